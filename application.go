@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gorilla/mux"
 	"html/template"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 /**************************************************************
@@ -17,6 +21,9 @@ import (
 // If DEBUG is set to true, Debug information are printed out in /var/log/web-1.log
 var DEBUG = true
 
+// AWS session shared by all AWS calls, set in OpenStores when needed
+var awsSession *session.Session
+
 // HTML Template for the index page
 var indexTemplate = template.Must(template.New("index-template.html").
 	Delims("[[", "]]").ParseFiles("templates/index-template.html"))
@@ -75,20 +82,124 @@ func dumpHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Request: %v\n", string(request))
 }
 
+/**************************************************************
+	Create the object store (with the AWS session shared by
+	all calls) and the ledger of the configuration
+ **************************************************************/
+func OpenStores() error {
+	if config.NeedsAWS() {
+		sess, err := NewAWSSession(config.AWS)
+		if err != nil {
+			return err
+		}
+		awsSession = sess
+	}
+
+	store, err := NewObjectStore(config.ObjectStore, awsSession)
+	if err != nil {
+		Error("Error creating object store: %v", err)
+		return err
+	}
+	objectStore = store
+
+	ledgerStore, err := NewLedgerStore(config.Ledger, objectStore)
+	if err != nil {
+		Error("Error creating ledger: %v", err)
+		return err
+	}
+	ledger = NewLedger(ledgerStore)
+	return nil
+}
+
 /**************************************************************
 	Main program
 	Logs in /var/log/web-1.log and /var/log/web-1.error.log
  **************************************************************/
 func main() {
+
+	// Run a command (e.g. ddl) instead of the web server, the lambda command as a Lambda custom runtime
+	args := os.Args[1:]
+	if len(args) == 0 && os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		args = []string{"lambda"}
+	}
+	if len(args) > 0 {
+		DEBUG = false
+		if err := RunCommand(args); err != nil {
+			Error("Error with command %v: %v", args[0], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	Info(">>>>> main")
 	DebugOS()
 	PrintMemUsage()
 
+	// Load configuration
+	cfg, err := LoadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		Error("Error loading configuration: %v", err)
+		log.Fatal(err)
+	}
+	config = cfg
+	subscriptions = NewSubscriptionRegistry(config.SNSTopicArns)
+
+	// Define Object Store and Ledger of the processed objects
+	if err := OpenStores(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Define Work Queue processing S3 files in the background, resuming the jobs of the journal
+	journal, err := OpenJournal(config.Journal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	workQueue, err = NewWorkQueue(config.QueueSize, config.Workers, journal, config.Retry,
+		func(record RecordType) error {
+			_, err := processRecord(objectStore, record)
+			return err
+		},
+		func(job *Job) error {
+			return Park(objectStore, job.Record, job.Attempts)
+		})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Queue the source files whose events were lost, every reconcile.interval
+	if interval, _ := config.ReconcileInterval(); interval > 0 {
+		reconciler = NewReconciler(objectStore, config.Catalog.Bucket, workQueue.Enqueue)
+		reconciler.Start(interval)
+	}
+
+	// Poll the SQS queue of the S3 notifications, deleting the messages once processed
+	if config.SQS.QueueURL != "" {
+		queue, err := NewSQSQueue(awsSession, config.SQS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sqsPoller = NewSQSPoller(queue, config.SQS.visibilityTimeout, config.Retry,
+			func(record RecordType) error {
+				_, err := processRecord(objectStore, record)
+				return err
+			},
+			func(record RecordType, attempts []Attempt) error {
+				return Park(objectStore, record, attempts)
+			})
+		sqsPoller.Start()
+		Info("Polling SQS queue %v", config.SQS.QueueURL)
+	}
+
 	// Define HTTP Router
 	r := mux.NewRouter()
 	r.HandleFunc("/", indexHandler)
 	r.HandleFunc("/dump", dumpHandler)
 	r.HandleFunc("/event", eventHandler)
+	r.HandleFunc("/subscriptions", subscriptionsHandler)
+	r.HandleFunc("/ddl", ddlHandler)
+	r.HandleFunc("/stats", statsHandler)
+	r.HandleFunc("/admin/reprocess", reprocessHandler)
+	r.HandleFunc("/admin/reconcile", reconcileHandler)
 	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", http.FileServer(http.Dir("./assets"))))
 	r.PathPrefix("/").HandlerFunc(indexHandler) // Catch-all
 	http.Handle("/", r)
@@ -100,11 +211,43 @@ func main() {
 		Info("Defaulting to port %s\n", port)
 	}
 
+	// On SIGTERM (e.g. Elastic Beanstalk deploy), stop accepting events and drain the work queue
+	server := &http.Server{Addr: ":" + port}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		Info("Received %v, shutting down", sig)
+
+		timeout, _ := config.ShutdownDuration()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			Error("Error shutting down server: %v", err)
+		}
+		if reconciler != nil {
+			reconciler.Stop()
+		}
+		if sqsPoller != nil {
+			if err := sqsPoller.Stop(ctx); err != nil {
+				Error("Error stopping SQS poller, %v messages not processed: %v", sqsPoller.Stats().Busy, err)
+			}
+		}
+		if err := workQueue.Shutdown(ctx); err != nil {
+			Error("Error draining work queue, %v records not processed: %v", workQueue.Stats().Queued, err)
+			return
+		}
+		Info("Work queue drained")
+	}()
+
 	// Serve application (plain HTTP protocol within Elastic Beanstalk network)
 	Info("Listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		Error("Error with ListenAndServe: %v", err)
 		log.Fatal(err)
 	}
+	<-drained
 
 }
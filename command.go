@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+/**************************************************************
+	Define Command Line Variables
+ **************************************************************/
+
+// Commands run instead of the web server, e.g. "./application ddl -dataset sales"
+var commands = map[string]func(args []string) error{
+	"ddl":       ddlCommand,
+	"lambda":    lambdaCommand,
+	"reprocess": reprocessCommand,
+}
+
+/**************************************************************
+	Run the command of args[0] with the arguments args[1:],
+	after loading the configuration
+ **************************************************************/
+func RunCommand(args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, expected %v", args[0], strings.Join(names, ", "))
+	}
+
+	cfg, err := LoadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return err
+	}
+	config = cfg
+
+	return command(args[1:])
+}
+
+/**************************************************************
+	Print the CREATE EXTERNAL TABLE statements of the datasets
+ **************************************************************/
+func ddlCommand(args []string) error {
+	flags := flag.NewFlagSet("ddl", flag.ContinueOnError)
+	dataset := flags.String("dataset", "", "Dataset of the table, all datasets by default")
+	bucket := flags.String("bucket", config.Catalog.Bucket, "Bucket of the parquet files")
+	database := flags.String("database", config.Catalog.Database, "Glue database of the table")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *bucket == "" {
+		return fmt.Errorf("bucket required, set -bucket or DATA_BUCKET")
+	}
+
+	ddl, err := config.DatasetsDDL(*dataset, *database, *bucket)
+	if err != nil {
+		return err
+	}
+	fmt.Print(ddl)
+	return nil
+}
+
+/**************************************************************
+	Process the files under a prefix again, printing the
+	report in JSON
+ **************************************************************/
+func reprocessCommand(args []string) error {
+	flags := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	bucket := flags.String("bucket", config.Catalog.Bucket, "Bucket of the files")
+	prefix := flags.String("prefix", "", "Prefix of the files, e.g. error/ or data/")
+	dryRun := flags.Bool("dry-run", false, "List the files without processing them")
+	concurrency := flags.Int("concurrency", config.Workers, "Files processed at the same time")
+	since := flags.String("since", "", "Only files last modified at or after this RFC3339 time")
+	until := flags.String("until", "", "Only files last modified before this RFC3339 time")
+	deleteParked := flags.Bool("delete-parked", false, "Delete the parked copies in error/ once processed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	options, err := ParseReprocessOptions(*bucket, *prefix, *since, *until, *concurrency, *dryRun, *deleteParked)
+	if err != nil {
+		return err
+	}
+
+	if err := OpenStores(); err != nil {
+		return err
+	}
+	report, err := Reprocess(objectStore, options)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%v of %v files failed", report.Failed, len(report.Files))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+/**************************************************************
+	Define Compression Variables
+ **************************************************************/
+
+// Compressions of input files
+const (
+	CompressionNone  = ""
+	CompressionGzip  = "gzip"
+	CompressionZstd  = "zstd"
+	CompressionBzip2 = "bzip2"
+)
+
+// Compressions of the file extensions
+var compressionExtensions = map[string]string{
+	".gz":   CompressionGzip,
+	".gzip": CompressionGzip,
+	".zst":  CompressionZstd,
+	".zstd": CompressionZstd,
+	".bz2":  CompressionBzip2,
+}
+
+// Magic bytes at the start of compressed content
+var compressionMagics = []struct {
+	magic       []byte
+	compression string
+}{
+	{[]byte{0x1f, 0x8b}, CompressionGzip},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, CompressionZstd},
+	{[]byte("BZh"), CompressionBzip2},
+}
+
+/**************************************************************
+	Detect the compression of the content of key from its
+	extension, its Content-Encoding, or else its magic bytes,
+	and return a reader of the decompressed content, streamed
+ **************************************************************/
+func Decompress(key string, info *ObjectInfo, content io.Reader) (io.ReadCloser, string, error) {
+	reader := bufio.NewReader(content)
+	compression := DetectCompression(key, info, reader)
+
+	switch compression {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(reader)
+		return gz, compression, err
+	case CompressionZstd:
+		zr, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, compression, err
+		}
+		return zr.IOReadCloser(), compression, nil
+	case CompressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(reader)), compression, nil
+	}
+	return ioutil.NopCloser(reader), compression, nil
+}
+
+// Detect the compression of the content of key, peeking at its first bytes
+func DetectCompression(key string, info *ObjectInfo, reader *bufio.Reader) string {
+	if compression, ok := compressionExtensions[strings.ToLower(path.Ext(key))]; ok {
+		return compression
+	}
+
+	if info != nil {
+		switch strings.ToLower(strings.TrimSpace(info.ContentEncoding)) {
+		case "gzip", "x-gzip":
+			return CompressionGzip
+		case "zstd":
+			return CompressionZstd
+		case "bzip2", "x-bzip2":
+			return CompressionBzip2
+		}
+	}
+
+	head, _ := reader.Peek(4)
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	return CompressionNone
+}
+
+/**************************************************************
+	Remove the compression extension (if any) then the format
+	extension of key, e.g. data/x.json.gz -> data/x
+ **************************************************************/
+func TrimExtensions(key string) string {
+	key = TrimCompressionExtension(key)
+	return strings.TrimSuffix(key, path.Ext(key))
+}
+
+// Remove the compression extension of key, e.g. data/x.json.gz -> data/x.json
+func TrimCompressionExtension(key string) string {
+	if _, ok := compressionExtensions[strings.ToLower(path.Ext(key))]; ok {
+		return strings.TrimSuffix(key, path.Ext(key))
+	}
+	return key
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Content of the compressed fixtures
+const compressTestContent = `[{"a": 100, "b": 200}]`
+
+// bzip2 of compressTestContent, the standard library has no bzip2 writer
+const compressTestBzip2 = "\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xe3\x55\x13\x0f\x00\x00\x08\x1b\x80\x50\x04\x70\x10\x00\x0a\x30\x00\x00\x0a\x20\x00\x21\x2a\x3d\x46\x87\xa9\x82\x01\xa0\x05\xc1\xfe\x63\xa7\x9a\xd0\xc9\xa4\x54\x58\xbb\x92\x29\xc2\x84\x87\x1a\xa8\x98\x78"
+
+// Fixtures of compressTestContent for each compression
+func compressFixtures(t *testing.T) map[string][]byte {
+	var gz bytes.Buffer
+	writer := gzip.NewWriter(&gz)
+	writer.Write([]byte(compressTestContent))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	return map[string][]byte{
+		CompressionNone:  []byte(compressTestContent),
+		CompressionGzip:  gz.Bytes(),
+		CompressionZstd:  encoder.EncodeAll([]byte(compressTestContent), nil),
+		CompressionBzip2: []byte(compressTestBzip2),
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	fixtures := compressFixtures(t)
+	tests := []struct {
+		name            string
+		key             string
+		contentEncoding string
+		fixture         string // Compression of the content
+		compression     string // Compression detected
+	}{
+		{"gzip extension", "data/test.json.gz", "", CompressionGzip, CompressionGzip},
+		{"gzip extension, upper case", "data/test.json.GZIP", "", CompressionGzip, CompressionGzip},
+		{"zstd extension", "data/test.json.zst", "", CompressionZstd, CompressionZstd},
+		{"zstd long extension", "data/test.json.zstd", "", CompressionZstd, CompressionZstd},
+		{"bzip2 extension", "data/test.json.bz2", "", CompressionBzip2, CompressionBzip2},
+		{"gzip Content-Encoding", "data/test.json", "gzip", CompressionGzip, CompressionGzip},
+		{"x-gzip Content-Encoding", "data/test.json", " X-GZIP ", CompressionGzip, CompressionGzip},
+		{"zstd Content-Encoding", "data/test.json", "zstd", CompressionZstd, CompressionZstd},
+		{"bzip2 Content-Encoding", "data/test.json", "x-bzip2", CompressionBzip2, CompressionBzip2},
+		{"gzip magic", "data/test.json", "", CompressionGzip, CompressionGzip},
+		{"zstd magic", "data/test.json", "", CompressionZstd, CompressionZstd},
+		{"bzip2 magic", "data/test.json", "", CompressionBzip2, CompressionBzip2},
+		{"uncompressed", "data/test.json", "", CompressionNone, CompressionNone},
+		{"uncompressed, identity Content-Encoding", "data/test.json", "identity", CompressionNone, CompressionNone},
+		{"extension before Content-Encoding", "data/test.json.zst", "gzip", CompressionZstd, CompressionZstd},
+		{"Content-Encoding before magic", "data/test.json", "zstd", CompressionZstd, CompressionZstd},
+	}
+	for _, test := range tests {
+		info := &ObjectInfo{ContentEncoding: test.contentEncoding}
+		reader, compression, err := Decompress(test.key, info, bytes.NewReader(fixtures[test.fixture]))
+		if err != nil || compression != test.compression {
+			t.Errorf("%v: compression %q, %v, expected %q", test.name, compression, err, test.compression)
+			continue
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(content) != compressTestContent {
+			t.Errorf("%v: content %q, %v", test.name, content, err)
+		}
+	}
+
+	// Short content, without info
+	for _, content := range []string{"", "[", "BZ"} {
+		reader := bufio.NewReader(strings.NewReader(content))
+		if compression := DetectCompression("data/test.json", nil, reader); compression != CompressionNone {
+			t.Errorf("%q: compression %q", content, compression)
+		}
+	}
+
+	// Content not matching the extension
+	reader, _, err := Decompress("data/test.json.gz", nil, strings.NewReader(compressTestContent))
+	if err == nil {
+		reader.Close()
+		t.Errorf("uncompressed .gz: expected an error")
+	}
+}
+
+func TestTrimExtensions(t *testing.T) {
+	tests := []struct {
+		key, compression, trimmed string
+	}{
+		{"data/test.json.gz", "data/test.json", "data/test"},
+		{"data/test.csv.ZST", "data/test.csv", "data/test"},
+		{"data/test.json.bz2", "data/test.json", "data/test"},
+		{"data/test.json", "data/test.json", "data/test"},
+		{"data/test", "data/test", "data/test"},
+		{"data/test.gz", "data/test", "data/test"},
+		{"data/test.tar.gz", "data/test.tar", "data/test"},
+		{"data/v1.2/test.zip", "data/v1.2/test.zip", "data/v1.2/test"},
+	}
+	for _, test := range tests {
+		if trimmed := TrimCompressionExtension(test.key); trimmed != test.compression {
+			t.Errorf("TrimCompressionExtension(%v): got %v, expected %v", test.key, trimmed, test.compression)
+		}
+		if trimmed := TrimExtensions(test.key); trimmed != test.trimmed {
+			t.Errorf("TrimExtensions(%v): got %v, expected %v", test.key, trimmed, test.trimmed)
+		}
+	}
+}
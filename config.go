@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**************************************************************
+	Define Configuration Variables
+ **************************************************************/
+
+// Configuration of the application, loaded in main
+var config = DefaultConfig()
+
+// Configuration of the application, read from the optional
+// JSON file CONFIG_FILE then overridden by environment variables
+type Config struct {
+	// Object store: "s3", "memory" or "file:<folder>" (OBJECT_STORE)
+	ObjectStore string `json:"objectStore,omitempty"`
+	// Topics whose subscriptions are confirmed automatically (SNS_TOPIC_ARNS, comma separated)
+	SNSTopicArns []string `json:"snsTopicArns,omitempty"`
+	// AWS session settings
+	AWS AWSConfig `json:"aws"`
+	// Datasets converted to parquet, routed by key prefix (default: DataObjectElement records)
+	Datasets []*Dataset `json:"datasets,omitempty"`
+	// Routes of the source keys to the parquet and error keys, the first matching route wins (default: data/ to processed/ and error/)
+	Routes []*Route `json:"routes,omitempty"`
+	// Handlers of the S3 events by event name and key prefix, the first matching rule wins (default: created objects converted, removed objects removed)
+	Events []*EventRule `json:"events,omitempty"`
+	// Ledger of the processed objects: "memory", "file:<folder>", "s3" or "s3:<prefix>", by default s3 with the s3 object store, else memory (LEDGER)
+	Ledger string `json:"ledger,omitempty"`
+	// Records waiting to be processed before /event responds 503 (QUEUE_SIZE)
+	QueueSize int `json:"queueSize,omitempty"`
+	// Number of records processed at the same time (WORKERS)
+	Workers int `json:"workers,omitempty"`
+	// Time given to queued records on SIGTERM, e.g. "30s" (SHUTDOWN_TIMEOUT)
+	ShutdownTimeout string `json:"shutdownTimeout,omitempty"`
+	// Folder of the journal of the pending records, "" to keep them in memory only (JOURNAL_DIR)
+	Journal string `json:"journal"`
+	// Retries of the records failing
+	Retry RetryPolicy `json:"retry"`
+	// Athena/Glue tables of the datasets
+	Catalog CatalogConfig `json:"catalog"`
+	// Policies of the parquet files of the removed objects
+	Removal RemovalConfig `json:"removal"`
+	// Reconciliation of the source files and the parquet files
+	Reconcile ReconcileConfig `json:"reconcile"`
+	// SQS queue of the S3 notifications, polled instead of receiving them at /event
+	SQS SQSConfig `json:"sqs"`
+	// Bearer token of the events posted to /event without SNS signature (S3, EventBridge or SQS envelopes), refused when empty (EVENT_TOKEN)
+	EventToken string `json:"eventToken,omitempty"`
+	// Bearer token of the /admin/ endpoints, disabled when empty (ADMIN_TOKEN)
+	AdminToken string `json:"adminToken,omitempty"`
+	// Bytes of rows buffered in memory by the partitions of a file before a parquet row group is written (ROW_GROUP_SIZE)
+	RowGroupSize int64 `json:"rowGroupSize,omitempty"`
+}
+
+// AWS session settings
+type AWSConfig struct {
+	// Region of the buckets (AWS_REGION)
+	Region string `json:"region,omitempty"`
+	// Custom S3 endpoint, e.g. http://localhost:9000 for MinIO (S3_ENDPOINT)
+	Endpoint string `json:"endpoint,omitempty"`
+	// Use path-style addressing http://endpoint/bucket/key (S3_FORCE_PATH_STYLE)
+	PathStyle bool `json:"pathStyle,omitempty"`
+	// Profile of the shared credentials file (AWS_PROFILE)
+	Profile string `json:"profile,omitempty"`
+	// Role to assume with the base credentials (ASSUME_ROLE_ARN)
+	AssumeRoleArn string `json:"assumeRoleArn,omitempty"`
+}
+
+// Configuration used when nothing is set
+func DefaultConfig() *Config {
+	return &Config{
+		ObjectStore: "s3",
+		AWS: AWSConfig{
+			Region: "us-west-1",
+		},
+		Datasets:        []*Dataset{DefaultDataset()},
+		Routes:          DefaultRoutes(),
+		Events:          DefaultEventRules(),
+		RowGroupSize:    128 * 1024 * 1024, //128M
+		QueueSize:       100,
+		Workers:         4,
+		ShutdownTimeout: "30s",
+		Journal:         filepath.Join(os.TempDir(), "demo-aws-journal"),
+		Retry: RetryPolicy{
+			MaxAttempts: 5,
+			BaseDelay:   "2s",
+			MaxDelay:    "5m",
+		},
+		Catalog: CatalogConfig{
+			Database: "default",
+			Prefix:   "catalog/",
+		},
+		Removal: RemovalConfig{
+			Archive:   "archive/",
+			Tombstone: "tombstone/",
+		},
+		SQS: SQSConfig{
+			MaxMessages:       10,
+			WaitTime:          "20s",
+			VisibilityTimeout: "2m",
+		},
+	}
+}
+
+/**************************************************************
+	Load the configuration from the JSON file filename (if
+	not empty) and the environment variables, and validate it
+ **************************************************************/
+func LoadConfig(filename string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if filename != "" {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			Error("Error reading config file %v: %v", filename, err)
+			return nil, err
+		}
+		cfg.Datasets, cfg.Routes, cfg.Events = nil, nil, nil
+		if err := json.Unmarshal(content, cfg); err != nil {
+			Error("Error decoding config file %v: %v", filename, err)
+			return nil, err
+		}
+		if len(cfg.Datasets) == 0 {
+			cfg.Datasets = []*Dataset{DefaultDataset()}
+		}
+		if len(cfg.Routes) == 0 {
+			cfg.Routes = DefaultRoutes()
+		}
+		if len(cfg.Events) == 0 {
+			cfg.Events = DefaultEventRules()
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Override settings with the environment variables which are set
+func (cfg *Config) applyEnv() error {
+	setString := func(name string, value *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*value = strings.TrimSpace(v)
+		}
+	}
+	setString("OBJECT_STORE", &cfg.ObjectStore)
+	setString("LEDGER", &cfg.Ledger)
+	setString("AWS_REGION", &cfg.AWS.Region)
+	setString("S3_ENDPOINT", &cfg.AWS.Endpoint)
+	setString("AWS_PROFILE", &cfg.AWS.Profile)
+	setString("ASSUME_ROLE_ARN", &cfg.AWS.AssumeRoleArn)
+	setString("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	setString("JOURNAL_DIR", &cfg.Journal)
+	setString("RETRY_BASE_DELAY", &cfg.Retry.BaseDelay)
+	setString("RETRY_MAX_DELAY", &cfg.Retry.MaxDelay)
+	setString("GLUE_DATABASE", &cfg.Catalog.Database)
+	setString("DATA_BUCKET", &cfg.Catalog.Bucket)
+	setString("ADMIN_TOKEN", &cfg.AdminToken)
+	setString("EVENT_TOKEN", &cfg.EventToken)
+	setString("RECONCILE_INTERVAL", &cfg.Reconcile.Interval)
+	setString("ARCHIVE_PREFIX", &cfg.Removal.Archive)
+	setString("TOMBSTONE_PREFIX", &cfg.Removal.Tombstone)
+	setString("SQS_QUEUE_URL", &cfg.SQS.QueueURL)
+	setString("SQS_VISIBILITY_TIMEOUT", &cfg.SQS.VisibilityTimeout)
+
+	if v, ok := os.LookupEnv("REMOVAL_POLICY"); ok {
+		if cfg.Removal.Policies == nil {
+			cfg.Removal.Policies = map[string]string{}
+		}
+		cfg.Removal.Policies["*"] = strings.TrimSpace(v)
+	}
+	if v, ok := os.LookupEnv("SNS_TOPIC_ARNS"); ok {
+		cfg.SNSTopicArns = splitList(v)
+	}
+	if v, ok := os.LookupEnv("ROW_GROUP_SIZE"); ok {
+		size, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("ROW_GROUP_SIZE: %v", err)
+		}
+		cfg.RowGroupSize = size
+	}
+	for name, value := range map[string]*int{"QUEUE_SIZE": &cfg.QueueSize, "WORKERS": &cfg.Workers, "RETRY_MAX_ATTEMPTS": &cfg.Retry.MaxAttempts} {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+			*value = n
+		}
+	}
+	if v, ok := os.LookupEnv("S3_FORCE_PATH_STYLE"); ok {
+		pathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("S3_FORCE_PATH_STYLE: %v", err)
+		}
+		cfg.AWS.PathStyle = pathStyle
+	}
+	if v, ok := os.LookupEnv("CATALOG_MANIFEST"); ok {
+		manifest, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("CATALOG_MANIFEST: %v", err)
+		}
+		cfg.Catalog.Manifest = manifest
+	}
+	return nil
+}
+
+/**************************************************************
+	Check the configuration is consistent
+ **************************************************************/
+func (cfg *Config) Validate() error {
+	switch {
+	case cfg.ObjectStore == "s3", cfg.ObjectStore == "memory":
+	case strings.HasPrefix(cfg.ObjectStore, "file:") && len(cfg.ObjectStore) > len("file:"):
+	default:
+		return fmt.Errorf("objectStore %q is not s3, memory or file:<folder>", cfg.ObjectStore)
+	}
+
+	// The markers of the s3 object store outlive restarts, unlike the memory ledger
+	if cfg.Ledger == "" {
+		cfg.Ledger = "memory"
+		if cfg.ObjectStore == "s3" {
+			cfg.Ledger = "s3"
+		}
+	}
+	switch {
+	case cfg.Ledger == "memory", cfg.Ledger == "s3":
+	case strings.HasPrefix(cfg.Ledger, "file:") && len(cfg.Ledger) > len("file:"):
+	case strings.HasPrefix(cfg.Ledger, "s3:") && strings.Trim(cfg.Ledger[len("s3:"):], "/") != "":
+	default:
+		return fmt.Errorf("ledger %q is not memory, file:<folder>, s3 or s3:<prefix>", cfg.Ledger)
+	}
+
+	if cfg.RowGroupSize < 1024*1024 {
+		return fmt.Errorf("rowGroupSize %v is below 1MB", cfg.RowGroupSize)
+	}
+
+	if cfg.QueueSize < 1 {
+		return fmt.Errorf("queueSize %v is below 1", cfg.QueueSize)
+	}
+	if cfg.Workers < 1 {
+		return fmt.Errorf("workers %v is below 1", cfg.Workers)
+	}
+	if _, err := cfg.ShutdownDuration(); err != nil {
+		return err
+	}
+	if err := cfg.Retry.Compile(); err != nil {
+		return err
+	}
+
+	if cfg.AWS.Region == "" {
+		return fmt.Errorf("aws.region is required")
+	}
+	if cfg.AWS.Endpoint != "" {
+		u, err := url.Parse(cfg.AWS.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("aws.endpoint %q is not a http(s) URL", cfg.AWS.Endpoint)
+		}
+	}
+	if cfg.AWS.AssumeRoleArn != "" && !strings.HasPrefix(cfg.AWS.AssumeRoleArn, "arn:") {
+		return fmt.Errorf("aws.assumeRoleArn %q is not an ARN", cfg.AWS.AssumeRoleArn)
+	}
+
+	if err := cfg.Removal.Validate(); err != nil {
+		return err
+	}
+
+	if cfg.SQS.QueueURL != "" {
+		if err := cfg.SQS.Compile(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Reconcile.Interval != "" {
+		if _, err := cfg.ReconcileInterval(); err != nil {
+			return err
+		}
+		if cfg.Catalog.Bucket == "" {
+			return fmt.Errorf("reconcile.interval requires catalog.bucket, the bucket to reconcile")
+		}
+	}
+
+	if cfg.Catalog.Database == "" {
+		return fmt.Errorf("catalog.database is required")
+	}
+	if cfg.Catalog.Manifest && strings.Trim(cfg.Catalog.Prefix, "/") == "" {
+		return fmt.Errorf("catalog.prefix is required with catalog.manifest")
+	}
+
+	names := map[string]bool{}
+	for _, dataset := range cfg.Datasets {
+		if err := dataset.Compile(); err != nil {
+			return err
+		}
+		if names[dataset.Name] {
+			return fmt.Errorf("duplicate dataset %v", dataset.Name)
+		}
+		names[dataset.Name] = true
+	}
+
+	for _, route := range cfg.Routes {
+		if err := route.Compile(); err != nil {
+			return err
+		}
+		if route.Dataset != "" && !names[route.Dataset] {
+			return fmt.Errorf("route %q: unknown dataset %v", route.Prefix, route.Dataset)
+		}
+	}
+
+	for _, rule := range cfg.Events {
+		if err := rule.Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**************************************************************
+	Find the dataset of a key, the one with the longest
+	matching prefix
+ **************************************************************/
+func (cfg *Config) DatasetFor(key string) (*Dataset, error) {
+	var found *Dataset
+	for _, dataset := range cfg.Datasets {
+		if strings.HasPrefix(key, dataset.Prefix) && (found == nil || len(dataset.Prefix) > len(found.Prefix)) {
+			found = dataset
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w %v", ErrNoDataset, key)
+	}
+	return found, nil
+}
+
+// Time given to queued records on SIGTERM
+func (cfg *Config) ShutdownDuration() (time.Duration, error) {
+	timeout, err := time.ParseDuration(cfg.ShutdownTimeout)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("shutdownTimeout %q is not a duration, e.g. 30s", cfg.ShutdownTimeout)
+	}
+	return timeout, nil
+}
+
+// Time between two reconciliations, 0 when disabled
+func (cfg *Config) ReconcileInterval() (time.Duration, error) {
+	if cfg.Reconcile.Interval == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(cfg.Reconcile.Interval)
+	if err != nil || interval < time.Minute {
+		return 0, fmt.Errorf("reconcile.interval %q is not a duration of at least 1m, e.g. 1h", cfg.Reconcile.Interval)
+	}
+	return interval, nil
+}
+
+// Does the configuration need an AWS session
+func (cfg *Config) NeedsAWS() bool {
+	return cfg.ObjectStore == "s3" || cfg.SQS.QueueURL != ""
+}
+
+// Settings of the S3 clients only, the custom endpoint must not
+// apply to the STS calls of the assumed role or to SQS
+func (cfg AWSConfig) S3Config() *aws.Config {
+	s3Config := &aws.Config{S3ForcePathStyle: aws.Bool(cfg.PathStyle)}
+	if cfg.Endpoint != "" {
+		s3Config.Endpoint = aws.String(cfg.Endpoint)
+	}
+	return s3Config
+}
+
+/**************************************************************
+	Create the AWS session shared by all AWS calls, and check
+	credentials can be resolved
+ **************************************************************/
+func NewAWSSession(cfg AWSConfig) (*session.Session, error) {
+	awsConfig := aws.Config{
+		Region: aws.String(cfg.Region),
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		Profile:           cfg.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		Error("Error creating AWS session: %v", err)
+		return nil, err
+	}
+
+	// Assume a role with the base credentials
+	if cfg.AssumeRoleArn != "" {
+		sess = sess.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(sess, cfg.AssumeRoleArn),
+		})
+	}
+
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		Error("Error getting AWS credentials: %v", err)
+		return nil, err
+	}
+
+	Info("AWS session in region %v (endpoint %q, path style %v, profile %q, role %q)",
+		cfg.Region, cfg.Endpoint, cfg.PathStyle, cfg.Profile, cfg.AssumeRoleArn)
+	return sess, nil
+}
+
+/**************************************************************
+	Utility to split a comma separated list, ignoring blanks
+ **************************************************************/
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Default configuration for the test, restored when the test ends
+func withConfig(t *testing.T) {
+	previous := config
+	config = DefaultConfig()
+	t.Cleanup(func() { config = previous })
+}
+
+// Ledger of markers ledger/<key>.json in store, restored when the test ends
+func withLedger(t *testing.T, store ObjectStore) {
+	previous := ledger
+	ledger = NewLedger(NewMarkerLedgerStore(store, "", "ledger/"))
+	t.Cleanup(func() { ledger = previous })
+}
+
+func TestNewAWSSessionEndpoint(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	cfg := AWSConfig{Region: "eu-west-1", Endpoint: "http://localhost:9000", PathStyle: true}
+
+	sess, err := NewAWSSession(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The custom endpoint applies to the S3 clients only, not to STS (assumed role)
+	if endpoint := sts.New(sess).Endpoint; endpoint == cfg.Endpoint || !strings.HasSuffix(endpoint, ".amazonaws.com") {
+		t.Errorf("STS endpoint %v", endpoint)
+	}
+	store := NewS3Store(sess, cfg.S3Config())
+	if client := s3.New(store.sess); client.Endpoint != cfg.Endpoint || !aws.BoolValue(client.Config.S3ForcePathStyle) {
+		t.Errorf("S3 endpoint %v, path style %v", client.Endpoint, aws.BoolValue(client.Config.S3ForcePathStyle))
+	}
+}
+
+func TestLoadConfigLedger(t *testing.T) {
+	tests := []struct {
+		objectStore, ledger, expected string
+	}{
+		{"s3", "", "s3"},
+		{"memory", "", "memory"},
+		{"file:/tmp/buckets", "", "memory"},
+		{"s3", "memory", "memory"},
+		{"s3", "s3:markers", "s3:markers"},
+		{"file:/tmp/buckets", "file:/tmp/ledger", "file:/tmp/ledger"},
+	}
+	for _, test := range tests {
+		t.Setenv("OBJECT_STORE", test.objectStore)
+		t.Setenv("LEDGER", test.ledger)
+		cfg, err := LoadConfig("")
+		if err != nil {
+			t.Errorf("%v with ledger %q: %v", test.objectStore, test.ledger, err)
+		} else if cfg.Ledger != test.expected {
+			t.Errorf("%v with ledger %q: got %v, expected %v", test.objectStore, test.ledger, cfg.Ledger, test.expected)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+/**************************************************************
+	CSVOptions describe how a dataset reads CSV and TSV files
+ **************************************************************/
+type CSVOptions struct {
+	// Field delimiter, default "," for .csv files and tab for .tsv files
+	Delimiter string `json:"delimiter,omitempty"`
+	// Quote character, default '"', a doubled quote inside a quoted field is a quote
+	Quote string `json:"quote,omitempty"`
+	// Unquoted values read as null, default [""]
+	NullValues []string `json:"nullValues,omitempty"`
+	// The file has no header line, fields are the dataset columns in order
+	NoHeader bool `json:"noHeader,omitempty"`
+	// Column of each header name, by default the column with the same name (ignoring case)
+	HeaderMap map[string]string `json:"headerMap,omitempty"`
+}
+
+// Check the options, delimiter and quote are single characters
+func (options *CSVOptions) Validate(dataset *Dataset) error {
+	for name, value := range map[string]string{"delimiter": options.Delimiter, "quote": options.Quote} {
+		if value != "" && utf8.RuneCountInString(value) != 1 {
+			return fmt.Errorf("csv %v %q is not a single character", name, value)
+		}
+	}
+	if options.Delimiter != "" && options.Delimiter == options.Quote {
+		return fmt.Errorf("csv delimiter and quote are both %q", options.Delimiter)
+	}
+	for header, name := range options.HeaderMap {
+		if _, ok := dataset.Column(name); !ok {
+			return fmt.Errorf("csv headerMap %v: %v is not a column", header, name)
+		}
+	}
+	return nil
+}
+
+/**************************************************************
+	Read CSV (or TSV) records into rows of a dataset, values
+	are converted to the column types. Errors report the row
+	number (1 for the first record after the header) and line.
+ **************************************************************/
+type csvReader struct {
+	reader    *bufio.Reader
+	dataset   *Dataset
+	delimiter rune
+	quote     rune
+	nulls     map[string]bool
+	columns   []string // Column of each field, "" to ignore the field
+	line      int      // Line of the next character
+	row       int
+}
+
+// Field of a CSV record
+type csvField struct {
+	value  string
+	quoted bool
+}
+
+// Create a RowReader of the CSV in r, delimiter is used when the dataset doesn't set one
+func NewCSVReader(r io.Reader, dataset *Dataset, delimiter rune) RowReader {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	options := dataset.CSV
+	csv := &csvReader{
+		reader:    reader,
+		dataset:   dataset,
+		delimiter: delimiter,
+		quote:     '"',
+		nulls:     map[string]bool{"": true},
+		line:      1,
+	}
+	if options.Delimiter != "" {
+		csv.delimiter, _ = utf8.DecodeRuneInString(options.Delimiter)
+	}
+	if options.Quote != "" {
+		csv.quote, _ = utf8.DecodeRuneInString(options.Quote)
+	}
+	if options.NullValues != nil {
+		csv.nulls = map[string]bool{}
+		for _, value := range options.NullValues {
+			csv.nulls[value] = true
+		}
+	}
+	if options.NoHeader {
+		for _, column := range dataset.Columns {
+			csv.columns = append(csv.columns, column.Name)
+		}
+	}
+	return csv
+}
+
+func (csv *csvReader) Next() (Row, error) {
+	// Map the header names to columns
+	if csv.columns == nil {
+		header, line, err := csv.readRecord()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, &RowError{Line: line, Err: fmt.Errorf("header: %v", err)}
+		}
+		csv.columns = csv.mapHeader(header)
+	}
+
+	fields, line, err := csv.readRecord()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	csv.row++
+	if err != nil {
+		return nil, &RowError{Record: csv.row, Line: line, Err: err}
+	}
+	if len(fields) > len(csv.columns) {
+		values := make([]string, len(fields))
+		for i, field := range fields {
+			values[i] = field.value
+		}
+		return nil, &RowError{Record: csv.row, Line: line, Err: fmt.Errorf("%v fields, expected %v", len(fields), len(csv.columns)), Content: values}
+	}
+
+	record := map[string]interface{}{}
+	for i, field := range fields {
+		if csv.columns[i] == "" {
+			continue
+		}
+		if !field.quoted && csv.nulls[field.value] {
+			record[csv.columns[i]] = nil
+		} else {
+			record[csv.columns[i]] = field.value
+		}
+	}
+	row, err := csv.dataset.NewRow(record)
+	if err != nil {
+		return nil, &RowError{Record: csv.row, Line: line, Err: err, Content: record}
+	}
+	return row, nil
+}
+
+// Column of each header name, "" for names without column
+func (csv *csvReader) mapHeader(header []csvField) []string {
+	columns := make([]string, len(header))
+	for i, field := range header {
+		name := strings.TrimSpace(field.value)
+		if column, ok := csv.dataset.CSV.HeaderMap[name]; ok {
+			columns[i] = column
+			continue
+		}
+		for _, column := range csv.dataset.Columns {
+			if strings.EqualFold(column.Name, name) {
+				columns[i] = column.Name
+				break
+			}
+		}
+		if columns[i] == "" {
+			Debug("Ignoring CSV field %q without column in dataset %v", name, csv.dataset.Name)
+		}
+	}
+	return columns
+}
+
+// Read the fields of the next record and its first line, skipping blank lines; io.EOF at the end
+func (csv *csvReader) readRecord() ([]csvField, int, error) {
+	for {
+		line := csv.line
+		fields, blank, err := csv.readFields()
+		if err != nil || !blank {
+			return fields, line, err
+		}
+	}
+}
+
+// Read the fields of one record, which can span lines in quoted fields
+func (csv *csvReader) readFields() ([]csvField, bool, error) {
+	fields := []csvField{}
+	var value strings.Builder
+	quoted, inQuotes, afterQuote, empty := false, false, false, true
+
+	for {
+		r, _, err := csv.reader.ReadRune()
+		if err == io.EOF {
+			if inQuotes {
+				return nil, false, fmt.Errorf("unterminated quoted field")
+			}
+			if empty {
+				return nil, false, io.EOF
+			}
+			return append(fields, csvField{value.String(), quoted}), false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if r == '\n' {
+			csv.line++
+		}
+
+		switch {
+		case inQuotes && r == csv.quote:
+			// Either a doubled quote or the end of the quoted field
+			if next, _, err := csv.reader.ReadRune(); err == nil && next == csv.quote {
+				value.WriteRune(csv.quote)
+			} else {
+				if err == nil {
+					csv.reader.UnreadRune()
+				}
+				inQuotes, afterQuote = false, true
+			}
+		case inQuotes:
+			value.WriteRune(r)
+		case r == csv.delimiter:
+			fields = append(fields, csvField{value.String(), quoted})
+			value.Reset()
+			quoted, afterQuote, empty = false, false, false
+		case r == '\n':
+			if empty {
+				return nil, true, nil
+			}
+			return append(fields, csvField{strings.TrimSuffix(value.String(), "\r"), quoted}), false, nil
+		case r == '\r' && afterQuote:
+			// Line ending after a quoted field
+		case afterQuote:
+			return nil, false, fmt.Errorf("unexpected %q after quoted field", r)
+		case r == csv.quote && value.Len() == 0:
+			quoted, inQuotes, empty = true, true, false
+		default:
+			value.WriteRune(r)
+			if r != '\r' {
+				empty = false
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Dataset of the CSV tests, reading with options
+func csvTestDataset(t *testing.T, options CSVOptions) *Dataset {
+	dataset := &Dataset{
+		Name: "people",
+		Columns: []Column{
+			{Name: "name", Type: "BYTE_ARRAY", LogicalType: "UTF8", Nullable: true},
+			{Name: "qty", Type: "INT64", Nullable: true},
+			{Name: "note", Type: "BYTE_ARRAY", LogicalType: "UTF8", Nullable: true},
+		},
+		CSV: options,
+	}
+	if err := dataset.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	return dataset
+}
+
+func TestCSVReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   CSVOptions
+		delimiter rune
+		content   string
+		rows      []Row
+	}{
+		{
+			name:    "header and rows",
+			content: "name,qty,note\nAda,3,first\nBob,4,second\n",
+			rows:    []Row{{"name": "Ada", "qty": int64(3), "note": "first"}, {"name": "Bob", "qty": int64(4), "note": "second"}},
+		},
+		{
+			name:    "header order and case, unknown and missing fields",
+			content: "Note,extra,NAME\nfirst,x,Ada\n",
+			rows:    []Row{{"name": "Ada", "qty": nil, "note": "first"}},
+		},
+		{
+			name:    "quoted delimiters",
+			content: "name,note\n\"Lovelace, Ada\",\"a,b,c\"\n",
+			rows:    []Row{{"name": "Lovelace, Ada", "qty": nil, "note": "a,b,c"}},
+		},
+		{
+			name:    "escaped quotes",
+			content: "name,note\nAda,\"she said \"\"hello\"\"\"\n\"\"\"\",x\n",
+			rows:    []Row{{"name": "Ada", "qty": nil, "note": `she said "hello"`}, {"name": `"`, "qty": nil, "note": "x"}},
+		},
+		{
+			name:    "embedded newlines",
+			content: "name,note\nAda,\"line 1\nline 2\r\nline 3\"\nBob,x\n",
+			rows:    []Row{{"name": "Ada", "qty": nil, "note": "line 1\nline 2\r\nline 3"}, {"name": "Bob", "qty": nil, "note": "x"}},
+		},
+		{
+			name:    "CRLF and blank lines",
+			content: "name,qty\r\n\r\nAda,3\r\n\nBob,\"4\"\r\n",
+			rows:    []Row{{"name": "Ada", "qty": int64(3), "note": nil}, {"name": "Bob", "qty": int64(4), "note": nil}},
+		},
+		{
+			name:    "no final newline",
+			content: "name,qty\nAda,3",
+			rows:    []Row{{"name": "Ada", "qty": int64(3), "note": nil}},
+		},
+		{
+			name:    "empty values are null, quoted ones are strings",
+			content: "name,qty,note\n,,\"\"\n",
+			rows:    []Row{{"name": nil, "qty": nil, "note": ""}},
+		},
+		{
+			name:    "nullValues",
+			options: CSVOptions{NullValues: []string{"NULL", "-"}},
+			content: "name,qty,note\nNULL,-,\n\"NULL\",3,\"-\"\n",
+			rows:    []Row{{"name": nil, "qty": nil, "note": ""}, {"name": "NULL", "qty": int64(3), "note": "-"}},
+		},
+		{
+			name:    "noHeader",
+			options: CSVOptions{NoHeader: true},
+			content: "Ada,3,first\nBob\n",
+			rows:    []Row{{"name": "Ada", "qty": int64(3), "note": "first"}, {"name": "Bob", "qty": nil, "note": nil}},
+		},
+		{
+			name:    "headerMap",
+			options: CSVOptions{HeaderMap: map[string]string{"Full Name": "name", "Quantity": "qty"}},
+			content: "Full Name,Quantity,name\nAda,3,ignored?\n",
+			rows:    []Row{{"name": "ignored?", "qty": int64(3), "note": nil}},
+		},
+		{
+			name:      "TSV",
+			delimiter: '\t',
+			content:   "name\tqty\tnote\nLovelace, Ada\t3\t\"tab\there\"\n",
+			rows:      []Row{{"name": "Lovelace, Ada", "qty": int64(3), "note": "tab\there"}},
+		},
+		{
+			name:    "delimiter and quote options",
+			options: CSVOptions{Delimiter: ";", Quote: "'"},
+			content: "name;note\n'Ada; Bob';'it''s \"x\"'\n",
+			rows:    []Row{{"name": "Ada; Bob", "qty": nil, "note": `it's "x"`}},
+		},
+		{
+			name:    "empty file",
+			content: "",
+			rows:    []Row{},
+		},
+		{
+			name:    "header only",
+			content: "name,qty,note\n",
+			rows:    []Row{},
+		},
+	}
+	for _, test := range tests {
+		delimiter := test.delimiter
+		if delimiter == 0 {
+			delimiter = ','
+		}
+		rows, err := readRows(NewCSVReader(strings.NewReader(test.content), csvTestDataset(t, test.options), delimiter))
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(rows, test.rows) {
+			t.Errorf("%v: got %v, expected %v", test.name, rows, test.rows)
+		}
+	}
+}
+
+func TestCSVReaderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		rows    int
+		record  int
+		line    int
+		err     string
+	}{
+		{name: "unterminated quote", content: "name,note\nAda,x\nBob,\"open\n", rows: 1, record: 2, line: 3, err: "row 2 (line 3): unterminated quoted field"},
+		{name: "text after quote", content: "name,note\n\"Ada\"x,y\n", record: 1, line: 2, err: `unexpected 'x' after quoted field`},
+		{name: "too many fields", content: "name,qty\nAda,3,x\n", record: 1, line: 2, err: "3 fields, expected 2"},
+		{name: "invalid value", content: "name,qty\nAda,3\n\n\"Bob\nB\",three\n", rows: 1, record: 2, line: 4, err: "row 2 (line 4): column qty:"},
+		{name: "line after multi-line field", content: "name,note\nAda,\"a\nb\"\nBob,x,y\n", rows: 1, record: 2, line: 4, err: "row 2 (line 4)"},
+		{name: "header", content: "\"name,qty\n", line: 1, err: "line 1: header: unterminated quoted field"},
+	}
+	for _, test := range tests {
+		rows, err := readRows(NewCSVReader(strings.NewReader(test.content), csvTestDataset(t, CSVOptions{}), ','))
+		var rowErr *RowError
+		if len(rows) != test.rows || !errors.As(err, &rowErr) || rowErr.Record != test.record || rowErr.Line != test.line || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: %v rows, got %v, expected %q", test.name, len(rows), err, test.err)
+		}
+	}
+}
+
+func TestCSVOptionsValidate(t *testing.T) {
+	tests := []struct {
+		options CSVOptions
+		err     string
+	}{
+		{CSVOptions{Delimiter: ";", Quote: "'"}, ""},
+		{CSVOptions{Delimiter: "\t"}, ""},
+		{CSVOptions{Delimiter: ";;"}, "csv delimiter \";;\" is not a single character"},
+		{CSVOptions{Quote: "''"}, "csv quote"},
+		{CSVOptions{Delimiter: "'", Quote: "'"}, "csv delimiter and quote are both"},
+		{CSVOptions{HeaderMap: map[string]string{"Full Name": "fullname"}}, "csv headerMap Full Name: fullname is not a column"},
+	}
+	for _, test := range tests {
+		dataset := &Dataset{Name: "people", Columns: []Column{{Name: "name", Type: "BYTE_ARRAY", LogicalType: "UTF8"}}, CSV: test.options}
+		err := dataset.CSV.Validate(dataset)
+		if (test.err == "" && err != nil) || (test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err))) {
+			t.Errorf("%+v: got %v, expected %q", test.options, err, test.err)
+		}
+	}
+}
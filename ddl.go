@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+/**************************************************************
+	Define Catalog Variables
+ **************************************************************/
+
+// Athena (Hive) types of the parquet types, logical types first
+var athenaTypes = map[string]string{
+	"UTF8":             "string",
+	"DATE":             "date",
+	"TIMESTAMP_MILLIS": "timestamp",
+	"TIMESTAMP_MICROS": "timestamp",
+	"INT_8":            "tinyint",
+	"INT_16":           "smallint",
+	"INT_32":           "int",
+	"INT_64":           "bigint",
+	"BOOLEAN":          "boolean",
+	"INT32":            "int",
+	"INT64":            "bigint",
+	"FLOAT":            "float",
+	"DOUBLE":           "double",
+	"BYTE_ARRAY":       "string",
+}
+
+// Hive classes of parquet tables
+const (
+	parquetInputFormat  = "org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"
+	parquetOutputFormat = "org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"
+	parquetSerde        = "org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe"
+)
+
+// Settings of the Athena/Glue tables of the datasets
+type CatalogConfig struct {
+	// Glue database of the tables (GLUE_DATABASE)
+	Database string `json:"database,omitempty"`
+	// Bucket of the parquet files, in the LOCATION of the tables (DATA_BUCKET)
+	Bucket string `json:"bucket,omitempty"`
+	// Write the Glue table manifest and ALTER TABLE ADD PARTITION statements to the bucket (CATALOG_MANIFEST)
+	Manifest bool `json:"manifest,omitempty"`
+	// Folder of the manifests and statements, e.g. catalog/sales/table.json
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// Glue TableInput, as read by "aws glue create-table --table-input"
+type GlueTable struct {
+	Name              string                `json:"Name"`
+	TableType         string                `json:"TableType"`
+	Parameters        map[string]string     `json:"Parameters"`
+	PartitionKeys     []GlueColumn          `json:"PartitionKeys"`
+	StorageDescriptor GlueStorageDescriptor `json:"StorageDescriptor"`
+}
+
+// Glue column
+type GlueColumn struct {
+	Name string `json:"Name"`
+	Type string `json:"Type"`
+}
+
+// Glue storage of a table
+type GlueStorageDescriptor struct {
+	Columns      []GlueColumn `json:"Columns"`
+	Location     string       `json:"Location"`
+	InputFormat  string       `json:"InputFormat"`
+	OutputFormat string       `json:"OutputFormat"`
+	SerdeInfo    struct {
+		SerializationLibrary string            `json:"SerializationLibrary"`
+		Parameters           map[string]string `json:"Parameters"`
+	} `json:"SerdeInfo"`
+}
+
+/**************************************************************
+	Folder of the parquet files of a dataset, the Location of
+	the dataset, or else the fixed start of the output
+	template of its route, e.g. processed/
+ **************************************************************/
+func (cfg *Config) TableLocation(dataset *Dataset) string {
+	if dataset.Location != "" {
+		return strings.TrimSuffix(dataset.Location, "/") + "/"
+	}
+
+	var found *Route
+	for _, route := range cfg.Routes {
+		if route.Dataset == dataset.Name {
+			found = route
+			break
+		}
+		if route.Dataset == "" && found == nil {
+			found = route
+		}
+	}
+	if found == nil {
+		return ""
+	}
+
+	var location strings.Builder
+	for _, part := range found.output {
+		if part.placeholder && part.text != "dataset" {
+			break
+		}
+		if part.placeholder {
+			location.WriteString(dataset.Name)
+		} else {
+			location.WriteString(part.text)
+		}
+	}
+	folder := location.String()
+	return folder[:strings.LastIndex(folder, "/")+1]
+}
+
+/**************************************************************
+	CREATE EXTERNAL TABLE statement of the parquet files of a
+	dataset in database, located in bucket
+ **************************************************************/
+func (cfg *Config) DDL(dataset *Dataset, database, bucket string) string {
+	var ddl strings.Builder
+	fmt.Fprintf(&ddl, "CREATE EXTERNAL TABLE IF NOT EXISTS %v.%v (\n", athenaName(database), athenaName(dataset.Name))
+	for i, column := range dataset.Columns {
+		fmt.Fprintf(&ddl, "  %v %v%v\n", athenaName(column.Name), column.athenaType(), separator(i, len(dataset.Columns)))
+	}
+	ddl.WriteString(")\n")
+
+	if len(dataset.Partitions) > 0 {
+		ddl.WriteString("PARTITIONED BY (\n")
+		for i, partition := range dataset.Partitions {
+			fmt.Fprintf(&ddl, "  %v string%v\n", athenaName(partition.Name), separator(i, len(dataset.Partitions)))
+		}
+		ddl.WriteString(")\n")
+	}
+
+	ddl.WriteString("STORED AS PARQUET\n")
+	fmt.Fprintf(&ddl, "LOCATION '%v'\n", s3URL(bucket, cfg.TableLocation(dataset)))
+	ddl.WriteString("TBLPROPERTIES ('parquet.compression'='SNAPPY');\n")
+	return ddl.String()
+}
+
+// Athena type of a column
+func (column Column) athenaType() string {
+	if column.LogicalType != "" {
+		return athenaTypes[column.LogicalType]
+	}
+	return athenaTypes[column.Type]
+}
+
+// Quote an Athena name, e.g. `sales`
+func athenaName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// Comma between list items
+func separator(i, n int) string {
+	if i < n-1 {
+		return ","
+	}
+	return ""
+}
+
+// URL of a folder in a bucket, e.g. s3://deglon/processed/
+func s3URL(bucket, folder string) string {
+	return "s3://" + bucket + "/" + strings.TrimPrefix(folder, "/")
+}
+
+/**************************************************************
+	Glue table manifest of a dataset, located in bucket
+ **************************************************************/
+func (cfg *Config) GlueTable(dataset *Dataset, bucket string) *GlueTable {
+	table := &GlueTable{
+		Name:          dataset.Name,
+		TableType:     "EXTERNAL_TABLE",
+		Parameters:    map[string]string{"classification": "parquet", "EXTERNAL": "TRUE", "parquet.compression": "SNAPPY"},
+		PartitionKeys: []GlueColumn{},
+	}
+	for _, column := range dataset.Columns {
+		table.StorageDescriptor.Columns = append(table.StorageDescriptor.Columns, GlueColumn{column.Name, column.athenaType()})
+	}
+	for _, partition := range dataset.Partitions {
+		table.PartitionKeys = append(table.PartitionKeys, GlueColumn{partition.Name, "string"})
+	}
+	table.StorageDescriptor.Location = s3URL(bucket, cfg.TableLocation(dataset))
+	table.StorageDescriptor.InputFormat = parquetInputFormat
+	table.StorageDescriptor.OutputFormat = parquetOutputFormat
+	table.StorageDescriptor.SerdeInfo.SerializationLibrary = parquetSerde
+	table.StorageDescriptor.SerdeInfo.Parameters = map[string]string{"serialization.format": "1"}
+	return table
+}
+
+/**************************************************************
+	ALTER TABLE ADD PARTITION statement of the partition path
+	(e.g. dt=2020-04-06/hour=21) of a dataset in folder
+ **************************************************************/
+func AddPartitionDDL(dataset *Dataset, database, partition, bucket, folder string) string {
+	values := []string{}
+	for _, folder := range strings.Split(partition, "/") {
+		kv := strings.SplitN(folder, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value, err := url.PathUnescape(kv[1])
+		if err != nil {
+			value = kv[1]
+		}
+		values = append(values, fmt.Sprintf("%v='%v'", athenaName(kv[0]), strings.Replace(value, "'", "''", -1)))
+	}
+	return fmt.Sprintf("ALTER TABLE %v.%v ADD IF NOT EXISTS PARTITION (%v) LOCATION '%v';\n",
+		athenaName(database), athenaName(dataset.Name), strings.Join(values, ", "), s3URL(bucket, strings.TrimSuffix(folder, "/")+"/"))
+}
+
+// Folder of the partition in the parquet key, e.g. processed/dt=2020-04-06/ of processed/dt=2020-04-06/2020/test.json.parquet
+func partitionFolder(key, partition string) string {
+	if i := strings.Index("/"+key, "/"+partition+"/"); i >= 0 {
+		return key[:i+len(partition)+1]
+	}
+	return path.Dir(key)
+}
+
+/**************************************************************
+	Write the Glue table manifest of the dataset, and the
+	ALTER TABLE ADD PARTITION statement of each new partition
+	of the parquet files, to the catalog folder of bucket
+ **************************************************************/
+func WriteCatalog(store ObjectStore, bucket string, dataset *Dataset, files []ParquetFile) error {
+	folder := path.Join(config.Catalog.Prefix, dataset.Name)
+
+	// Table manifest, written once
+	manifest := folder + "/table.json"
+	if _, err := store.Head(bucket, manifest); errors.Is(err, ErrObjectNotFound) {
+		content, err := json.MarshalIndent(config.GlueTable(dataset, bucket), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := store.Put(bucket, manifest, bytes.NewReader(content)); err != nil {
+			return err
+		}
+		Info("Glue table manifest s3://%v/%v written", bucket, manifest)
+	} else if err != nil {
+		return err
+	}
+
+	// Statements of the new partitions
+	for _, file := range files {
+		if file.Partition == "" {
+			continue
+		}
+		statement := folder + "/partitions/" + file.Partition + ".sql"
+		_, err := store.Head(bucket, statement)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+		ddl := AddPartitionDDL(dataset, config.Catalog.Database, file.Partition, bucket, partitionFolder(file.Key, file.Partition))
+		if err := store.Put(bucket, statement, strings.NewReader(ddl)); err != nil {
+			return err
+		}
+		Info("New partition %v of dataset %v: s3://%v/%v written", file.Partition, dataset.Name, bucket, statement)
+	}
+	return nil
+}
+
+/**************************************************************
+	Define /ddl Handler, the CREATE EXTERNAL TABLE statements
+	of the datasets (all, or ?dataset=name), with the LOCATION
+	in catalog.bucket or ?bucket=name
+ **************************************************************/
+func ddlHandler(w http.ResponseWriter, r *http.Request) {
+	Info(">>>>> ddlHandler")
+
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		bucket = config.Catalog.Bucket
+	}
+	if bucket == "" {
+		http.Error(w, "Bad Request: bucket required, set catalog.bucket or ?bucket=", http.StatusBadRequest)
+		return
+	}
+
+	ddl, err := config.DatasetsDDL(r.URL.Query().Get("dataset"), config.Catalog.Database, bucket)
+	if err != nil {
+		http.Error(w, "Not Found: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, ddl)
+}
+
+// DDL of the dataset name, or of all datasets when name is empty
+func (cfg *Config) DatasetsDDL(name, database, bucket string) (string, error) {
+	statements := []string{}
+	for _, dataset := range cfg.Datasets {
+		if name == "" || dataset.Name == name {
+			statements = append(statements, cfg.DDL(dataset, database, bucket))
+		}
+	}
+	if len(statements) == 0 {
+		return "", fmt.Errorf("unknown dataset %v", name)
+	}
+	return strings.Join(statements, "\n"), nil
+}
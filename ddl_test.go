@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// Store counting the objects written to each key
+type countingStore struct {
+	*MemoryStore
+	puts map[string]int
+}
+
+func (store *countingStore) Put(bucket, key string, content io.Reader) error {
+	store.puts[key]++
+	return store.MemoryStore.Put(bucket, key, content)
+}
+
+func TestDDL(t *testing.T) {
+	cfg := DefaultConfig()
+	unpartitioned := cfg.Datasets[0]
+	partitioned := DefaultDataset()
+	partitioned.Name = "sales`s"
+	partitioned.Columns = append(partitioned.Columns,
+		Column{Name: "name", Type: "BYTE_ARRAY", LogicalType: "UTF8"},
+		Column{Name: "day", Type: "INT32", LogicalType: "DATE"},
+		Column{Name: "qty", Type: "INT64"},
+		Column{Name: "paid", Type: "BOOLEAN"})
+	partitioned.Partitions = []Partition{{Name: "dt", Format: "date"}, {Name: "hour", Format: "hour"}}
+	if err := partitioned.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dataset *Dataset
+		ddl     string
+	}{
+		{unpartitioned, "CREATE EXTERNAL TABLE IF NOT EXISTS `db`.`default` (\n" +
+			"  `a` float,\n" +
+			"  `b` float,\n" +
+			"  `total` float,\n" +
+			"  `created_ts` timestamp\n" +
+			")\n" +
+			"STORED AS PARQUET\n" +
+			"LOCATION 's3://deglon/processed/'\n" +
+			"TBLPROPERTIES ('parquet.compression'='SNAPPY');\n"},
+		{partitioned, "CREATE EXTERNAL TABLE IF NOT EXISTS `db`.`sales``s` (\n" +
+			"  `a` float,\n" +
+			"  `b` float,\n" +
+			"  `total` float,\n" +
+			"  `created_ts` timestamp,\n" +
+			"  `name` string,\n" +
+			"  `day` date,\n" +
+			"  `qty` bigint,\n" +
+			"  `paid` boolean\n" +
+			")\n" +
+			"PARTITIONED BY (\n" +
+			"  `dt` string,\n" +
+			"  `hour` string\n" +
+			")\n" +
+			"STORED AS PARQUET\n" +
+			"LOCATION 's3://deglon/processed/'\n" +
+			"TBLPROPERTIES ('parquet.compression'='SNAPPY');\n"},
+	}
+	for _, test := range tests {
+		if ddl := cfg.DDL(test.dataset, "db", "deglon"); ddl != test.ddl {
+			t.Errorf("%v: got\n%v\nexpected\n%v", test.dataset.Name, ddl, test.ddl)
+		}
+	}
+}
+
+func TestAddPartitionDDL(t *testing.T) {
+	dataset := &Dataset{Name: "sales`s"}
+	tests := []struct {
+		partition, folder, ddl string
+	}{
+		{"dt=2020-04-06", "processed/dt=2020-04-06",
+			"ALTER TABLE `db`.`sales``s` ADD IF NOT EXISTS PARTITION (`dt`='2020-04-06') LOCATION 's3://deglon/processed/dt=2020-04-06/';\n"},
+		{"dt=2020-04-06/hour=21", "processed/dt=2020-04-06/hour=21/",
+			"ALTER TABLE `db`.`sales``s` ADD IF NOT EXISTS PARTITION (`dt`='2020-04-06', `hour`='21') LOCATION 's3://deglon/processed/dt=2020-04-06/hour=21/';\n"},
+		{"country=O%27Hare/c`ol=x", "processed/country=O%27Hare/c`ol=x/",
+			"ALTER TABLE `db`.`sales``s` ADD IF NOT EXISTS PARTITION (`country`='O''Hare', `c``ol`='x') LOCATION 's3://deglon/processed/country=O%27Hare/c`ol=x/';\n"},
+		{"name=it's", "/processed/name=it's",
+			"ALTER TABLE `db`.`sales``s` ADD IF NOT EXISTS PARTITION (`name`='it''s') LOCATION 's3://deglon/processed/name=it's/';\n"},
+	}
+	for _, test := range tests {
+		if ddl := AddPartitionDDL(dataset, "db", test.partition, "deglon", test.folder); ddl != test.ddl {
+			t.Errorf("%v: got\n%v\nexpected\n%v", test.partition, ddl, test.ddl)
+		}
+	}
+}
+
+func TestTableLocation(t *testing.T) {
+	cfg := DefaultConfig()
+	dataset := cfg.Datasets[0]
+	sales := &Dataset{Name: "sales"}
+	cfg.Routes = append([]*Route{
+		{Prefix: "sales/", Dataset: "sales", Output: "processed/{dataset}/{yyyy}/{basename}.parquet", Error: "error/{filename}"},
+		{Prefix: "orders/", Dataset: "orders", Output: "{dataset}/{basename}.parquet", Error: "error/{filename}"},
+		{Prefix: "other/", Dataset: "other", Output: "{yyyy}/{basename}.parquet", Error: "error/{filename}"},
+	}, cfg.Routes...)
+	for _, route := range cfg.Routes {
+		if err := route.Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		dataset  *Dataset
+		location string
+	}{
+		{dataset, "processed/"},
+		{sales, "processed/sales/"},
+		{&Dataset{Name: "orders"}, "orders/"},
+		{&Dataset{Name: "other"}, ""},
+		{&Dataset{Name: "sales", Location: "tables/sales"}, "tables/sales/"},
+		{&Dataset{Name: "sales", Location: "tables/sales/"}, "tables/sales/"},
+	}
+	for _, test := range tests {
+		if location := cfg.TableLocation(test.dataset); location != test.location {
+			t.Errorf("%v (location %q): got %q, expected %q", test.dataset.Name, test.dataset.Location, location, test.location)
+		}
+	}
+
+	// The first route without dataset when no route names the dataset
+	cfg.Routes = cfg.Routes[3:]
+	if location := cfg.TableLocation(sales); location != "processed/" {
+		t.Errorf("sales without route: got %q", location)
+	}
+	cfg.Routes = nil
+	if location := cfg.TableLocation(sales); location != "" {
+		t.Errorf("sales without routes: got %q", location)
+	}
+}
+
+func TestWriteCatalog(t *testing.T) {
+	withConfig(t)
+	config.Catalog.Database = "db"
+	dataset := DefaultDataset()
+	dataset.Partitions = []Partition{{Name: "dt", Format: "date"}}
+	if err := dataset.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{MemoryStore: NewMemoryStore(), puts: map[string]int{}}
+
+	batches := [][]ParquetFile{
+		{{Key: "processed/dt=2020-04-05/test.json.parquet", Partition: "dt=2020-04-05"}, {Key: "processed/dt=2020-04-06/2020/test.json.parquet", Partition: "dt=2020-04-06"}},
+		{{Key: "processed/dt=2020-04-06/other.json.parquet", Partition: "dt=2020-04-06"}, {Key: "processed/dt=2020-04-07/other.json.parquet", Partition: "dt=2020-04-07"}},
+		{},
+	}
+	for _, files := range batches {
+		if err := WriteCatalog(store, "deglon", dataset, files); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]int{
+		"catalog/default/table.json":                   1,
+		"catalog/default/partitions/dt=2020-04-05.sql": 1,
+		"catalog/default/partitions/dt=2020-04-06.sql": 1,
+		"catalog/default/partitions/dt=2020-04-07.sql": 1,
+	}
+	if len(store.puts) != len(expected) {
+		t.Errorf("puts %v, expected %v", store.puts, expected)
+	}
+	for key, puts := range expected {
+		if store.puts[key] != puts {
+			t.Errorf("%v written %v times, expected %v", key, store.puts[key], puts)
+		}
+	}
+
+	content, err := store.Get("deglon", "catalog/default/partitions/dt=2020-04-06.sql")
+	expectedDDL := "ALTER TABLE `db`.`default` ADD IF NOT EXISTS PARTITION (`dt`='2020-04-06') LOCATION 's3://deglon/processed/dt=2020-04-06/';\n"
+	if err != nil || string(content) != expectedDDL {
+		t.Errorf("partition dt=2020-04-06: got %q, %v, expected %q", content, err, expectedDDL)
+	}
+
+	content, err = store.Get("deglon", "catalog/default/table.json")
+	expectedTable := `{
+  "Name": "default",
+  "TableType": "EXTERNAL_TABLE",
+  "Parameters": {
+    "EXTERNAL": "TRUE",
+    "classification": "parquet",
+    "parquet.compression": "SNAPPY"
+  },
+  "PartitionKeys": [
+    {
+      "Name": "dt",
+      "Type": "string"
+    }
+  ],
+  "StorageDescriptor": {
+    "Columns": [
+      {
+        "Name": "a",
+        "Type": "float"
+      },
+      {
+        "Name": "b",
+        "Type": "float"
+      },
+      {
+        "Name": "total",
+        "Type": "float"
+      },
+      {
+        "Name": "created_ts",
+        "Type": "timestamp"
+      }
+    ],
+    "Location": "s3://deglon/processed/",
+    "InputFormat": "org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat",
+    "OutputFormat": "org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat",
+    "SerdeInfo": {
+      "SerializationLibrary": "org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe",
+      "Parameters": {
+        "serialization.format": "1"
+      }
+    }
+  }
+}`
+	if err != nil || strings.TrimSpace(string(content)) != expectedTable {
+		t.Errorf("table manifest: got\n%s\n%v", content, err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/**************************************************************
+	Define Envelope Variables
+ **************************************************************/
+
+// Error returned when an event without SNS signature has no valid event token
+var ErrInvalidEventToken = errors.New("invalid event token")
+
+// Envelopes of the S3 events
+const (
+	// SNS notification, its Message being another envelope
+	EnvelopeSNS = "sns"
+	// S3 notification, with a Records array (also the S3 event of Lambda)
+	EnvelopeS3 = "s3"
+	// EventBridge event of source aws.s3, e.g. detail-type "Object Created"
+	EnvelopeEventBridge = "eventbridge"
+	// SQS messages of Lambda (Records of eventSource aws:sqs), their body being another envelope
+	EnvelopeSQS = "sqs"
+	// SNS notifications of Lambda (Records of EventSource aws:sns), their Sns.Message being another envelope
+	EnvelopeLambdaSNS = "lambda-sns"
+)
+
+// Envelope of the Records of each event source
+var recordEnvelopes = map[string]string{
+	"aws:s3":  EnvelopeS3,
+	"aws:sqs": EnvelopeSQS,
+	"aws:sns": EnvelopeLambdaSNS,
+}
+
+// Most envelopes wrapped in each other, e.g. S3 in SNS in SQS
+const maxEnvelopeDepth = 4
+
+// S3 event name of the EventBridge detail-types of S3
+var eventBridgeNames = map[string]string{
+	"Object Created":               "ObjectCreated:",
+	"Object Deleted":               "ObjectRemoved:",
+	"Object Restore Initiated":     "ObjectRestore:Post",
+	"Object Restore Completed":     "ObjectRestore:Completed",
+	"Object Restore Expired":       "ObjectRestore:Delete",
+	"Object Tags Added":            "ObjectTagging:Put",
+	"Object Tags Deleted":          "ObjectTagging:Delete",
+	"Object ACL Updated":           "ObjectAcl:Put",
+	"Object Storage Class Changed": "LifecycleTransition",
+}
+
+// S3 event name suffix of the reasons of the EventBridge "Object Created" events
+var eventBridgeCreated = map[string]string{
+	"PutObject":               "Put",
+	"POST Object":             "Post",
+	"CopyObject":              "Copy",
+	"CompleteMultipartUpload": "CompleteMultipartUpload",
+}
+
+// Fields telling the envelopes apart
+type envelopeProbe struct {
+	// SNS
+	Type     string `json:"Type"`
+	TopicArn string `json:"TopicArn"`
+	Message  string `json:"Message"`
+	// EventBridge
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Detail     json.RawMessage `json:"detail"`
+	// S3, SQS and SNS of Lambda
+	Records []struct {
+		EventSource string `json:"eventSource"`
+		Body        string `json:"body"`
+		Sns         struct {
+			Message string `json:"Message"`
+		} `json:"Sns"`
+	} `json:"Records"`
+	// S3 test event, sent when the notification is set up
+	Event string `json:"Event"`
+}
+
+// EventBridge event of S3
+type eventBridgeEvent struct {
+	DetailType string    `json:"detail-type"`
+	Source     string    `json:"source"`
+	Time       time.Time `json:"time"`
+	Region     string    `json:"region"`
+	Detail     struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key       string `json:"key"`
+			Size      int64  `json:"size"`
+			ETag      string `json:"etag"`
+			Sequencer string `json:"sequencer"`
+		} `json:"object"`
+		RequestID       string `json:"request-id"`
+		Requester       string `json:"requester"`
+		SourceIPAddress string `json:"source-ip-address"`
+		Reason          string `json:"reason"`
+		DeletionType    string `json:"deletion-type"`
+	} `json:"detail"`
+}
+
+/**************************************************************
+	Detect the envelope of the event body: sns, s3,
+	eventbridge, sqs or lambda-sns
+ **************************************************************/
+func DetectEnvelope(body []byte) (string, error) {
+	var probe envelopeProbe
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return "", fmt.Errorf("decoding event: %v", err)
+	}
+	return probe.envelope()
+}
+
+func (probe *envelopeProbe) envelope() (string, error) {
+	switch {
+	case probe.Type != "" && probe.TopicArn != "":
+		return EnvelopeSNS, nil
+	case probe.DetailType != "" && probe.Detail != nil:
+		return EnvelopeEventBridge, nil
+	case len(probe.Records) > 0:
+		envelope, ok := recordEnvelopes[probe.Records[0].EventSource]
+		if !ok {
+			return "", fmt.Errorf("unknown event source %q of records, expected aws:s3, aws:sqs or aws:sns", probe.Records[0].EventSource)
+		}
+		return envelope, nil
+	case probe.Records != nil || probe.Event == "s3:TestEvent":
+		return EnvelopeS3, nil
+	}
+	return "", fmt.Errorf("unknown event envelope, expected SNS, S3, EventBridge or SQS")
+}
+
+/**************************************************************
+	Normalize the event body into S3 records, unwrapping the
+	envelopes: S3 notifications as they are, EventBridge
+	events as one record, and the S3 events in SNS
+	notifications and SQS messages (also the SNS records of
+	Lambda), decoding their URL-encoded keys. The S3 test
+	event has no record.
+ **************************************************************/
+func NormalizeS3Event(body []byte) (*MessageType, error) {
+	records, err := normalizeEnvelope(body, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageType{Records: records}, nil
+}
+
+// S3 records of the envelope body, wrapped in depth envelopes
+func normalizeEnvelope(body []byte, depth int) ([]RecordType, error) {
+	if depth >= maxEnvelopeDepth {
+		return nil, fmt.Errorf("more than %v envelopes", maxEnvelopeDepth)
+	}
+	var probe envelopeProbe
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, fmt.Errorf("decoding event: %v", err)
+	}
+	envelope, err := probe.envelope()
+	if err != nil {
+		return nil, err
+	}
+
+	switch envelope {
+	case EnvelopeSNS:
+		if probe.Type != "Notification" {
+			return nil, fmt.Errorf("unexpected SNS message %v", probe.Type)
+		}
+		return normalizeEnvelope([]byte(probe.Message), depth+1)
+
+	case EnvelopeSQS:
+		records := []RecordType{}
+		for i, message := range probe.Records {
+			if message.EventSource != "aws:sqs" {
+				return nil, fmt.Errorf("SQS record %v: unexpected event source %q", i+1, message.EventSource)
+			}
+			messageRecords, err := normalizeEnvelope([]byte(message.Body), depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("SQS record %v: %v", i+1, err)
+			}
+			records = append(records, messageRecords...)
+		}
+		return records, nil
+
+	case EnvelopeLambdaSNS:
+		records := []RecordType{}
+		for i, message := range probe.Records {
+			if message.EventSource != "aws:sns" {
+				return nil, fmt.Errorf("SNS record %v: unexpected event source %q", i+1, message.EventSource)
+			}
+			messageRecords, err := normalizeEnvelope([]byte(message.Sns.Message), depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("SNS record %v: %v", i+1, err)
+			}
+			records = append(records, messageRecords...)
+		}
+		return records, nil
+
+	case EnvelopeEventBridge:
+		record, err := eventBridgeRecord(body)
+		if err != nil {
+			return nil, err
+		}
+		return []RecordType{record}, nil
+	}
+
+	var message MessageType
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, fmt.Errorf("decoding S3 notification: %v", err)
+	}
+	for i, record := range message.Records {
+		if record.EventSource != "aws:s3" {
+			return nil, fmt.Errorf("S3 record %v: unexpected event source %q", i+1, record.EventSource)
+		}
+		// Keys of S3 notifications are URL-encoded ("+" for spaces), unlike the keys of EventBridge events
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("S3 record %v: key %q: %v", i+1, record.S3.Object.Key, err)
+		}
+		message.Records[i].S3.Object.Key = key
+	}
+	return message.Records, nil
+}
+
+/**************************************************************
+	Convert an EventBridge event of S3 to the S3 record of the
+	same change, e.g. "Object Created" of reason PutObject to
+	ObjectCreated:Put
+ **************************************************************/
+func eventBridgeRecord(body []byte) (RecordType, error) {
+	var record RecordType
+	var event eventBridgeEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return record, fmt.Errorf("decoding EventBridge event: %v", err)
+	}
+	if event.Source != "aws.s3" {
+		return record, fmt.Errorf("unexpected EventBridge source %q, expected aws.s3", event.Source)
+	}
+	detail := event.Detail
+
+	// Event name, unknown detail-types being kept so they match no event rule
+	name, ok := eventBridgeNames[event.DetailType]
+	if !ok {
+		name = "EventBridge:" + strings.ReplaceAll(event.DetailType, " ", "")
+	}
+	switch event.DetailType {
+	case "Object Created":
+		if suffix, ok := eventBridgeCreated[detail.Reason]; ok {
+			name += suffix
+		} else {
+			name += strings.ReplaceAll(detail.Reason, " ", "")
+		}
+	case "Object Deleted":
+		if detail.Reason == "Lifecycle Expiration" {
+			name = "LifecycleExpiration:"
+		}
+		if detail.DeletionType == "Delete Marker Created" {
+			name += "DeleteMarkerCreated"
+		} else {
+			name += "Delete"
+		}
+	}
+
+	record.EventVersion = "2.1"
+	record.EventSource = "aws:s3"
+	record.AwsRegion = event.Region
+	record.EventTime = event.Time
+	record.EventName = name
+	record.UserIdentity.PrincipalId = detail.Requester
+	record.RequestParameters.SourceIPAddress = detail.SourceIPAddress
+	record.ResponseElements.XAmzRequestId = detail.RequestID
+	record.S3.S3SchemaVersion = "1.0"
+	record.S3.Bucket.Name = detail.Bucket.Name
+	record.S3.Bucket.Arn = "arn:aws:s3:::" + detail.Bucket.Name
+	record.S3.Object.Key = detail.Object.Key
+	record.S3.Object.Size = detail.Object.Size
+	record.S3.Object.ETag = detail.Object.ETag
+	record.S3.Object.Sequencer = detail.Object.Sequencer
+	if record.S3.Bucket.Name == "" || record.S3.Object.Key == "" {
+		return record, fmt.Errorf("EventBridge event %v without bucket or key", event.DetailType)
+	}
+	return record, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeS3EventSamples(t *testing.T) {
+	tests := []struct {
+		file      string
+		envelope  string
+		eventName string
+		key       string
+	}{
+		{"s3.json", EnvelopeS3, "ObjectCreated:Put", "data/test.json"},
+		{"sns.json", EnvelopeSNS, "ObjectCreated:Put", "data/test.json"},
+		{"eventbridge-created.json", EnvelopeEventBridge, "ObjectCreated:Put", "data/test.json"},
+		{"eventbridge-deleted.json", EnvelopeEventBridge, "ObjectRemoved:DeleteMarkerCreated", "data/test.json"},
+		{"sqs.json", EnvelopeSQS, "ObjectCreated:Put", "data/test.json"},
+		{"lambda-sns.json", EnvelopeLambdaSNS, "ObjectCreated:Put", "data/test.json"},
+		// Keys of S3 notifications are URL-encoded, data/my+file%281%29.json being data/my file(1).json
+		{"s3-encoded-key.json", EnvelopeS3, "ObjectCreated:Put", "data/my file(1).json"},
+		{"sns-encoded-key.json", EnvelopeSNS, "ObjectCreated:Put", "data/my file(1).json"},
+		{"sqs-encoded-key.json", EnvelopeSQS, "ObjectCreated:Put", "data/my file(1).json"},
+		{"lambda-sns-encoded-key.json", EnvelopeLambdaSNS, "ObjectCreated:Put", "data/my file(1).json"},
+		// Keys of EventBridge events are raw
+		{"eventbridge-raw-key.json", EnvelopeEventBridge, "ObjectCreated:Put", "data/my file+(1)%.json"},
+	}
+	samples, err := filepath.Glob(filepath.Join("events", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != len(tests) {
+		t.Errorf("%v samples in events/, %v tested", len(samples), len(tests))
+	}
+
+	for _, test := range tests {
+		body, err := ioutil.ReadFile(filepath.Join("events", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope, err := DetectEnvelope(body)
+		if err != nil || envelope != test.envelope {
+			t.Errorf("%v: envelope %q, %v, expected %v", test.file, envelope, err, test.envelope)
+		}
+		message, err := NormalizeS3Event(body)
+		if err != nil {
+			t.Errorf("%v: %v", test.file, err)
+			continue
+		}
+		if len(message.Records) != 1 {
+			t.Errorf("%v: %v records", test.file, len(message.Records))
+			continue
+		}
+		record := message.Records[0]
+		if record.EventSource != "aws:s3" || record.EventName != test.eventName || record.S3.Bucket.Name != "deglon" || record.S3.Object.Key != test.key || record.S3.Object.Sequencer == "" {
+			t.Errorf("%v: record %v %v s3://%v/%v (sequencer %q)", test.file, record.EventSource, record.EventName, record.S3.Bucket.Name, record.S3.Object.Key, record.S3.Object.Sequencer)
+		}
+	}
+}
+
+func TestNormalizeS3EventErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"unknown event source", `{"Records":[{"eventSource":"aws:kinesis","kinesis":{"data":"e30="}}]}`, `unknown event source "aws:kinesis"`},
+		{"S3 record without event source", `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"deglon"},"object":{"key":"data/test.json"}}}]}`, "unknown event source"},
+		{"mixed S3 records", `{"Records":[{"eventSource":"aws:s3"},{"eventSource":"aws:sqs"}]}`, `S3 record 2: unexpected event source "aws:sqs"`},
+		{"SNS record of unknown envelope", `{"Records":[{"EventSource":"aws:sns","Sns":{"Message":"{\"hello\":\"world\"}"}}]}`, "SNS record 1: unknown event envelope"},
+		{"SQS message of unknown event source", `{"Records":[{"eventSource":"aws:sqs","body":"{\"Records\":[{\"eventSource\":\"aws:dynamodb\"}]}"}]}`, `SQS record 1: unknown event source "aws:dynamodb"`},
+		{"unknown envelope", `{"hello":"world"}`, "unknown event envelope"},
+		{"invalid key encoding", `{"Records":[{"eventSource":"aws:s3","s3":{"bucket":{"name":"deglon"},"object":{"key":"data/100%.json"}}}]}`, `S3 record 1: key "data/100%.json"`},
+	}
+	for _, test := range tests {
+		if _, err := NormalizeS3Event([]byte(test.body)); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got %v, expected %q", test.name, err, test.err)
+		}
+	}
+
+	// The S3 test event has no record
+	if message, err := NormalizeS3Event([]byte(`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"deglon"}`)); err != nil || len(message.Records) != 0 {
+		t.Errorf("S3 test event: %+v, %v", message, err)
+	}
+}
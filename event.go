@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"path/filepath"
 	"strings"
 	"time"
 )
@@ -20,6 +22,11 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Read event from http.Request
 	event, err := ReadS3Event(r)
+	if errors.Is(err, ErrInvalidSignature) || errors.Is(err, ErrInvalidEventToken) {
+		Error("Rejecting event: %v", err)
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		Error("Error reading event: %v", err)
 		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
@@ -27,80 +34,225 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	event.Print()
 
-	// In case of "Notification", process each S3 files in Records
-	if event.Type == "Notification" {
-		for _, e := range event.MessageObject.Records {
-			if e.EventName != "ObjectRemoved:Delete" {
-				// Read S3 file
-				data, err := ReadS3File(e.S3.Bucket.Name, e.S3.Object.Key)
-				if err != nil {
-					Error("Error with file s3://%v/%v", e.S3.Bucket.Name, e.S3.Object.Key)
-				} else {
-					// Process file content
-					err = doWork(data, e.S3.Bucket.Name, e.S3.Object.Key)
-					if err != nil {
-						Error("Error doing work with file s3://%v/%v", e.S3.Bucket.Name, e.S3.Object.Key)
-					}
+	switch event.Type {
+	case "SubscriptionConfirmation":
+		// Confirm subscriptions to allowed topics
+		if err := subscriptions.Confirm(event); err != nil {
+			http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	case "UnsubscribeConfirmation":
+		subscriptions.Unsubscribed(event)
+
+	case "Notification":
+		// In case of "Notification", process each S3 files in Records matching an event rule
+		records := config.FilterEvents(event.MessageObject.Records)
+
+		// Without queue, process S3 files before responding
+		if workQueue == nil {
+			for _, e := range records {
+				if _, err := processRecord(objectStore, e); err != nil {
+					Park(objectStore, e, []Attempt{NewAttempt(err)})
 				}
 			}
+			break
 		}
+
+		// Queue S3 files to process them in the background, SNS retries when the queue is full
+		if err := workQueue.Enqueue(records); err != nil {
+			Error("Error queuing %v records: %v", len(records), err)
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		Debug("Queued %v records", len(records))
 	}
 
 	fmt.Fprintf(w, "OK")
 }
 
 /**************************************************************
-	Do the work on the JSON content from s3://bucket/item
+	Process the S3 object of the event record with the handler
+	of its event rule, unless the ledger already has it, and
+	record it in the ledger. Returns the reason why the record
+	was skipped (SkipIgnored, SkipUnrouted, SkipLedger), empty
+	when processed.
  **************************************************************/
-func doWork(content []byte, bucket, item string) error {
+func processRecord(store ObjectStore, record RecordType) (string, error) {
+	rule := config.EventRuleFor(record)
+	if rule == nil {
+		eventCounters.Unmatched(record)
+		return SkipUnmatched, nil
+	}
+	if rule.Handler == HandlerIgnore {
+		Info("Ignoring %v of s3://%v/%v (event rule %q)", record.EventName, record.S3.Bucket.Name, record.S3.Object.Key, rule.Event)
+		eventCounters.Skipped(SkipIgnored)
+		return SkipIgnored, nil
+	}
 
-	Debug("Working on data: %v", B2S(content))
+	// Only the routed keys are recorded in the ledger, other files (e.g. processed/) are skipped
+	if _, _, err := config.RouteOf(record.S3.Object.Key); err != nil {
+		Info("Skipping file s3://%v/%v: %v", record.S3.Bucket.Name, record.S3.Object.Key, err)
+		eventCounters.Skipped(SkipUnrouted)
+		return SkipUnrouted, nil
+	}
 
-	// Marshal content to a Go object
-	var object DataObjectType
-	err := json.Unmarshal(content, &object)
+	if !ledger.Begin(record) {
+		eventCounters.Skipped(SkipLedger)
+		return SkipLedger, nil
+	}
+	eventCounters.Handled(rule.Handler)
+
+	// Apply the removal policy to the parquet files of removed objects
+	if rule.Handler == HandlerRemove {
+		status, outputs, err := removeWork(store, record)
+		if err != nil {
+			Error("Error removing parquet files of s3://%v/%v", record.S3.Bucket.Name, record.S3.Object.Key)
+			ledger.Done(record, "", nil)
+			return "", err
+		}
+		ledger.Done(record, status, outputs)
+		return "", nil
+	}
+
+	outputs, err := doWork(store, record)
 	if err != nil {
-		Error("Error reading JSON data %v: %v", B2S(content), err)
-		return err
+		Error("Error doing work with file s3://%v/%v", record.S3.Bucket.Name, record.S3.Object.Key)
+		ledger.Done(record, "", nil)
+		return "", err
+	}
+	ledger.Done(record, LedgerProcessed, outputs)
+	return "", nil
+}
+
+/**************************************************************
+	Do the work on the JSON content of the S3 object of the
+	event record, streaming it from store and writing results
+	to store, returning the keys of the parquet files. Errors
+	of the content are permanent, other errors (e.g. of the
+	store) can be retried.
+ **************************************************************/
+func doWork(store ObjectStore, record RecordType) ([]string, error) {
+	bucket, item := record.S3.Bucket.Name, record.S3.Object.Key
+
+	// Time of the partitions and of the date parts of keys
+	eventTime := record.EventTime
+	if eventTime.IsZero() {
+		eventTime = time.Now()
+	}
+
+	// Find the route and the dataset of the item, ErrNoRoute for other files (e.g. processed/)
+	route, dataset, err := config.RouteOf(item)
+	if err != nil {
+		Info("Skipping file s3://%v/%v: %v", bucket, item, err)
+		return nil, err
+	}
+	Debug("Route %q and dataset %v for s3://%v/%v", route.Prefix, dataset.Name, bucket, item)
+
+	// Translate s3 item (e.g. data/test.json) into parquet item (e.g. processed/test.json.parquet)
+	// and error parking lot item (e.g. error/test.json) with the templates of the route
+	itemParquet, itemError, err := route.Keys(bucket, item, dataset.Name, "", eventTime)
+	if err != nil {
+		Error("Error with file s3://%v/%v: %v", bucket, item, err)
+		return nil, Permanent(AtStage(StageRoute, err))
+	}
+	// NDJSON item of the rows rejected (e.g. rejected/test.json.ndjson)
+	itemRejected, err := route.RejectedKey(bucket, item, dataset.Name, eventTime)
+	if err != nil {
+		Error("Error with file s3://%v/%v: %v", bucket, item, err)
+		return nil, Permanent(AtStage(StageRoute, err))
+	}
+	// Parquet item of each partition of the dataset (e.g. processed/dt=2020-04-06/test.json.parquet)
+	keyOf := func(partition string) (string, error) {
+		output, _, err := route.Keys(bucket, item, dataset.Name, partition, eventTime)
+		return output, AtStage(StageRoute, err)
+	}
+
+	// Open the S3 file
+	content, info, err := store.Open(bucket, item)
+	if err != nil {
+		Error("Error with file s3://%v/%v", bucket, item)
+		return nil, AtStage(StageDownload, err)
+	}
+	defer content.Close()
+	Debug("Working on s3://%v/%v (%v bytes)", bucket, item, info.Size)
+
+	// Errors of the content are permanent, unless reading the file failed
+	source := &sourceReader{Reader: content}
+	contentError := func(err error) error {
+		if source.err != nil {
+			return AtStage(StageDownload, fmt.Errorf("reading s3://%v/%v: %v", bucket, item, source.err))
+		}
+		return Permanent(err)
 	}
 
-	// Execute the work, here add total = a + b, and set Timestamp to now in milliseconds
-	for i := range object {
-		object[i].Total = object[i].A + object[i].B
-		object[i].Timestamp = time.Now().UnixNano() / 1000000 // TIMESTAMP_MILLIS
+	// Decompress the content (gzip, zstd, bzip2)
+	decompressed, compression, err := Decompress(item, info, source)
+	if err != nil {
+		Error("Error decompressing file s3://%v/%v: %v", bucket, item, err)
+		return nil, contentError(AtStage(StageDecompress, err))
 	}
+	defer decompressed.Close()
 
-	// Translate s3 item (e.g. data/test.json) into parquet item (e.g. processed/test.parquet)
-	itemParquet := strings.Replace(item, "data", "processed", 1)
-	itemParquet = strings.Replace(itemParquet, filepath.Ext(item), "", 1)
-	itemParquet += ".parquet"
+	// Read the content as rows of the dataset
+	reader, format, err := NewRowReader(TrimCompressionExtension(item), decompressed, dataset)
+	if err != nil {
+		Error("Error reading file s3://%v/%v: %v", bucket, item, err)
+		return nil, contentError(AtStage(StageFormat, err))
+	}
+	Debug("Format %v (compression %q) for s3://%v/%v", format, compression, bucket, item)
 
-	// Translate s3 item (e.g. data/test.json) into error parking lot item (e.g. error/test.json)
-	itemError := strings.Replace(item, "data", "error", 1)
+	// Execute the work on each row, computing derived columns, and set aside the invalid rows
+	rows := NewRowRejecter(NewDerivedRowReader(reader, dataset, &ExprEnv{
+		Now:       time.Now(),
+		EventTime: record.EventTime,
+	}), dataset)
+	defer rows.Close()
 
 	Debug("Raw filename s3://%v/%v", bucket, item)
 	Debug("Processed filename s3://%v/%v", bucket, itemParquet)
 	Debug("Error filename s3://%v/%v", bucket, itemError)
+	Debug("Rejected filename s3://%v/%v", bucket, itemRejected)
 
-	// Write content to parquet file s3://bucket/itemParquet
-	err = WriteToParquet(object, bucket, itemParquet)
+	// Write content to parquet files s3://bucket/itemParquet, one per partition
+	files, err := WriteToParquet(store, dataset, rows, eventTime, bucket, keyOf)
 	if err != nil {
 		Error("Error processing file s3://%v/%v: %v", bucket, item, err)
-		// In case of an error processing file, copy file to the error folder
-		err2 := CopyS3File(bucket, item, bucket, itemError)
-		if err2 != nil {
-			Error("Error copying file s3://%v/%v to s3://%v/%v: %v", bucket, item, bucket, itemError, err2)
+		if IsPermanent(err) {
+			return nil, contentError(err)
 		}
-		return err
+		return nil, err
 	}
 
-	Info("Parquet file s3://%v/%v ready", bucket, itemParquet)
+	Info("%v parquet file(s) ready for s3://%v/%v", len(files), bucket, item)
 
-	return nil
+	// Write the rows rejected next to the parquet files
+	if rows.Rejected() > 0 {
+		if err := rows.Upload(store, bucket, itemRejected); err != nil {
+			return nil, AtStage(StageUpload, err)
+		}
+		Info("%v row(s) of s3://%v/%v rejected to s3://%v/%v", rows.Rejected(), bucket, item, bucket, itemRejected)
+	}
+
+	// Record the table and its new partitions in the catalog folder
+	if config.Catalog.Manifest {
+		if err := WriteCatalog(store, bucket, dataset, files); err != nil {
+			Error("Error writing catalog of dataset %v in s3://%v: %v", dataset.Name, bucket, err)
+		}
+	}
+
+	outputs := make([]string, len(files))
+	for i, file := range files {
+		outputs[i] = file.Key
+	}
+	return outputs, nil
 }
 
 /**************************************************************
-	Read S3 Event Notification from a http.Request call
+	Read S3 Event Notification from a http.Request call:
+	SNS messages with a valid SNS signature, or S3,
+	EventBridge and SQS events with the event token
  **************************************************************/
 func ReadS3Event(r *http.Request) (*EventType, error) {
 
@@ -113,6 +265,35 @@ func ReadS3Event(r *http.Request) (*EventType, error) {
 	body := buffer.Bytes()
 	Debug("Response: %s", body)
 
+	// Bodies which can't be decoded are unauthenticated, refused like unsigned messages
+	envelope, err := DetectEnvelope(body)
+	if err != nil {
+		Error("Error decoding event: %v", err)
+		return nil, ErrInvalidSignature
+	}
+
+	// Events not sent by SNS, e.g. from an EventBridge API destination, carry the event token
+	if envelope != EnvelopeSNS {
+		if err := checkEventToken(r); err != nil {
+			return nil, err
+		}
+		message, err := NormalizeS3Event(body)
+		if err != nil {
+			Error("Error decoding %v event: %v", envelope, err)
+			return nil, err
+		}
+		Debug("Event of envelope %v with %v records", envelope, len(message.Records))
+		return &EventType{Type: "Notification", MessageObject: *message}, nil
+	}
+
+	// Only trust messages signed by SNS
+	if err := snsVerifier.Verify(body); err != nil {
+		if !errors.Is(err, ErrInvalidSignature) {
+			Error("Error verifying event: %v", err)
+		}
+		return nil, err
+	}
+
 	// interprate content with structure EventType
 	var event EventType
 	if err := json.Unmarshal(body, &event); err != nil {
@@ -120,17 +301,43 @@ func ReadS3Event(r *http.Request) (*EventType, error) {
 		return nil, err
 	}
 
-	// For a "Notification" event, interprate Message string element
+	// For a "Notification" event, interprate Message string element (S3 or EventBridge event)
 	if event.Type == "Notification" {
-		if err := json.Unmarshal([]byte(event.Message), &(event.MessageObject)); err != nil {
-			Error("Error decoding event's message %v: %v", event.MessageObject, err)
+		message, err := NormalizeS3Event([]byte(event.Message))
+		if err != nil {
+			Error("Error decoding event's message %v: %v", event.Message, err)
 			return nil, err
 		}
+		event.MessageObject = *message
 	}
 
 	return &event, nil
 }
 
+// Check the event token of r, ErrInvalidEventToken when missing or wrong (or no token is set)
+func checkEventToken(r *http.Request) error {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if config.EventToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.EventToken)) != 1 {
+		Error("Rejecting event without SNS signature nor event token from %v", r.RemoteAddr)
+		return ErrInvalidEventToken
+	}
+	return nil
+}
+
+// Reader of the content of a file, remembering read errors
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (reader *sourceReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		reader.err = err
+	}
+	return n, err
+}
+
 // Pretty Print an EventType
 func (event *EventType) Print() {
 	Debug("EVENT:")
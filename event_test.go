@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Record of an ObjectCreated event of bucket/key
+func createdRecord(bucket, key string) RecordType {
+	var record RecordType
+	record.EventName = "ObjectCreated:Put"
+	record.EventTime = time.Date(2020, 4, 6, 21, 5, 45, 0, time.UTC)
+	record.S3.Bucket.Name = bucket
+	record.S3.Object.Key = key
+	return record
+}
+
+// Keys of the objects of bucket, sorted
+func bucketKeys(t *testing.T, store ObjectStore, bucket string) []string {
+	objects, err := store.List(bucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, len(objects))
+	for i, object := range objects {
+		keys[i] = object.Key
+	}
+	return keys
+}
+
+func TestDoWork(t *testing.T) {
+	withConfig(t)
+	// Reject the rows of negative a, up to 1 per file
+	dataset := DefaultDataset()
+	min := 0.0
+	dataset.Rules = []Rule{{Column: "a", Min: &min}}
+	dataset.Reject = RejectPolicy{MaxRows: 1}
+	if err := dataset.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	config.Datasets = []*Dataset{dataset}
+
+	tests := []struct {
+		name      string
+		content   string
+		keys      []string
+		rejected  string
+		permanent bool
+	}{
+		{
+			name:    "valid",
+			content: `[{"a": 100, "b": 200}, {"a": 300, "b": 400}]`,
+			keys:    []string{"data/test.json", "processed/test.json.parquet"},
+		},
+		{
+			name:     "rejected row",
+			content:  `[{"a": 100, "b": 200}, {"a": -1, "b": 400}]`,
+			keys:     []string{"data/test.json", "processed/test.json.parquet", "rejected/test.json.ndjson"},
+			rejected: `"column a: -1 below min 0"`,
+		},
+		{
+			name:      "too many rejected rows",
+			content:   `[{"a": -1, "b": 200}, {"a": -2, "b": 400}]`,
+			keys:      []string{"data/test.json", "error/test.json", "error/test.json.error.json"},
+			permanent: true,
+		},
+	}
+	for _, test := range tests {
+		store := NewMemoryStore()
+		store.Put("deglon", "data/test.json", strings.NewReader(test.content))
+		record := createdRecord("deglon", "data/test.json")
+
+		outputs, err := doWork(store, record)
+		if test.permanent {
+			if !IsPermanent(err) {
+				t.Errorf("%v: got %v, expected a permanent error", test.name, err)
+				continue
+			}
+			// Failures of the content go to the error parking lot
+			if err := Park(store, record, []Attempt{NewAttempt(err)}); err != nil {
+				t.Fatal(err)
+			}
+		} else if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		} else if len(outputs) != 1 || outputs[0] != "processed/test.json.parquet" {
+			t.Errorf("%v: outputs %v", test.name, outputs)
+		}
+
+		keys := bucketKeys(t, store, "deglon")
+		if strings.Join(keys, ",") != strings.Join(test.keys, ",") {
+			t.Errorf("%v: keys %v, expected %v", test.name, keys, test.keys)
+		}
+		if !test.permanent {
+			content, err := store.Get("deglon", "processed/test.json.parquet")
+			if err != nil || !strings.HasPrefix(string(content), "PAR1") {
+				t.Errorf("%v: parquet file %q, %v", test.name, content, err)
+			}
+		}
+		if test.rejected != "" {
+			content, err := store.Get("deglon", "rejected/test.json.ndjson")
+			if err != nil || strings.Count(string(content), "\n") != 1 || !strings.Contains(string(content), test.rejected) {
+				t.Errorf("%v: rejected rows %q, %v", test.name, content, err)
+			}
+		}
+	}
+}
+
+func TestProcessRecordLedgerS3(t *testing.T) {
+	withConfig(t)
+	config.Ledger = "s3"
+	store := NewMemoryStore()
+	withLedger(t, store)
+
+	store.Put("deglon", "data/test.json", strings.NewReader(`[{"a": 100, "b": 200}]`))
+	if _, err := processRecord(store, createdRecord("deglon", "data/test.json")); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"data/test.json", "ledger/data/test.json.json", "processed/test.json.parquet"}
+	if keys := bucketKeys(t, store, "deglon"); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("keys %v, expected %v", keys, expected)
+	}
+
+	// The events of the marker and of the parquet file are skipped, without new marker
+	for _, key := range []string{"ledger/data/test.json.json", "processed/test.json.parquet"} {
+		if _, err := processRecord(store, createdRecord("deglon", key)); err != nil {
+			t.Errorf("%v: %v", key, err)
+		}
+	}
+	if keys := bucketKeys(t, store, "deglon"); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("keys %v, expected %v", keys, expected)
+	}
+	if _, err := doWork(store, createdRecord("deglon", "processed/test.json.parquet")); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("doWork of processed/test.json.parquet: got %v, expected ErrNoRoute", err)
+	}
+}
+
+func TestProcessRecordCounters(t *testing.T) {
+	withConfig(t)
+	config.Ledger = "s3"
+	config.Events = append([]*EventRule{{Event: "ObjectCreated:*", Prefix: "data/tmp/", Handler: HandlerIgnore}}, config.Events...)
+	for _, rule := range config.Events {
+		if err := rule.Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := NewMemoryStore()
+	withLedger(t, store)
+	previous := eventCounters
+	eventCounters = NewEventCounters()
+	t.Cleanup(func() { eventCounters = previous })
+
+	store.Put("deglon", "data/test.json", strings.NewReader(`[{"a": 100, "b": 200}]`))
+	created := createdRecord("deglon", "data/test.json")
+	created.S3.Object.Sequencer = "0055AED6DCD90281E5"
+	restored := createdRecord("deglon", "data/test.json")
+	restored.EventName = "ObjectRestore:Completed"
+	for _, test := range []struct {
+		record RecordType
+		skip   string
+	}{
+		{created, ""},
+		{created, SkipLedger}, // Duplicate
+		{createdRecord("deglon", "data/tmp/test.json"), SkipIgnored},
+		{createdRecord("deglon", "processed/test.json.parquet"), SkipUnrouted},
+		{restored, SkipUnmatched},
+	} {
+		if skip, err := processRecord(store, test.record); err != nil || skip != test.skip {
+			t.Fatalf("%v of %v: skipped %q, %v, expected %q", test.record.EventName, test.record.S3.Object.Key, skip, err, test.skip)
+		}
+	}
+
+	// Only the record processed is handled, the others are skipped or unmatched
+	stats := eventCounters.Stats()
+	if len(stats.Handled) != 1 || stats.Handled[HandlerConvert] != 1 {
+		t.Errorf("handled %v", stats.Handled)
+	}
+	if len(stats.Skipped) != 3 || stats.Skipped[SkipLedger] != 1 || stats.Skipped[SkipIgnored] != 1 || stats.Skipped[SkipUnrouted] != 1 {
+		t.Errorf("skipped %v", stats.Skipped)
+	}
+	if stats.Unmatched != 1 || stats.UnmatchedEvents["ObjectRestore:Completed"] != 1 {
+		t.Errorf("unmatched %v %v", stats.Unmatched, stats.UnmatchedEvents)
+	}
+}
+
+func TestEventRuleForInternalPrefixes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Ledger = "s3:markers"
+
+	tests := []struct {
+		key, handler string
+	}{
+		{"data/test.json", HandlerConvert},
+		{"markers/data/test.json.json", HandlerIgnore},
+		{"archive/processed/test.json.parquet", HandlerIgnore},
+		{"tombstone/data/test.json.json", HandlerIgnore},
+		{"ledger/data/test.json.json", HandlerConvert},
+		{"archived/test.json", HandlerConvert},
+	}
+	for _, test := range tests {
+		rule := cfg.EventRuleFor(createdRecord("deglon", test.key))
+		if rule == nil || rule.Handler != test.handler {
+			t.Errorf("%v: got %+v, expected %v", test.key, rule, test.handler)
+		}
+	}
+}
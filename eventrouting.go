@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+/**************************************************************
+	Define Event Routing Variables
+ **************************************************************/
+
+// Handlers of the S3 events
+const (
+	// Convert the object to parquet
+	HandlerConvert = "convert"
+	// Apply the removal policy to the parquet files of the object
+	HandlerRemove = "remove"
+	// Skip the event, without recording it in the ledger
+	HandlerIgnore = "ignore"
+)
+
+// Names of the handlers, for messages
+var eventHandlers = []string{HandlerConvert, HandlerRemove, HandlerIgnore}
+
+// Counters of the events routed, since the start
+var eventCounters = NewEventCounters()
+
+/**************************************************************
+	EventRule routes the events matching a pattern of event
+	names (e.g. "ObjectCreated:*") and a key prefix to a
+	named handler
+ **************************************************************/
+type EventRule struct {
+	// Pattern of the event names, e.g. "ObjectCreated:*" or "ObjectRestore:Completed" ("s3:" is ignored)
+	Event string `json:"event"`
+	// Folders of the keys, matched segment by segment like routes, any key by default
+	Prefix string `json:"prefix,omitempty"`
+	// Name of the handler: convert, remove or ignore
+	Handler string `json:"handler"`
+
+	prefix []string
+}
+
+/**************************************************************
+	Default event rules: created objects are converted,
+	removed and expired objects are removed. Other events
+	(restore, replication...) are unmatched.
+ **************************************************************/
+func DefaultEventRules() []*EventRule {
+	rules := []*EventRule{
+		{Event: "ObjectCreated:*", Handler: HandlerConvert},
+		{Event: "ObjectRemoved:*", Handler: HandlerRemove},
+		{Event: "LifecycleExpiration:*", Handler: HandlerRemove},
+	}
+	for _, rule := range rules {
+		if err := rule.Compile(); err != nil {
+			panic(err)
+		}
+	}
+	return rules
+}
+
+// Check the patterns and the handler of the rule
+func (rule *EventRule) Compile() error {
+	rule.Event = strings.TrimPrefix(rule.Event, "s3:")
+	if rule.Event == "" {
+		return fmt.Errorf("event rule: event required")
+	}
+	if _, err := path.Match(rule.Event, ""); err != nil {
+		return fmt.Errorf("event rule %q: %v", rule.Event, err)
+	}
+	switch rule.Handler {
+	case HandlerConvert, HandlerRemove, HandlerIgnore:
+	default:
+		return fmt.Errorf("event rule %q: unknown handler %q, expected %v", rule.Event, rule.Handler, strings.Join(eventHandlers, ", "))
+	}
+	var err error
+	if rule.prefix, err = compilePrefix(rule.Prefix); err != nil {
+		return fmt.Errorf("event rule %q: %v", rule.Event, err)
+	}
+	return nil
+}
+
+// Does the rule match the event record
+func (rule *EventRule) Match(record RecordType) bool {
+	matched, _ := path.Match(rule.Event, strings.TrimPrefix(record.EventName, "s3:"))
+	return matched && matchPrefix(rule.prefix, record.S3.Object.Key)
+}
+
+/**************************************************************
+	Folders the application writes to in the bucket of the
+	objects, whose events are always ignored so that its own
+	writes don't trigger it again: the ledger markers, and the
+	archived parquet files and tombstones of the removals
+ **************************************************************/
+func (cfg *Config) InternalPrefixes() []string {
+	prefixes := []string{}
+	if prefix := LedgerPrefix(cfg.Ledger); prefix != "" {
+		prefixes = append(prefixes, prefix)
+	}
+	for _, prefix := range []string{cfg.Removal.Archive, cfg.Removal.Tombstone} {
+		if strings.Trim(prefix, "/") != "" {
+			prefixes = append(prefixes, strings.TrimSuffix(prefix, "/")+"/")
+		}
+	}
+	return prefixes
+}
+
+// First event rule matching the event record, nil when none, an ignore rule in the internal folders
+func (cfg *Config) EventRuleFor(record RecordType) *EventRule {
+	for _, prefix := range cfg.InternalPrefixes() {
+		if strings.HasPrefix(record.S3.Object.Key, prefix) {
+			return &EventRule{Event: "*", Prefix: prefix, Handler: HandlerIgnore}
+		}
+	}
+	for _, rule := range cfg.Events {
+		if rule.Match(record) {
+			return rule
+		}
+	}
+	return nil
+}
+
+/**************************************************************
+	Keep the event records matching an event rule, logging
+	and counting the others
+ **************************************************************/
+func (cfg *Config) FilterEvents(records []RecordType) []RecordType {
+	matched := []RecordType{}
+	for _, record := range records {
+		if cfg.EventRuleFor(record) == nil {
+			eventCounters.Unmatched(record)
+			continue
+		}
+		matched = append(matched, record)
+	}
+	return matched
+}
+
+// Reasons why event records are skipped
+const (
+	SkipIgnored   = "ignored"   // Rule with the ignore handler
+	SkipUnrouted  = "unrouted"  // Key without route or dataset, e.g. processed/
+	SkipLedger    = "ledger"    // Duplicate or out of order event, or object being processed
+	SkipUnmatched = "unmatched" // No event rule, counted as unmatched rather than skipped
+)
+
+/**************************************************************
+	EventCounters counts the events of each handler, the
+	events skipped by reason, and the unmatched events by name
+ **************************************************************/
+type EventCounters struct {
+	mutex sync.Mutex
+	stats EventStats
+}
+
+// Counters of the events
+type EventStats struct {
+	// Events of each handler, processed once the ledger let them through
+	Handled map[string]int64 `json:"handled"`
+	// Events matching a rule but skipped, by reason (ignored, unrouted, ledger)
+	Skipped map[string]int64 `json:"skipped"`
+	// Events matching no event rule, not processed
+	Unmatched int64 `json:"unmatched"`
+	// Unmatched events by name
+	UnmatchedEvents map[string]int64 `json:"unmatchedEvents"`
+}
+
+// Create counters at zero
+func NewEventCounters() *EventCounters {
+	return &EventCounters{stats: EventStats{Handled: map[string]int64{}, Skipped: map[string]int64{}, UnmatchedEvents: map[string]int64{}}}
+}
+
+// Count an event of handler
+func (counters *EventCounters) Handled(handler string) {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	counters.stats.Handled[handler]++
+}
+
+// Count an event skipped for reason
+func (counters *EventCounters) Skipped(reason string) {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	counters.stats.Skipped[reason]++
+}
+
+// Log and count an event record matching no rule
+func (counters *EventCounters) Unmatched(record RecordType) {
+	Info("No event rule for %v of s3://%v/%v, skipped", record.EventName, record.S3.Bucket.Name, record.S3.Object.Key)
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	counters.stats.Unmatched++
+	counters.stats.UnmatchedEvents[record.EventName]++
+}
+
+// Copy of the counters
+func (counters *EventCounters) Stats() EventStats {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	stats := EventStats{Handled: map[string]int64{}, Skipped: map[string]int64{}, Unmatched: counters.stats.Unmatched, UnmatchedEvents: map[string]int64{}}
+	for name, count := range counters.stats.Handled {
+		stats.Handled[name] = count
+	}
+	for reason, count := range counters.stats.Skipped {
+		stats.Skipped[reason] = count
+	}
+	for name, count := range counters.stats.UnmatchedEvents {
+		stats.UnmatchedEvents[name] = count
+	}
+	return stats
+}
@@ -0,0 +1,824 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/**************************************************************
+	Expressions computing derived columns, e.g.
+	"a + b", "upper(trim(name))", "if(qty > 0, price * qty, null)",
+	"coalesce(updated_at, event_time())", "cast(id, 'INT64')"
+ **************************************************************/
+
+// Compiled expression
+type Expression struct {
+	Source  string
+	root    exprNode
+	columns []string
+}
+
+// Values and times available while evaluating an expression on a row
+type ExprEnv struct {
+	Row Row
+	// Time returned by now(), the start of the processing of the file
+	Now time.Time
+	// Time returned by event_time(), the time of the S3 event
+	EventTime time.Time
+}
+
+// Node of the expression tree, evaluated to nil, bool, int64, float64, string or time.Time
+type exprNode interface {
+	eval(env *ExprEnv) (interface{}, error)
+}
+
+// Function callable in expressions, arguments are evaluated on demand
+type exprFunction struct {
+	minArgs, maxArgs int // maxArgs < 0 for any number
+	call             func(env *ExprEnv, args []exprNode) (interface{}, error)
+}
+
+// Types accepted by cast(value, 'TYPE')
+var castTypes = map[string]bool{
+	"BOOLEAN": true, "INT32": true, "INT64": true, "FLOAT": true, "DOUBLE": true, "STRING": true, "TIMESTAMP": true,
+}
+
+// Functions of the expression language
+var exprFunctions = map[string]exprFunction{
+	"now": {0, 0, func(env *ExprEnv, args []exprNode) (interface{}, error) {
+		return env.Now, nil
+	}},
+	"event_time": {0, 0, func(env *ExprEnv, args []exprNode) (interface{}, error) {
+		return env.EventTime, nil
+	}},
+	"if": {3, 3, func(env *ExprEnv, args []exprNode) (interface{}, error) {
+		condition, err := args[0].eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(condition) {
+			return args[1].eval(env)
+		}
+		return args[2].eval(env)
+	}},
+	"coalesce": {1, -1, func(env *ExprEnv, args []exprNode) (interface{}, error) {
+		for _, arg := range args {
+			value, err := arg.eval(env)
+			if err != nil || value != nil {
+				return value, err
+			}
+		}
+		return nil, nil
+	}},
+	"cast": {2, 2, func(env *ExprEnv, args []exprNode) (interface{}, error) {
+		values, err := evalArgs(env, args)
+		if err != nil {
+			return nil, err
+		}
+		return castValue(values[0], values[1].(string))
+	}},
+	"upper":  stringFunction(1, 1, func(s []string) (interface{}, error) { return strings.ToUpper(s[0]), nil }),
+	"lower":  stringFunction(1, 1, func(s []string) (interface{}, error) { return strings.ToLower(s[0]), nil }),
+	"trim":   stringFunction(1, 1, func(s []string) (interface{}, error) { return strings.TrimSpace(s[0]), nil }),
+	"length": stringFunction(1, 1, func(s []string) (interface{}, error) { return int64(len([]rune(s[0]))), nil }),
+	"concat": stringFunction(1, -1, func(s []string) (interface{}, error) { return strings.Join(s, ""), nil }),
+	"replace": stringFunction(3, 3, func(s []string) (interface{}, error) {
+		return strings.Replace(s[0], s[1], s[2], -1), nil
+	}),
+	"substr": {2, 3, func(env *ExprEnv, args []exprNode) (interface{}, error) {
+		values, err := evalArgs(env, args)
+		if err != nil || values[0] == nil {
+			return nil, err
+		}
+		runes := []rune(toString(values[0]))
+		// Start is 1-based, like SQL
+		start, err := toInt(values[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		start = int64(math.Max(float64(start-1), 0))
+		if start > int64(len(runes)) {
+			return "", nil
+		}
+		end := int64(len(runes))
+		if len(values) == 3 {
+			length, err := toInt(values[2], 64)
+			if err != nil {
+				return nil, err
+			}
+			if length >= 0 && start+length < end {
+				end = start + length
+			}
+		}
+		return string(runes[start:end]), nil
+	}},
+	"abs": numberFunction(func(f float64) float64 { return math.Abs(f) }),
+	"round": {1, 2, func(env *ExprEnv, args []exprNode) (interface{}, error) {
+		values, err := evalArgs(env, args)
+		if err != nil || values[0] == nil {
+			return nil, err
+		}
+		f, err := toFloat(values[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		var digits int64
+		if len(values) == 2 {
+			if digits, err = toInt(values[1], 64); err != nil {
+				return nil, err
+			}
+		}
+		scale := math.Pow(10, float64(digits))
+		return math.Round(f*scale) / scale, nil
+	}},
+}
+
+// Function of strings, returning null if any argument is null
+func stringFunction(minArgs, maxArgs int, fn func([]string) (interface{}, error)) exprFunction {
+	return exprFunction{minArgs, maxArgs, func(env *ExprEnv, args []exprNode) (interface{}, error) {
+		values, err := evalArgs(env, args)
+		if err != nil {
+			return nil, err
+		}
+		strs := make([]string, len(values))
+		for i, value := range values {
+			if value == nil {
+				return nil, nil
+			}
+			strs[i] = toString(value)
+		}
+		return fn(strs)
+	}}
+}
+
+// Function of one number, returning null for null
+func numberFunction(fn func(float64) float64) exprFunction {
+	return exprFunction{1, 1, func(env *ExprEnv, args []exprNode) (interface{}, error) {
+		value, err := args[0].eval(env)
+		if err != nil || value == nil {
+			return nil, err
+		}
+		if n, ok := value.(int64); ok {
+			return int64(fn(float64(n))), nil
+		}
+		f, err := toFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return fn(f), nil
+	}}
+}
+
+// Evaluate all the arguments
+func evalArgs(env *ExprEnv, args []exprNode) ([]interface{}, error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+/**************************************************************
+	Compile the source of an expression, checking syntax,
+	function names and number of arguments
+ **************************************************************/
+func CompileExpression(source string) (*Expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %v", p.peek().text, p.peek().pos)
+	}
+	return &Expression{Source: source, root: root, columns: p.columns}, nil
+}
+
+// Names of the columns referenced by the expression, in order of appearance
+func (expression *Expression) Columns() []string {
+	return expression.columns
+}
+
+// Evaluate the expression
+func (expression *Expression) Eval(env *ExprEnv) (interface{}, error) {
+	value, err := expression.root.eval(env)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", expression.Source, err)
+	}
+	return value, nil
+}
+
+/**************************************************************
+	Tokenizer
+ **************************************************************/
+const (
+	tokenEOF = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+// Operators, longest first
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "<", ">", "!", "(", ")", ","}
+
+func tokenize(source string) ([]exprToken, error) {
+	tokens := []exprToken{}
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				((runes[i] == '+' || runes[i] == '-') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokenNumber, string(runes[start:i]), start})
+
+		case r == '\'' || r == '"':
+			start := i
+			var text strings.Builder
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				text.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %v", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{tokenString, text.String(), start})
+
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokenIdent, string(runes[start:i]), start})
+
+		default:
+			found := false
+			for _, operator := range exprOperators {
+				if strings.HasPrefix(string(runes[i:]), operator) {
+					tokens = append(tokens, exprToken{tokenOperator, operator, i})
+					i += len([]rune(operator))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected %q at position %v", r, i)
+			}
+		}
+	}
+	return append(tokens, exprToken{tokenEOF, "end of expression", len(runes)}), nil
+}
+
+/**************************************************************
+	Recursive descent parser, from the lowest precedence:
+	|| (or), && (and), ! (not), comparisons, + -, * / %, unary -
+ **************************************************************/
+type exprParser struct {
+	tokens  []exprToken
+	pos     int
+	columns []string
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+// Consume the next token if it is one of the operators or keywords
+func (p *exprParser) accept(operators ...string) (string, bool) {
+	token := p.peek()
+	if token.kind != tokenOperator && token.kind != tokenIdent {
+		return "", false
+	}
+	for _, operator := range operators {
+		if (token.kind == tokenOperator && token.text == operator) ||
+			(token.kind == tokenIdent && strings.EqualFold(token.text, operator)) {
+			p.next()
+			return operator, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(operator string) error {
+	if _, ok := p.accept(operator); !ok {
+		return fmt.Errorf("expected %q at position %v, got %q", operator, p.peek().pos, p.peek().text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil {
+		if _, ok := p.accept("||", "or"); !ok {
+			break
+		}
+		var right exprNode
+		if right, err = p.parseAnd(); err == nil {
+			left = &logicalNode{or: true, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	for err == nil {
+		if _, ok := p.accept("&&", "and"); !ok {
+			break
+		}
+		var right exprNode
+		if right, err = p.parseNot(); err == nil {
+			left = &logicalNode{or: false, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if operator, ok := p.accept("==", "!=", "<=", ">=", "<", ">"); ok {
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{operator, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+	left, err := p.parseMultiplicative()
+	for err == nil {
+		operator, ok := p.accept("+", "-")
+		if !ok {
+			break
+		}
+		var right exprNode
+		if right, err = p.parseMultiplicative(); err == nil {
+			left = &binaryNode{operator, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseMultiplicative() (exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		operator, ok := p.accept("*", "/", "%")
+		if !ok {
+			break
+		}
+		var right exprNode
+		if right, err = p.parseUnary(); err == nil {
+			left = &binaryNode{operator, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{"-", &literalNode{int64(0)}, operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token := p.next()
+	switch token.kind {
+	case tokenNumber:
+		if n, err := strconv.ParseInt(token.text, 10, 64); err == nil {
+			return &literalNode{n}, nil
+		}
+		f, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %v", token.text, token.pos)
+		}
+		return &literalNode{f}, nil
+
+	case tokenString:
+		return &literalNode{token.text}, nil
+
+	case tokenIdent:
+		switch strings.ToLower(token.text) {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(token)
+		}
+		p.columns = append(p.columns, token.text)
+		return &columnNode{token.text}, nil
+
+	case tokenOperator:
+		if token.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %v", token.text, token.pos)
+}
+
+// Parse the arguments of a function call, after "("
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	function, ok := exprFunctions[strings.ToLower(name.text)]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %v at position %v", name.text, name.pos)
+	}
+
+	args := []exprNode{}
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) < function.minArgs || (function.maxArgs >= 0 && len(args) > function.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments for %v at position %v", name.text, name.pos)
+	}
+	if strings.EqualFold(name.text, "cast") {
+		typeName := ""
+		literal, ok := args[1].(*literalNode)
+		if ok {
+			typeName, _ = literal.value.(string)
+		}
+		if !castTypes[strings.ToUpper(typeName)] {
+			return nil, fmt.Errorf("cast at position %v: second argument must be one of BOOLEAN, INT32, INT64, FLOAT, DOUBLE, STRING or TIMESTAMP", name.pos)
+		}
+		literal.value = strings.ToUpper(typeName)
+	}
+	return &callNode{name.text, function, args}, nil
+}
+
+/**************************************************************
+	Nodes of the expression tree
+ **************************************************************/
+type literalNode struct {
+	value interface{}
+}
+
+func (node *literalNode) eval(env *ExprEnv) (interface{}, error) {
+	return node.value, nil
+}
+
+type columnNode struct {
+	name string
+}
+
+func (node *columnNode) eval(env *ExprEnv) (interface{}, error) {
+	return normalizeValue(env.Row[node.name]), nil
+}
+
+type callNode struct {
+	name     string
+	function exprFunction
+	args     []exprNode
+}
+
+func (node *callNode) eval(env *ExprEnv) (interface{}, error) {
+	value, err := node.function.call(env, node.args)
+	if err != nil {
+		return nil, fmt.Errorf("%v(): %v", node.name, err)
+	}
+	return value, nil
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (node *notNode) eval(env *ExprEnv) (interface{}, error) {
+	value, err := node.operand.eval(env)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return !truthy(value), nil
+}
+
+type logicalNode struct {
+	or          bool
+	left, right exprNode
+}
+
+func (node *logicalNode) eval(env *ExprEnv) (interface{}, error) {
+	left, err := node.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(left) == node.or {
+		return node.or, nil
+	}
+	right, err := node.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(right), nil
+}
+
+type binaryNode struct {
+	operator    string
+	left, right exprNode
+}
+
+func (node *binaryNode) eval(env *ExprEnv) (interface{}, error) {
+	left, err := node.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := node.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node.operator {
+	case "==", "!=":
+		equal := compareValues(left, right) == 0
+		if left == nil || right == nil {
+			equal = left == nil && right == nil
+		}
+		return equal == (node.operator == "=="), nil
+	case "<", "<=", ">", ">=":
+		if left == nil || right == nil {
+			return nil, nil
+		}
+		c := compareValues(left, right)
+		if c == incomparable {
+			return nil, fmt.Errorf("cannot compare %v and %v", left, right)
+		}
+		switch node.operator {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}
+
+	// Arithmetic, null if any operand is null
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	if node.operator == "+" {
+		if ls, ok := left.(string); ok {
+			return ls + toString(right), nil
+		}
+		if rs, ok := right.(string); ok {
+			return toString(left) + rs, nil
+		}
+	}
+	li, lInt := left.(int64)
+	ri, rInt := right.(int64)
+	if lInt && rInt && node.operator != "/" {
+		switch node.operator {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "%":
+			if ri == 0 {
+				return nil, fmt.Errorf("modulo by zero")
+			}
+			return li % ri, nil
+		}
+	}
+	lf, err := toFloat(left, 64)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := toFloat(right, 64)
+	if err != nil {
+		return nil, err
+	}
+	switch node.operator {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	}
+	if rf == 0 {
+		return nil, fmt.Errorf("modulo by zero")
+	}
+	return math.Mod(lf, rf), nil
+}
+
+/**************************************************************
+	Value helpers
+ **************************************************************/
+
+// Result of compareValues for values of different kinds
+const incomparable = 2
+
+// Compare two values: -1, 0, 1 or incomparable
+func compareValues(left, right interface{}) int {
+	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r)
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			if l == r {
+				return 0
+			}
+			return incomparable
+		}
+	case time.Time:
+		if r, ok := right.(time.Time); ok {
+			switch {
+			case l.Before(r):
+				return -1
+			case l.After(r):
+				return 1
+			}
+			return 0
+		}
+	case int64, float64:
+		switch right.(type) {
+		case int64, float64:
+			lf, _ := toFloat(left, 64)
+			rf, _ := toFloat(right, 64)
+			switch {
+			case lf < rf:
+				return -1
+			case lf > rf:
+				return 1
+			}
+			return 0
+		}
+	}
+	return incomparable
+}
+
+// Convert row values to the expression types: int64, float64, string, bool or time.Time
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
+
+// Truth value: false for null, false, 0 and ""
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+// String representation of a value
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// Convert a value with cast(value, 'TYPE')
+func castValue(value interface{}, typeName string) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch typeName {
+	case "BOOLEAN":
+		if s, ok := value.(string); ok {
+			return strconv.ParseBool(strings.TrimSpace(s))
+		}
+		return truthy(value), nil
+	case "INT32", "INT64":
+		if f, ok := value.(float64); ok {
+			value = math.Trunc(f)
+		}
+		if t, ok := value.(time.Time); ok {
+			return t.UnixNano() / 1000000, nil
+		}
+		if typeName == "INT32" {
+			return toInt(value, 32)
+		}
+		return toInt(value, 64)
+	case "FLOAT", "DOUBLE":
+		return toFloat(value, 64)
+	case "STRING":
+		return toString(value), nil
+	}
+
+	// TIMESTAMP from a RFC3339 string or milliseconds since epoch
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(time.RFC3339Nano, strings.TrimSpace(v))
+	}
+	millis, err := toInt(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	return time.Unix(0, millis*1000000).UTC(), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Row and times of the expressions of the tests
+func testExprEnv() *ExprEnv {
+	return &ExprEnv{
+		Row: Row{
+			"qty":   json.Number("3"),
+			"price": 2.5,
+			"name":  " Ada ",
+			"zero":  int32(0),
+			"none":  nil,
+		},
+		Now:       time.Date(2020, 4, 6, 21, 30, 0, 0, time.UTC),
+		EventTime: time.Date(2020, 4, 6, 21, 5, 45, 0, time.UTC),
+	}
+}
+
+func TestExpressionEval(t *testing.T) {
+	tests := []struct {
+		source string
+		value  interface{}
+	}{
+		// Precedence and associativity
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"10 - 4 - 3", int64(3)},
+		{"2 * 3 % 4", int64(2)},
+		{"12 / 3 / 2", 2.0},
+		{"-2 * 3", int64(-6)},
+		{"- -2", int64(2)},
+		{"1 + 2 == 3", true},
+		{"!true || true", true},
+		{"not (true || true)", false},
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"false and true or true", true},
+		{"qty * price", 7.5},
+		{"'a' + 1 + 2", "a12"},
+		{"1 + 2 + 'a'", "3a"},
+
+		// Null propagation
+		{"none + 1", nil},
+		{"1 - none", nil},
+		{"none * price", nil},
+		{"none / 0", nil},
+		{"none > 1", nil},
+		{"none == null", true},
+		{"none != 1", true},
+		{"!none", nil},
+		{"upper(none)", nil},
+		{"concat(name, none)", nil},
+		{"coalesce(none, none)", nil},
+		{"coalesce(none, qty) * 2", int64(6)},
+		{"coalesce(none + 1, 'default')", "default"},
+		{"coalesce(qty, 1 / zero)", int64(3)}, // Evaluated on demand
+		{"if(none, 1, 2)", int64(2)},
+		{"cast(none, 'INT64')", nil},
+
+		// Casts to each type
+		{"cast('true', 'BOOLEAN')", true},
+		{"cast(0, 'boolean')", false},
+		{"cast(price, 'INT32')", int64(2)},
+		{"cast('42', 'INT64')", int64(42)},
+		{"cast(-2.7, 'INT64')", int64(-2)},
+		{"cast(event_time(), 'INT64')", int64(1586207145000)},
+		{"cast('1.5', 'FLOAT')", 1.5},
+		{"cast(qty, 'DOUBLE')", 3.0},
+		{"cast(price, 'STRING')", "2.5"},
+		{"cast(true, 'STRING')", "true"},
+		{"cast(event_time(), 'STRING')", "2020-04-06T21:05:45Z"},
+		{"cast('2020-04-06T21:05:45Z', 'TIMESTAMP')", time.Date(2020, 4, 6, 21, 5, 45, 0, time.UTC)},
+		{"cast(1586207145000, 'TIMESTAMP')", time.Date(2020, 4, 6, 21, 5, 45, 0, time.UTC)},
+		{"cast(now(), 'TIMESTAMP') > event_time()", true},
+
+		// substr and replace at the bounds of the strings
+		{"substr('abc', 1)", "abc"},
+		{"substr('abc', 0)", "abc"},
+		{"substr('abc', -5, 2)", "ab"},
+		{"substr('abc', 3)", "c"},
+		{"substr('abc', 4)", ""},
+		{"substr('abc', 10, 2)", ""},
+		{"substr('abc', 2, 0)", ""},
+		{"substr('abc', 2, 10)", "bc"},
+		{"substr('abc', 2, -1)", "bc"},
+		{"substr('héllo', 2, 3)", "éll"},
+		{"substr(none, 1)", nil},
+		{"replace('abc', 'abc', 'x')", "x"},
+		{"replace('aaa', 'a', '')", ""},
+		{"replace('abc', 'd', 'x')", "abc"},
+		{"replace('abc', '', '-')", "-a-b-c-"},
+		{"replace('', 'a', 'b')", ""},
+		{"replace(name, ' ', '')", "Ada"},
+
+		// Other functions
+		{"upper(trim(name))", "ADA"},
+		{"length('héllo')", int64(5)},
+		{"abs(-3)", int64(3)},
+		{"round(2.345, 2)", 2.35},
+		{"if(qty > 2, 'many', 'few')", "many"},
+	}
+	for _, test := range tests {
+		expression, err := CompileExpression(test.source)
+		if err != nil {
+			t.Errorf("%v: %v", test.source, err)
+			continue
+		}
+		value, err := expression.Eval(testExprEnv())
+		if err != nil {
+			t.Errorf("%v: %v", test.source, err)
+			continue
+		}
+		if tv, ok := test.value.(time.Time); ok {
+			if v, ok := value.(time.Time); !ok || !v.Equal(tv) {
+				t.Errorf("%v: got %v (%T), expected %v", test.source, value, value, test.value)
+			}
+		} else if value != test.value {
+			t.Errorf("%v: got %v (%T), expected %v (%T)", test.source, value, value, test.value, test.value)
+		}
+	}
+}
+
+func TestExpressionEvalErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"1 / 0", "division by zero"},
+		{"price / zero", "division by zero"},
+		{"1.5 / 0.0", "division by zero"},
+		{"qty % zero", "modulo by zero"},
+		{"price % 0", "modulo by zero"},
+		{"'a' < 1", "cannot compare"},
+		{"name * 2", "invalid syntax"},
+		{"cast('abc', 'INT64')", "cast(): \"abc\" is not an integer"},
+		{"cast(3000000000, 'INT32')", "not a 32 bits integer"},
+		{"cast('yesterday', 'TIMESTAMP')", "cast():"},
+		{"upper(1 / 0)", "division by zero"},
+	}
+	for _, test := range tests {
+		expression, err := CompileExpression(test.source)
+		if err != nil {
+			t.Errorf("%v: %v", test.source, err)
+			continue
+		}
+		if value, err := expression.Eval(testExprEnv()); err == nil || !strings.Contains(err.Error(), test.err) || !strings.HasPrefix(err.Error(), test.source+": ") {
+			t.Errorf("%v: got %v, %v, expected %q", test.source, value, err, test.err)
+		}
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"lower(name) + uper(name)", "unknown function uper at position 14"},
+		{"upper()", "wrong number of arguments for upper"},
+		{"upper(name, name)", "wrong number of arguments for upper"},
+		{"now(1)", "wrong number of arguments for now"},
+		{"if(qty > 0, 1)", "wrong number of arguments for if"},
+		{"substr('abc')", "wrong number of arguments for substr"},
+		{"coalesce()", "wrong number of arguments for coalesce"},
+		{"cast(qty, 'DECIMAL')", "second argument must be one of"},
+		{"cast(qty, name)", "second argument must be one of"},
+		{"(1 + 2", `expected ")" at position 6`},
+		{"((1 + 2)", `expected ")"`},
+		{"1 + 2)", `unexpected ")" at position 5`},
+		{"upper(name", `expected ")"`},
+		{"upper(name))", `unexpected ")"`},
+		{"()", `unexpected ")"`},
+		{"1 +", "unexpected \"end of expression\""},
+		{"1 2", `unexpected "2" at position 2`},
+		{"1 < 2 == true", `unexpected "==" at position 6`}, // Comparisons don't chain
+		{"'abc", "unterminated string at position 0"},
+		{"qty # 2", "unexpected '#' at position 4"},
+		{"1.2.3", `invalid number "1.2.3"`},
+	}
+	for _, test := range tests {
+		if _, err := CompileExpression(test.source); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got %v, expected %q", test.source, err, test.err)
+		}
+	}
+
+	// Columns in order of appearance, not the functions
+	expression, err := CompileExpression("coalesce(price, 0) * qty + length(name)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns := strings.Join(expression.Columns(), ","); columns != "price,qty,name" {
+		t.Errorf("columns %v", columns)
+	}
+}
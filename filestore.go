@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/**************************************************************
+	FileStore is an ObjectStore in a local folder, each bucket
+	is a sub folder of Root and each key a file path in it
+ **************************************************************/
+type FileStore struct {
+	Root string
+}
+
+// Create a FileStore in the folder root
+func NewFileStore(root string) (*FileStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		Error("Error creating store folder %v: %v", root, err)
+		return nil, err
+	}
+	return &FileStore{Root: root}, nil
+}
+
+// Local path of bucket/key, refusing keys escaping the bucket folder
+func (store *FileStore) path(bucket, key string) (string, error) {
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || bucket == "." || bucket == ".." {
+		return "", fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	clean := path.Clean("/" + key)
+	if key == "" || clean == "/" || clean != "/"+key {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(store.Root, bucket, filepath.FromSlash(clean)), nil
+}
+
+// Read the content of bucket/key
+func (store *FileStore) Get(bucket, key string) ([]byte, error) {
+	filename, err := store.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return content, err
+}
+
+// Stream the content of bucket/key
+func (store *FileStore) Open(bucket, key string) (io.ReadCloser, *ObjectInfo, error) {
+	filename, err := store.path(bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := store.info(filename, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// Write the content of body to bucket/key, through a temp file renamed once complete
+func (store *FileStore) Put(bucket, key string, body io.Reader) error {
+	filename, err := store.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// Copy sourceBucket/sourceKey to bucket/key
+func (store *FileStore) Copy(sourceBucket, sourceKey, bucket, key string) error {
+	filename, err := store.path(sourceBucket, sourceKey)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return store.Put(bucket, key, file)
+}
+
+// Describe bucket/key, the ETag is the MD5 of the content like S3 single part uploads
+func (store *FileStore) Head(bucket, key string) (*ObjectInfo, error) {
+	filename, err := store.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return store.info(filename, key)
+}
+
+// Describe the file filename holding key
+func (store *FileStore) info(filename, key string) (*ObjectInfo, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ETag:         hex.EncodeToString(hash.Sum(nil)),
+		LastModified: stat.ModTime(),
+		ContentType:  mime.TypeByExtension(filepath.Ext(key)),
+	}, nil
+}
+
+// List objects of bucket with keys starting with prefix
+func (store *FileStore) List(bucket, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	folder := filepath.Join(store.Root, bucket)
+	err := filepath.Walk(folder, func(filename string, stat os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if stat.IsDir() || strings.HasPrefix(stat.Name(), ".tmp-") {
+			return nil
+		}
+		relative, err := filepath.Rel(folder, filename)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := store.info(filename, key)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *info)
+		return nil
+	})
+	if err != nil {
+		Error("Unable to list %v/%v: %v", folder, prefix, err)
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Delete bucket/key
+func (store *FileStore) Delete(bucket, key string) error {
+	filename, err := store.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**************************************************************
+	Define Journal Variables
+ **************************************************************/
+
+// Sequence of the jobs created by this process
+var jobSequence int64
+
+// Record to process, with its failed attempts
+type Job struct {
+	ID     string     `json:"id"`
+	Record RecordType `json:"record"`
+	// Failed attempts, oldest first
+	Attempts []Attempt `json:"attempts,omitempty"`
+	// Time of the next attempt
+	NotBefore time.Time `json:"notBefore,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Failed attempt to process a record
+type Attempt struct {
+	At        time.Time `json:"at"`
+	Error     string    `json:"error"`
+	Permanent bool      `json:"permanent,omitempty"`
+	// Stage which failed, and record number and line of the row in error
+	Stage  string `json:"stage,omitempty"`
+	Record int    `json:"record,omitempty"`
+	Line   int    `json:"line,omitempty"`
+}
+
+// Attempt failed now with err
+func NewAttempt(err error) Attempt {
+	attempt := Attempt{At: time.Now(), Error: err.Error(), Permanent: IsPermanent(err)}
+	var stage *StageError
+	if errors.As(err, &stage) {
+		attempt.Stage = stage.Stage
+	}
+	var row *RowError
+	if errors.As(err, &row) {
+		attempt.Record, attempt.Line = row.Record, row.Line
+	}
+	return attempt
+}
+
+// Create the job of record
+func NewJob(record RecordType) *Job {
+	now := time.Now()
+	return &Job{
+		ID:        fmt.Sprintf("%020d-%06d", now.UnixNano(), atomic.AddInt64(&jobSequence, 1)%1000000),
+		Record:    record,
+		CreatedAt: now,
+	}
+}
+
+/**************************************************************
+	Journal is the write-ahead log of the pending jobs, one
+	JSON file per job in a local folder, so jobs survive
+	restarts. Without folder, jobs are only kept in memory.
+ **************************************************************/
+type Journal struct {
+	folder string
+}
+
+// Open the journal in folder, created if needed, "" for no journal
+func OpenJournal(folder string) (*Journal, error) {
+	if folder == "" {
+		return &Journal{}, nil
+	}
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		Error("Error creating journal folder %v: %v", folder, err)
+		return nil, err
+	}
+	return &Journal{folder: folder}, nil
+}
+
+// File of a job
+func (journal *Journal) filename(job *Job) string {
+	return filepath.Join(journal.folder, job.ID+".json")
+}
+
+/**************************************************************
+	Save the job, synced to disk before returning, through a
+	temp file renamed once complete
+ **************************************************************/
+func (journal *Journal) Save(job *Job) error {
+	if journal.folder == "" {
+		return nil
+	}
+	content, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(journal.folder, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), journal.filename(job))
+}
+
+// Remove the job, done
+func (journal *Journal) Remove(job *Job) error {
+	if journal.folder == "" {
+		return nil
+	}
+	if err := os.Remove(journal.filename(job)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/**************************************************************
+	Load the pending jobs, oldest first, skipping (and logging)
+	unreadable files
+ **************************************************************/
+func (journal *Journal) Load() ([]*Job, error) {
+	if journal.folder == "" {
+		return nil, nil
+	}
+	names, err := filepath.Glob(filepath.Join(journal.folder, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	jobs := []*Job{}
+	for _, name := range names {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			Error("Error reading job %v: %v", name, err)
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal(content, &job); err != nil || job.ID+".json" != filepath.Base(name) {
+			Error("Error decoding job %v: %v", name, err)
+			continue
+		}
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+// Describe the journal, for logs
+func (journal *Journal) String() string {
+	if journal.folder == "" {
+		return "memory"
+	}
+	return strings.TrimSuffix(journal.folder, "/")
+}
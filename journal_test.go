@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Names of the files of folder, sorted
+func folderFiles(t *testing.T, folder string) []string {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestJournalReplay(t *testing.T) {
+	folder := t.TempDir()
+	journal, err := OpenJournal(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := []*Job{
+		NewJob(createdRecord("deglon", "data/a.json")),
+		NewJob(createdRecord("deglon", "data/b.json")),
+		NewJob(createdRecord("deglon", "data/c.json")),
+		NewJob(createdRecord("deglon", "data/d.json")),
+	}
+	// b failed once and waits for its retry
+	jobs[1].Attempts = []Attempt{NewAttempt(errors.New("S3 unavailable"))}
+	jobs[1].NotBefore = time.Now().Add(50 * time.Millisecond)
+	for _, job := range jobs {
+		if err := journal.Save(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unreadable files are skipped
+	ioutil.WriteFile(filepath.Join(folder, "broken.json"), []byte("{"), 0600)
+	ioutil.WriteFile(filepath.Join(folder, ".tmp-123"), []byte("{"), 0600)
+
+	// Reopened from the same folder, as after a restart
+	reopened, err := OpenJournal(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := reopened.Load()
+	if err != nil || len(loaded) != len(jobs) {
+		t.Fatalf("loaded %v, %v", loaded, err)
+	}
+	for i, job := range loaded {
+		if job.ID != jobs[i].ID || job.Record.S3.Object.Key != jobs[i].Record.S3.Object.Key || len(job.Attempts) != len(jobs[i].Attempts) || !job.NotBefore.Equal(jobs[i].NotBefore) {
+			t.Errorf("job %v: %+v, expected %+v", i, job, jobs[i])
+		}
+	}
+
+	// The jobs are replayed by the queue, then deleted once done: c is parked, d can't be parked
+	var mutex sync.Mutex
+	processed := map[string]time.Time{}
+	start := time.Now()
+	queue, err := NewWorkQueue(10, 2, reopened, testRetryPolicy(t),
+		func(record RecordType) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			processed[record.S3.Object.Key] = time.Now()
+			if record.S3.Object.Key == "data/c.json" || record.S3.Object.Key == "data/d.json" {
+				return Permanent(errors.New("invalid JSON"))
+			}
+			return nil
+		},
+		func(job *Job) error {
+			if job.Record.S3.Object.Key == "data/d.json" {
+				return errors.New("S3 unavailable")
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for pendingJobs(queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(processed) != 4 {
+		t.Errorf("processed %v", processed)
+	}
+	if at := processed["data/b.json"]; at.Sub(start) < 40*time.Millisecond {
+		t.Errorf("data/b.json processed after %v, before its retry time", at.Sub(start))
+	}
+	if stats := queue.Stats(); stats.Recovered != 4 || stats.Processed != 2 || stats.Parked != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+	// Only the job which couldn't be parked stays, for the next start, other files are left alone
+	expected := []string{".tmp-123", jobs[3].ID + ".json", "broken.json"}
+	if files := folderFiles(t, folder); strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("journal files %v, expected %v", files, expected)
+	}
+}
+
+func TestJournalRemove(t *testing.T) {
+	folder := t.TempDir()
+	journal, err := OpenJournal(filepath.Join(folder, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := NewJob(createdRecord("deglon", "data/test.json"))
+	if err := journal.Save(job); err != nil {
+		t.Fatal(err)
+	}
+	if files := folderFiles(t, filepath.Join(folder, "journal")); len(files) != 1 || files[0] != job.ID+".json" {
+		t.Errorf("files %v", files)
+	}
+	if err := journal.Remove(job); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "journal", job.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("job file: %v", err)
+	}
+	// Removing twice is fine
+	if err := journal.Remove(job); err != nil {
+		t.Error(err)
+	}
+
+	// Without folder, jobs are in memory only
+	memory, _ := OpenJournal("")
+	if err := memory.Save(job); err != nil || memory.Remove(job) != nil {
+		t.Errorf("memory journal: %v", err)
+	}
+	if jobs, err := memory.Load(); err != nil || len(jobs) != 0 {
+		t.Errorf("memory journal: %v, %v", jobs, err)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		baseDelay, maxDelay string
+		attempts            int
+		delay               time.Duration // Before jitter, the delay is in [delay/2, delay]
+	}{
+		{"2s", "1m", 1, 2 * time.Second},
+		{"2s", "1m", 2, 4 * time.Second},
+		{"2s", "1m", 3, 8 * time.Second},
+		{"2s", "1m", 5, 32 * time.Second},
+		{"2s", "1m", 6, time.Minute},
+		{"2s", "1m", 100, time.Minute},
+		{"2s", "2s", 3, 2 * time.Second},
+		{"1s", "5s", 3, 4 * time.Second},
+		{"1s", "5s", 4, 5 * time.Second},
+		{"1ms", "1ms", 1, time.Millisecond},
+	}
+	for _, test := range tests {
+		policy := RetryPolicy{MaxAttempts: 5, BaseDelay: test.baseDelay, MaxDelay: test.maxDelay}
+		if err := policy.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		min, max := time.Duration(1<<62), time.Duration(0)
+		for i := 0; i < 500; i++ {
+			delay := policy.Delay(test.attempts)
+			if delay < min {
+				min = delay
+			}
+			if delay > max {
+				max = delay
+			}
+		}
+		// Within the bounds, and spread over them
+		if min < test.delay/2 || max > test.delay || max-min < test.delay/4 {
+			t.Errorf("%v to %v, attempt %v: delays from %v to %v, expected %v to %v", test.baseDelay, test.maxDelay, test.attempts, min, max, test.delay/2, test.delay)
+		}
+	}
+}
+
+func TestRetryPolicyCompile(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		err    string
+	}{
+		{RetryPolicy{MaxAttempts: 1, BaseDelay: "1s", MaxDelay: "1s"}, ""},
+		{RetryPolicy{MaxAttempts: 0, BaseDelay: "1s", MaxDelay: "1m"}, "retry.maxAttempts 0 is below 1"},
+		{RetryPolicy{MaxAttempts: 3, BaseDelay: "soon", MaxDelay: "1m"}, "retry.baseDelay"},
+		{RetryPolicy{MaxAttempts: 3, BaseDelay: "0s", MaxDelay: "1m"}, "retry.baseDelay"},
+		{RetryPolicy{MaxAttempts: 3, BaseDelay: "1m", MaxDelay: "1s"}, "retry.maxDelay"},
+	}
+	for _, test := range tests {
+		err := test.policy.Compile()
+		if (test.err == "" && err != nil) || (test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err))) {
+			t.Errorf("%+v: got %v, expected %q", test.policy, err, test.err)
+		}
+	}
+}
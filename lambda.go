@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+/**************************************************************
+	Define Lambda Variables
+ **************************************************************/
+
+// Version of the Lambda Runtime API
+const lambdaRuntimeVersion = "2018-06-01"
+
+// Event of a Lambda invocation
+type LambdaInvocation struct {
+	RequestID string
+	Deadline  time.Time
+	Body      []byte
+}
+
+// Response of an invocation, the counts of its S3 records
+type LambdaResponse struct {
+	Records   int `json:"records"`
+	Processed int `json:"processed"`
+	// Records ignored, without route, or already in the ledger
+	Skipped   int `json:"skipped"`
+	Parked    int `json:"parked"`
+	Unmatched int `json:"unmatched"`
+	// SQS messages to receive again, the others being deleted (ReportBatchItemFailures)
+	BatchItemFailures []LambdaBatchItemFailure `json:"batchItemFailures,omitempty"`
+}
+
+// SQS message failing in a batch
+type LambdaBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// SQS messages of an invocation, their body being another envelope
+type lambdaSQSEvent struct {
+	Records []struct {
+		MessageID   string `json:"messageId"`
+		EventSource string `json:"eventSource"`
+		Body        string `json:"body"`
+	} `json:"Records"`
+}
+
+// Error reported to the Lambda Runtime API
+type lambdaError struct {
+	ErrorMessage string `json:"errorMessage"`
+	ErrorType    string `json:"errorType"`
+}
+
+/**************************************************************
+	LambdaRuntime is a client of the Lambda Runtime API of a
+	custom runtime, at AWS_LAMBDA_RUNTIME_API in Lambda or at
+	a local runtime API emulator
+ **************************************************************/
+type LambdaRuntime struct {
+	baseURL string
+	client  *http.Client
+}
+
+// Create a LambdaRuntime of the runtime API api, e.g. "127.0.0.1:9001"
+func NewLambdaRuntime(api string) *LambdaRuntime {
+	// No timeout, waiting for the next invocation blocks until there is one
+	return &LambdaRuntime{baseURL: "http://" + api + "/" + lambdaRuntimeVersion + "/runtime", client: &http.Client{}}
+}
+
+// Wait for the next invocation
+func (runtime *LambdaRuntime) Next() (*LambdaInvocation, error) {
+	response, err := runtime.client.Get(runtime.baseURL + "/invocation/next")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("next invocation: %v: %s", response.Status, body)
+	}
+
+	invocation := &LambdaInvocation{RequestID: response.Header.Get("Lambda-Runtime-Aws-Request-Id"), Body: body}
+	if invocation.RequestID == "" {
+		return nil, fmt.Errorf("next invocation: no Lambda-Runtime-Aws-Request-Id")
+	}
+	if ms, err := strconv.ParseInt(response.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64); err == nil {
+		invocation.Deadline = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	// Propagate the X-Ray trace of the invocation
+	if trace := response.Header.Get("Lambda-Runtime-Trace-Id"); trace != "" {
+		os.Setenv("_X_AMZN_TRACE_ID", trace)
+	}
+	return invocation, nil
+}
+
+// Send the response of the invocation requestID
+func (runtime *LambdaRuntime) Respond(requestID string, response interface{}) error {
+	return runtime.post("/invocation/"+requestID+"/response", response, "")
+}
+
+// Report the failure of the invocation requestID, retried by Lambda for asynchronous invocations
+func (runtime *LambdaRuntime) Fail(requestID string, err error) error {
+	return runtime.post("/invocation/"+requestID+"/error", lambdaErrorOf(err), "Unhandled")
+}
+
+// Report an error of the initialization, before the first invocation
+func (runtime *LambdaRuntime) InitError(err error) error {
+	return runtime.post("/init/error", lambdaErrorOf(err), "Runtime.InitError")
+}
+
+// Post the JSON of value to the path of the runtime API
+func (runtime *LambdaRuntime) post(path string, value interface{}, errorType string) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, runtime.baseURL+path, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if errorType != "" {
+		request.Header.Set("Lambda-Runtime-Function-Error-Type", errorType)
+	}
+	response, err := runtime.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("%v: %v: %s", path, response.Status, body)
+	}
+	return nil
+}
+
+// Error of the runtime API, its type being the stage which failed
+func lambdaErrorOf(err error) *lambdaError {
+	errorType := "Error"
+	var stage *StageError
+	if errors.As(err, &stage) {
+		errorType = "Stage." + stage.Stage
+	}
+	return &lambdaError{ErrorMessage: err.Error(), ErrorType: errorType}
+}
+
+/**************************************************************
+	Process the invocations of the runtime with handle until
+	the runtime API fails (Lambda then restarts the runtime)
+ **************************************************************/
+func (runtime *LambdaRuntime) Run(handle func(body []byte) (interface{}, error)) error {
+	for {
+		invocation, err := runtime.Next()
+		if err != nil {
+			Error("Error getting next Lambda invocation: %v", err)
+			return err
+		}
+		Info("Lambda invocation %v (deadline %v)", invocation.RequestID, invocation.Deadline)
+
+		response, err := handle(invocation.Body)
+		if err != nil {
+			Error("Error with Lambda invocation %v: %v", invocation.RequestID, err)
+			err = runtime.Fail(invocation.RequestID, err)
+		} else {
+			err = runtime.Respond(invocation.RequestID, response)
+		}
+		if err != nil {
+			Error("Error responding to Lambda invocation %v: %v", invocation.RequestID, err)
+			return err
+		}
+	}
+}
+
+/**************************************************************
+	Process the S3 records of a Lambda event (S3, SNS,
+	EventBridge or SQS envelope) like /event does without
+	queue: records failing with a permanent error are parked,
+	other failures fail the invocation so Lambda retries it,
+	the records already processed being skipped by the ledger.
+	For SQS, only the failing messages are reported in
+	batchItemFailures, to be received again.
+ **************************************************************/
+func handleLambdaEvent(store ObjectStore, body []byte) (*LambdaResponse, error) {
+	envelope, err := DetectEnvelope(body)
+	if err != nil {
+		Error("Error decoding Lambda event: %v", err)
+		return nil, err
+	}
+	if envelope == EnvelopeSQS {
+		return handleLambdaSQSEvent(store, body)
+	}
+
+	message, err := NormalizeS3Event(body)
+	if err != nil {
+		Error("Error decoding Lambda event: %v", err)
+		return nil, err
+	}
+	response := &LambdaResponse{}
+	if err := response.process(store, message.Records); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+/**************************************************************
+	Process the S3 records of each SQS message, reporting the
+	messages whose records failed (or which aren't S3 events)
+	in batchItemFailures rather than failing the invocation:
+	Lambda deletes the other messages of the batch
+ **************************************************************/
+func handleLambdaSQSEvent(store ObjectStore, body []byte) (*LambdaResponse, error) {
+	var event lambdaSQSEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		Error("Error decoding Lambda SQS event: %v", err)
+		return nil, err
+	}
+
+	response := &LambdaResponse{BatchItemFailures: []LambdaBatchItemFailure{}}
+	for i, message := range event.Records {
+		err := func() error {
+			if message.EventSource != "aws:sqs" {
+				return fmt.Errorf("SQS record %v: unexpected event source %q", i+1, message.EventSource)
+			}
+			s3Message, err := NormalizeS3Event([]byte(message.Body))
+			if err != nil {
+				return err
+			}
+			return response.process(store, s3Message.Records)
+		}()
+		if err != nil {
+			Error("Error with SQS message %v, received again: %v", message.MessageID, err)
+			response.BatchItemFailures = append(response.BatchItemFailures, LambdaBatchItemFailure{ItemIdentifier: message.MessageID})
+		}
+	}
+	return response, nil
+}
+
+// Process the records matching an event rule, counting them, the first failure which can be retried returned
+func (response *LambdaResponse) process(store ObjectStore, records []RecordType) error {
+	matched := config.FilterEvents(records)
+	response.Records += len(records)
+	response.Unmatched += len(records) - len(matched)
+
+	var failed error
+	for _, record := range matched {
+		skip, err := processRecord(store, record)
+		if err == nil {
+			if skip != "" {
+				response.Skipped++
+			} else {
+				response.Processed++
+			}
+			continue
+		}
+		if !IsPermanent(err) {
+			if failed == nil {
+				failed = fmt.Errorf("s3://%v/%v: %w", record.S3.Bucket.Name, record.S3.Object.Key, err)
+			}
+			continue
+		}
+		if err := Park(store, record, []Attempt{NewAttempt(err)}); err != nil {
+			Error("Error parking s3://%v/%v: %v", record.S3.Bucket.Name, record.S3.Object.Key, err)
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		response.Parked++
+	}
+	return failed
+}
+
+/**************************************************************
+	Run as the custom runtime of a Lambda function triggered by
+	S3 (or SNS, EventBridge, SQS), processing the invocations
+	of the Runtime API until it fails
+ **************************************************************/
+func lambdaCommand(args []string) error {
+	flags := flag.NewFlagSet("lambda", flag.ContinueOnError)
+	api := flags.String("runtime-api", os.Getenv("AWS_LAMBDA_RUNTIME_API"), "Host and port of the Lambda Runtime API")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *api == "" {
+		return fmt.Errorf("runtime API required, set -runtime-api or AWS_LAMBDA_RUNTIME_API")
+	}
+	runtime := NewLambdaRuntime(*api)
+
+	if err := OpenStores(); err != nil {
+		if err := runtime.InitError(err); err != nil {
+			Error("Error reporting Lambda init error: %v", err)
+		}
+		return err
+	}
+	Info("Lambda runtime started with runtime API %v", *api)
+	return runtime.Run(func(body []byte) (interface{}, error) {
+		return handleLambdaEvent(objectStore, body)
+	})
+}
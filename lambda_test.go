@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Call of the function to the runtime API emulator
+type runtimeCall struct {
+	path      string
+	errorType string
+	body      string
+}
+
+/**************************************************************
+	Emulator of the Lambda Runtime API, giving the events
+	in order then failing /invocation/next, and recording the
+	responses and errors of the invocations
+ **************************************************************/
+type runtimeEmulator struct {
+	mutex  sync.Mutex
+	events []string
+	next   int
+	calls  []runtimeCall
+}
+
+func (emulator *runtimeEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/"+lambdaRuntimeVersion+"/runtime")
+
+	if r.Method == http.MethodGet && path == "/invocation/next" {
+		if emulator.next == len(emulator.events) {
+			http.Error(w, "no more events", http.StatusInternalServerError)
+			return
+		}
+		emulator.next++
+		w.Header().Set("Lambda-Runtime-Aws-Request-Id", "request-"+strconv.Itoa(emulator.next))
+		w.Header().Set("Lambda-Runtime-Deadline-Ms", strconv.FormatInt(time.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond), 10))
+		io.WriteString(w, emulator.events[emulator.next-1])
+		return
+	}
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unexpected "+r.Method+" "+path, http.StatusBadRequest)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	emulator.calls = append(emulator.calls, runtimeCall{path: path, errorType: r.Header.Get("Lambda-Runtime-Function-Error-Type"), body: string(body)})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Store failing to read the files of key
+type failingStore struct {
+	*MemoryStore
+	key string
+}
+
+func (store *failingStore) Open(bucket, key string) (io.ReadCloser, *ObjectInfo, error) {
+	if key == store.key {
+		return nil, nil, errors.New("S3 unavailable")
+	}
+	return store.MemoryStore.Open(bucket, key)
+}
+
+func TestLambdaRuntime(t *testing.T) {
+	withConfig(t)
+	withLedger(t, NewMemoryStore())
+
+	s3Event, err := ioutil.ReadFile(filepath.Join("events", "s3.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &failingStore{MemoryStore: NewMemoryStore(), key: "data/fail.json"}
+	store.Put("deglon", "data/test.json", strings.NewReader(`[{"a": 100, "b": 200}]`))
+	store.Put("deglon", "data/fail.json", strings.NewReader(`[{"a": 100, "b": 200}]`))
+	store.Put("deglon", "data/invalid.json", strings.NewReader(`[{"a": "not a number"}]`))
+	event := func(key string) string {
+		return `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"deglon"},"object":{"key":"` + key + `"}}}]}`
+	}
+
+	emulator := &runtimeEmulator{events: []string{
+		string(s3Event),
+		event("data/invalid.json"),
+		event("data/fail.json"),
+		`{"hello":"world"}`,
+		string(s3Event), // Already processed
+	}}
+	server := httptest.NewServer(emulator)
+	defer server.Close()
+
+	runtime := NewLambdaRuntime(strings.TrimPrefix(server.URL, "http://"))
+	err = runtime.Run(func(body []byte) (interface{}, error) {
+		return handleLambdaEvent(store, body)
+	})
+	if err == nil || !strings.Contains(err.Error(), "no more events") {
+		t.Errorf("run: got %v, expected the error of the last /invocation/next", err)
+	}
+
+	tests := []struct {
+		path      string
+		errorType string
+		body      string
+	}{
+		{"/invocation/request-1/response", "", `{"records":1,"processed":1,"skipped":0,"parked":0,"unmatched":0}`},
+		{"/invocation/request-2/response", "", `{"records":1,"processed":0,"skipped":0,"parked":1,"unmatched":0}`},
+		{"/invocation/request-3/error", "Unhandled", `"errorType":"Stage.download"`},
+		{"/invocation/request-4/error", "Unhandled", `"errorMessage":"unknown event envelope`},
+		{"/invocation/request-5/response", "", `{"records":1,"processed":0,"skipped":1,"parked":0,"unmatched":0}`},
+	}
+	if len(emulator.calls) != len(tests) {
+		t.Fatalf("calls %+v", emulator.calls)
+	}
+	for i, test := range tests {
+		call := emulator.calls[i]
+		if call.path != test.path || call.errorType != test.errorType || !strings.Contains(call.body, test.body) {
+			t.Errorf("call %v: %+v, expected %v %v %v", i+1, call, test.path, test.errorType, test.body)
+		}
+		if !json.Valid([]byte(call.body)) {
+			t.Errorf("call %v: invalid JSON %v", i+1, call.body)
+		}
+	}
+	if _, err := store.Get("deglon", "error/invalid.json"); err != nil {
+		t.Errorf("data/invalid.json not parked: %v", err)
+	}
+}
+
+func TestHandleLambdaSQSEvent(t *testing.T) {
+	withConfig(t)
+	withLedger(t, NewMemoryStore())
+
+	store := &failingStore{MemoryStore: NewMemoryStore(), key: "data/fail.json"}
+	store.Put("deglon", "data/test.json", strings.NewReader(`[{"a": 100, "b": 200}]`))
+	store.Put("deglon", "data/fail.json", strings.NewReader(`[{"a": 100, "b": 200}]`))
+	store.Put("deglon", "data/invalid.json", strings.NewReader(`[{"a": "not a number"}]`))
+	message := func(id, body string) map[string]string {
+		return map[string]string{"messageId": id, "eventSource": "aws:sqs", "body": body}
+	}
+	event := func(key, sequencer string) string {
+		return `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"deglon"},"object":{"key":"` + key + `","sequencer":"` + sequencer + `"}}}]}`
+	}
+	body, err := json.Marshal(map[string]interface{}{"Records": []map[string]string{
+		message("1", event("data/test.json", "005E8B99AA4CE3A3D2")),
+		message("2", event("data/fail.json", "005E8B99AA4CE3A3D3")),
+		message("3", "garbage"),
+		message("4", event("data/invalid.json", "005E8B99AA4CE3A3D4")),
+		message("5", event("data/test.json", "005E8B99AA4CE3A3D2")), // Duplicate of 1
+		message("6", `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectRestore:Completed","s3":{"bucket":{"name":"deglon"},"object":{"key":"data/test.json"}}}]}`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the messages which can be retried fail, the invalid file is parked
+	response, err := handleLambdaEvent(store, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := json.Marshal(response)
+	expected := `{"records":5,"processed":1,"skipped":1,"parked":1,"unmatched":1,"batchItemFailures":[{"itemIdentifier":"2"},{"itemIdentifier":"3"}]}`
+	if string(content) != expected {
+		t.Errorf("response %s, expected %s", content, expected)
+	}
+	if _, err := store.Get("deglon", "error/invalid.json"); err != nil {
+		t.Errorf("data/invalid.json not parked: %v", err)
+	}
+
+	// Without failure, the list is empty
+	body, _ = json.Marshal(map[string]interface{}{"Records": []map[string]string{message("7", event("data/test.json", "005E8B99AA4CE3A3D5"))}})
+	if response, err := handleLambdaEvent(store, body); err != nil || response.Processed != 1 || response.BatchItemFailures == nil || len(response.BatchItemFailures) != 0 {
+		t.Errorf("response %+v, %v", response, err)
+	}
+}
+
+func TestLambdaRuntimeInitError(t *testing.T) {
+	emulator := &runtimeEmulator{}
+	server := httptest.NewServer(emulator)
+	defer server.Close()
+
+	runtime := NewLambdaRuntime(strings.TrimPrefix(server.URL, "http://"))
+	if err := runtime.InitError(errors.New("unknown object store")); err != nil {
+		t.Fatal(err)
+	}
+	if len(emulator.calls) != 1 || emulator.calls[0].path != "/init/error" || emulator.calls[0].errorType != "Runtime.InitError" || !strings.Contains(emulator.calls[0].body, "unknown object store") {
+		t.Errorf("calls %+v", emulator.calls)
+	}
+}
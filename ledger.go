@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+	Define Ledger Variables
+ **************************************************************/
+
+// Ledger of the processed objects, set in main
+var ledger = NewLedger(NewMarkerLedgerStore(NewMemoryStore(), "", "ledger/"))
+
+// Status of the objects in the ledger
+const (
+	LedgerProcessed = "processed"
+	// Removed, by the removal policy of the event
+	LedgerIgnored    = "ignored"
+	LedgerDeleted    = "deleted"
+	LedgerArchived   = "archived"
+	LedgerTombstoned = "tombstoned"
+)
+
+// Entry of an object in the ledger, the last event processed for bucket/key
+type LedgerEntry struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	ETag        string    `json:"eTag,omitempty"`
+	Sequencer   string    `json:"sequencer,omitempty"`
+	EventName   string    `json:"eventName,omitempty"`
+	Status      string    `json:"status"`
+	ProcessedAt time.Time `json:"processedAt"`
+	// Parquet files written, or deleted, archived or tombstoned for a removal
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+/**************************************************************
+	LedgerStore keeps the ledger entries, one per object
+ **************************************************************/
+type LedgerStore interface {
+	// Entry of bucket/key, nil if the object was never processed
+	Get(bucket, key string) (*LedgerEntry, error)
+	// Save the entry of entry.Bucket/entry.Key
+	Put(entry *LedgerEntry) error
+}
+
+/**************************************************************
+	Create the LedgerStore from its name: "memory",
+	"file:<folder>", or "s3" and "s3:<prefix>" for marker
+	objects in the bucket of the objects, under prefix (by
+	default ledger/) in store
+ **************************************************************/
+func NewLedgerStore(name string, store ObjectStore) (LedgerStore, error) {
+	switch {
+	case name == "memory":
+		return NewMarkerLedgerStore(NewMemoryStore(), "", "ledger/"), nil
+	case strings.HasPrefix(name, "file:") && len(name) > len("file:"):
+		files, err := NewFileStore(strings.TrimPrefix(name, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		return NewMarkerLedgerStore(files, "ledger", ""), nil
+	case LedgerPrefix(name) != "":
+		return NewMarkerLedgerStore(store, "", LedgerPrefix(name)), nil
+	}
+	return nil, fmt.Errorf("unknown ledger %q", name)
+}
+
+// Folder of the markers of the ledger name in the bucket of the objects, e.g. ledger/ for "s3", empty for other ledgers
+func LedgerPrefix(name string) string {
+	switch {
+	case name == "s3":
+		return "ledger/"
+	case strings.HasPrefix(name, "s3:") && strings.Trim(name[len("s3:"):], "/") != "":
+		return strings.Trim(name[len("s3:"):], "/") + "/"
+	}
+	return ""
+}
+
+/**************************************************************
+	MarkerLedgerStore keeps each entry as a JSON marker object
+	prefix<key>.json in an ObjectStore, in the bucket of the
+	object or in a fixed bucket
+ **************************************************************/
+type MarkerLedgerStore struct {
+	store  ObjectStore
+	bucket string // Bucket of the markers, the bucket of the object when empty
+	prefix string
+}
+
+// Create a MarkerLedgerStore in store, under prefix
+func NewMarkerLedgerStore(store ObjectStore, bucket, prefix string) *MarkerLedgerStore {
+	return &MarkerLedgerStore{store: store, bucket: bucket, prefix: prefix}
+}
+
+// Bucket and key of the marker of bucket/key
+func (markers *MarkerLedgerStore) marker(bucket, key string) (string, string) {
+	if markers.bucket == "" {
+		return bucket, markers.prefix + key + ".json"
+	}
+	return markers.bucket, markers.prefix + bucket + "/" + key + ".json"
+}
+
+func (markers *MarkerLedgerStore) Get(bucket, key string) (*LedgerEntry, error) {
+	markerBucket, markerKey := markers.marker(bucket, key)
+	content, err := markers.store.Get(markerBucket, markerKey)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry LedgerEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, fmt.Errorf("ledger marker %v/%v: %v", markerBucket, markerKey, err)
+	}
+	return &entry, nil
+}
+
+func (markers *MarkerLedgerStore) Put(entry *LedgerEntry) error {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	markerBucket, markerKey := markers.marker(entry.Bucket, entry.Key)
+	return markers.store.Put(markerBucket, markerKey, bytes.NewReader(content))
+}
+
+/**************************************************************
+	Ledger skips the events of objects already processed, with
+	the same ETag or an older (or equal) sequencer, and counts
+	them. Events of an object are processed one at a time.
+ **************************************************************/
+type Ledger struct {
+	store LedgerStore
+
+	mutex    sync.Mutex
+	inflight map[string]chan struct{} // Closed once the object is processed
+	stats    LedgerStats
+}
+
+// Counters of the ledger
+type LedgerStats struct {
+	// Events processed
+	Processed int64 `json:"processed"`
+	// Events skipped, already processed
+	Duplicates int64 `json:"duplicates"`
+	// Events skipped, older than the last processed event of the object
+	OutOfOrder int64 `json:"outOfOrder"`
+	// Events waiting for an event of the same object to be processed
+	Waits int64 `json:"waits"`
+	// Ledger errors, the events being processed anyway
+	Errors int64 `json:"errors"`
+}
+
+// Create a Ledger saving entries in store
+func NewLedger(store LedgerStore) *Ledger {
+	return &Ledger{store: store, inflight: map[string]chan struct{}{}}
+}
+
+/**************************************************************
+	Check whether the event record must be processed, false
+	for duplicates and older events. When true, the caller
+	calls Done once processed.
+ **************************************************************/
+func (ledger *Ledger) Begin(record RecordType) bool {
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	id := bucket + "/" + key
+	ledger.Acquire(record)
+
+	entry, err := ledger.store.Get(bucket, key)
+	if err != nil {
+		// Process anyway, events are delivered at least once
+		Error("Error reading ledger of s3://%v/%v: %v", bucket, key, err)
+		ledger.count(func(stats *LedgerStats) { stats.Errors++ })
+		return true
+	}
+	if entry == nil {
+		return true
+	}
+
+	skip := ""
+	switch order := CompareSequencers(record.S3.Object.Sequencer, entry.Sequencer); {
+	case record.S3.Object.Sequencer != "" && entry.Sequencer != "" && order < 0:
+		skip = "out of order"
+		ledger.count(func(stats *LedgerStats) { stats.OutOfOrder++ })
+	case record.S3.Object.Sequencer != "" && entry.Sequencer != "" && order == 0,
+		record.S3.Object.Sequencer == "" && record.S3.Object.ETag != "" && record.S3.Object.ETag == entry.ETag:
+		skip = "duplicate"
+		ledger.count(func(stats *LedgerStats) { stats.Duplicates++ })
+	}
+	if skip == "" {
+		return true
+	}
+
+	ledger.release(id)
+	Info("Skipping %v event %v of s3://%v/%v (sequencer %v, last %v %v at %v)",
+		skip, record.EventName, bucket, key, record.S3.Object.Sequencer, entry.Status, entry.Sequencer, entry.ProcessedAt)
+	return false
+}
+
+/**************************************************************
+	Wait for the events of the object of record being
+	processed, without checking the ledger (e.g. to reprocess
+	it). The caller calls Done once processed.
+ **************************************************************/
+func (ledger *Ledger) Acquire(record RecordType) {
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	id := bucket + "/" + key
+	for {
+		ledger.mutex.Lock()
+		done, busy := ledger.inflight[id]
+		if !busy {
+			ledger.inflight[id] = make(chan struct{})
+			ledger.mutex.Unlock()
+			return
+		}
+		ledger.stats.Waits++
+		ledger.mutex.Unlock()
+		Debug("Waiting for s3://%v/%v being processed", bucket, key)
+		<-done
+	}
+}
+
+/**************************************************************
+	Record the event record processed with status (e.g.
+	processed) and its parquet files outputs, or only release
+	it when status is empty so a new delivery is processed
+	again
+ **************************************************************/
+func (ledger *Ledger) Done(record RecordType, status string, outputs []string) {
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	defer ledger.release(bucket + "/" + key)
+	if status == "" {
+		return
+	}
+
+	ledger.count(func(stats *LedgerStats) { stats.Processed++ })
+	if err := ledger.store.Put(&LedgerEntry{
+		Bucket:      bucket,
+		Key:         key,
+		ETag:        record.S3.Object.ETag,
+		Sequencer:   record.S3.Object.Sequencer,
+		EventName:   record.EventName,
+		Status:      status,
+		ProcessedAt: time.Now(),
+		Outputs:     outputs,
+	}); err != nil {
+		Error("Error writing ledger of s3://%v/%v: %v", bucket, key, err)
+		ledger.count(func(stats *LedgerStats) { stats.Errors++ })
+	}
+}
+
+// Entry of the last event processed for bucket/key, nil if none
+func (ledger *Ledger) Entry(bucket, key string) (*LedgerEntry, error) {
+	return ledger.store.Get(bucket, key)
+}
+
+// Counters of the ledger
+func (ledger *Ledger) Stats() LedgerStats {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	return ledger.stats
+}
+
+// Update the counters
+func (ledger *Ledger) count(update func(stats *LedgerStats)) {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	update(&ledger.stats)
+}
+
+// The object bucket/key is no longer being processed
+func (ledger *Ledger) release(id string) {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	if done, ok := ledger.inflight[id]; ok {
+		close(done)
+		delete(ledger.inflight, id)
+	}
+}
+
+/**************************************************************
+	Compare the sequencers of two events of the same object,
+	-1 when a is older than b, 0 when equal, 1 when newer.
+	The shorter hexadecimal value is right padded with zeros.
+ **************************************************************/
+func CompareSequencers(a, b string) int {
+	a, b = strings.ToUpper(a), strings.ToUpper(b)
+	for len(a) < len(b) {
+		a += "0"
+	}
+	for len(b) < len(a) {
+		b += "0"
+	}
+	return strings.Compare(a, b)
+}
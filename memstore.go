@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+	MemoryStore is an in-memory ObjectStore, for unit tests
+	and running the pipeline on a laptop
+ **************************************************************/
+type MemoryStore struct {
+	mutex   sync.Mutex
+	buckets map[string]map[string]*memoryObject
+}
+
+// Object held by a MemoryStore
+type memoryObject struct {
+	content []byte
+	info    ObjectInfo
+}
+
+// Create an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]map[string]*memoryObject{}}
+}
+
+// Read the content of bucket/key
+func (store *MemoryStore) Get(bucket, key string) ([]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	object, ok := store.buckets[bucket][key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return append([]byte{}, object.content...), nil
+}
+
+// Stream the content of bucket/key
+func (store *MemoryStore) Open(bucket, key string) (io.ReadCloser, *ObjectInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	object, ok := store.buckets[bucket][key]
+	if !ok {
+		return nil, nil, ErrObjectNotFound
+	}
+	info := object.info
+	return ioutil.NopCloser(bytes.NewReader(object.content)), &info, nil
+}
+
+// Write the content of body to bucket/key
+func (store *MemoryStore) Put(bucket, key string, body io.Reader) error {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	store.put(bucket, key, content)
+	return nil
+}
+
+// Store content in bucket/key, creating the bucket if needed
+func (store *MemoryStore) put(bucket, key string, content []byte) {
+	sum := md5.Sum(content)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.buckets[bucket] == nil {
+		store.buckets[bucket] = map[string]*memoryObject{}
+	}
+	store.buckets[bucket][key] = &memoryObject{
+		content: content,
+		info: ObjectInfo{
+			Key:          key,
+			Size:         int64(len(content)),
+			ETag:         hex.EncodeToString(sum[:]),
+			LastModified: time.Now(),
+			ContentType:  http.DetectContentType(content),
+		},
+	}
+}
+
+// Copy sourceBucket/sourceKey to bucket/key
+func (store *MemoryStore) Copy(sourceBucket, sourceKey, bucket, key string) error {
+	content, err := store.Get(sourceBucket, sourceKey)
+	if err != nil {
+		return err
+	}
+	store.put(bucket, key, content)
+	return nil
+}
+
+// Describe bucket/key
+func (store *MemoryStore) Head(bucket, key string) (*ObjectInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	object, ok := store.buckets[bucket][key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	info := object.info
+	return &info, nil
+}
+
+// List objects of bucket with keys starting with prefix
+func (store *MemoryStore) List(bucket, prefix string) ([]ObjectInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	objects := []ObjectInfo{}
+	for key, object := range store.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, object.info)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Delete bucket/key
+func (store *MemoryStore) Delete(bucket, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.buckets[bucket], key)
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+/**************************************************************
+	Define Park Variables
+ **************************************************************/
+
+// Extension of the report written next to a parked object
+const failureReportExtension = ".error.json"
+
+// Stages of the processing of an object, reported when it fails
+const (
+	// Computing the output and error keys of the route
+	StageRoute = "route"
+	// Opening and reading the object
+	StageDownload = "download"
+	// Decompressing the content
+	StageDecompress = "decompress"
+	// Detecting the format of the content
+	StageFormat = "format"
+	// Reading the records and converting them to rows
+	StageParse = "parse"
+	// Computing the derived columns
+	StageDerive = "derive"
+	// Checking the rules of the dataset
+	StageValidate = "validate"
+	// Writing the parquet files
+	StageWrite = "write"
+	// Uploading the parquet files
+	StageUpload = "upload"
+)
+
+// Report of the failed attempts to process an object, next to its copy in error/
+type FailureReport struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	ErrorKey  string    `json:"errorKey"`
+	ETag      string    `json:"eTag,omitempty"`
+	Sequencer string    `json:"sequencer,omitempty"`
+	EventName string    `json:"eventName,omitempty"`
+	EventTime time.Time `json:"eventTime"`
+	// Stage, error and position in the file of the last attempt
+	Stage  string `json:"stage,omitempty"`
+	Error  string `json:"error"`
+	Record int    `json:"record,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	// Host which gave up on the object
+	Host     string    `json:"host,omitempty"`
+	Attempts []Attempt `json:"attempts"`
+	ParkedAt time.Time `json:"parkedAt"`
+}
+
+// Error of a stage of the processing of an object
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (err *StageError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *StageError) Unwrap() error {
+	return err.Err
+}
+
+// Mark err as failing at stage, unless it already has a stage; nil stays nil
+func AtStage(stage string, err error) error {
+	var stageError *StageError
+	if err == nil || errors.As(err, &stageError) {
+		return err
+	}
+	return &StageError{Stage: stage, Err: err}
+}
+
+// Key of the error parking lot of the object of record, from its route or else error/<key>
+func errorKeyOf(record RecordType) string {
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	if route, err := config.RouteFor(key); err == nil {
+		if dataset, err := config.RouteDataset(route, key); err == nil {
+			if _, errorKey, err := route.Keys(bucket, key, dataset.Name, "", record.EventTime); err == nil {
+				return errorKey
+			}
+		}
+	}
+	return "error/" + key
+}
+
+/**************************************************************
+	Give up on the object of record: copy it to the error
+	parking lot, and write the report of the failed attempts
+	next to it (e.g. error/test.json.error.json). All the
+	failures are parked here, whatever their stage.
+ **************************************************************/
+func Park(store ObjectStore, record RecordType, attempts []Attempt) error {
+	bucket, item := record.S3.Bucket.Name, record.S3.Object.Key
+	itemError := errorKeyOf(record)
+
+	report := &FailureReport{
+		Bucket:    bucket,
+		Key:       item,
+		ErrorKey:  itemError,
+		ETag:      record.S3.Object.ETag,
+		Sequencer: record.S3.Object.Sequencer,
+		EventName: record.EventName,
+		EventTime: record.EventTime,
+		Attempts:  attempts,
+		ParkedAt:  time.Now(),
+	}
+	if len(attempts) > 0 {
+		last := attempts[len(attempts)-1]
+		report.Stage, report.Error, report.Record, report.Line = last.Stage, last.Error, last.Record, last.Line
+	}
+	report.Host, _ = os.Hostname()
+	// Events without ETag (e.g. test events) get the ETag of the object
+	if report.ETag == "" {
+		if info, err := store.Head(bucket, item); err == nil {
+			report.ETag = info.ETag
+		}
+	}
+
+	// Copy the file to the error folder, unless it was deleted since
+	err := store.Copy(bucket, item, bucket, itemError)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		Error("Error copying file s3://%v/%v to s3://%v/%v: %v", bucket, item, bucket, itemError, err)
+		return err
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := store.Put(bucket, itemError+failureReportExtension, bytes.NewReader(content)); err != nil {
+		Error("Error writing report s3://%v/%v%v: %v", bucket, itemError, failureReportExtension, err)
+		return err
+	}
+
+	Info("File s3://%v/%v parked in s3://%v/%v after %v attempt(s), failing at stage %q: %v", bucket, item, bucket, itemError, len(attempts), report.Stage, report.Error)
+	return nil
+}
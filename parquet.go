@@ -1,86 +1,263 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/xitongsys/parquet-go-source/local"
 	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
 	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"io/ioutil"
 	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"time"
 )
 
+// Key of the parquet file of a partition path (e.g. "dt=2020-04-06/hour=21", "" without partitions)
+type PartitionKeyFunc func(partition string) (string, error)
+
+// Parquet file written to the store
+type ParquetFile struct {
+	// Key of the file
+	Key string
+	// Partition path of the file, e.g. dt=2020-04-06/hour=21
+	Partition string
+	// Number of rows
+	Rows int
+}
+
+// Parquet file of one partition, written to a local temp file
+type parquetPartition struct {
+	filename string
+	fw       source.ParquetFile
+	pw       *writer.JSONWriter
+	count    int
+}
+
+// Bytes of the rows buffered by the writer, until its next row group
+func (partition *parquetPartition) buffered() int64 {
+	return partition.pw.Size + partition.pw.ObjsSize
+}
+
 /**************************************************************
-	Write a parquet file in s3://s3_bucket/s3_item from
-	a DataObjectType
+	Parquet writers of the partitions of a file. The rows
+	buffered by all the writers are bounded by the row group
+	size: past it, the writer buffering the most rows writes
+	its row group, so memory doesn't grow with the number of
+	partitions.
  **************************************************************/
-func WriteToParquet(object DataObjectType, s3_bucket, s3_item string) error {
+type parquetWriters struct {
+	dataset     *Dataset
+	folder      string
+	partitions  map[string]*parquetPartition
+	buffered    int64 // Bytes buffered by all the writers
+	maxBuffered int64
+}
 
-	Debug("Preparing file s3://%v/%v", s3_bucket, s3_item)
-	Debug("Object:%v", object)
+// Create the writers of the partitions of dataset in folder
+func newParquetWriters(dataset *Dataset, folder string) *parquetWriters {
+	return &parquetWriters{
+		dataset:     dataset,
+		folder:      folder,
+		partitions:  map[string]*parquetPartition{},
+		maxBuffered: config.RowGroupSize,
+	}
+}
 
-	// Create temp folder
-	exec_dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+// Writer of the partition path, created on first use
+func (writers *parquetWriters) partition(path string) (*parquetPartition, error) {
+	if partition, ok := writers.partitions[path]; ok {
+		return partition, nil
+	}
+	if len(writers.partitions) >= maxPartitions {
+		err := fmt.Errorf("more than %v partitions", maxPartitions)
+		Error("Error with dataset %v: %v", writers.dataset.Name, err)
+		return nil, err
+	}
+	partition, err := newParquetPartition(writers.dataset, writers.folder, len(writers.partitions))
 	if err != nil {
-		Error("Error getting executable folder: %v\n", err)
-		return err
+		return nil, err
 	}
+	writers.partitions[path] = partition
+	Debug("New partition %v", path)
+	return partition, nil
+}
 
-	timeNano := strconv.FormatInt(time.Now().UnixNano(), 10)
-	folder := exec_dir + "/data_" + timeNano
-	if err := os.MkdirAll(folder, 0700); err != nil {
-		Error("Error creating temp folder %v: %v\n", folder, err)
+// Write row in the file of the partition path
+func (writers *parquetWriters) write(path string, row Row) error {
+	partition, err := writers.partition(path)
+	if err != nil {
 		return err
 	}
+	element, err := json.Marshal(row)
+	if err != nil {
+		Error("Error encoding row %v: %v", row, err)
+		return err
+	}
+	buffered := partition.buffered()
+	if err = partition.pw.Write(string(element)); err != nil {
+		Error("Write error: %v", err)
+		return err
+	}
+	partition.count++
+	writers.buffered += partition.buffered() - buffered
+
+	for writers.buffered > writers.maxBuffered {
+		if flushed, err := writers.flushLargest(); err != nil || !flushed {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the row group of the writer buffering the most rows, false without rows buffered
+func (writers *parquetWriters) flushLargest() (bool, error) {
+	var largest *parquetPartition
+	for _, partition := range writers.partitions {
+		if largest == nil || partition.buffered() > largest.buffered() {
+			largest = partition
+		}
+	}
+	buffered := largest.buffered()
+	if buffered == 0 {
+		return false, nil
+	}
+	if err := largest.pw.Flush(true); err != nil {
+		Error("Flush error: %v", err)
+		return false, err
+	}
+	Debug("Row group of %v written, %v bytes buffered by %v partitions", largest.filename, writers.buffered, len(writers.partitions))
+	writers.buffered -= buffered - largest.buffered()
+	return true, nil
+}
+
+// Close the local files of the writers
+func (writers *parquetWriters) close() {
+	for _, partition := range writers.partitions {
+		partition.fw.Close()
+	}
+}
+
+/**************************************************************
+	Write the parquet files in s3://s3_bucket of store from the
+	rows of a dataset, read one at a time, one file per
+	partition of the dataset with the key given by keyOf.
+	Memory is bounded by the row group size, shared by the
+	partitions, parquet files are written to temp files then
+	streamed to the store. Return the files written. Errors of
+	the rows are permanent.
+ **************************************************************/
+func WriteToParquet(store ObjectStore, dataset *Dataset, rows RowReader, eventTime time.Time, s3_bucket string, keyOf PartitionKeyFunc) ([]ParquetFile, error) {
+
+	Debug("Preparing parquet files of dataset %v in s3://%v", dataset.Name, s3_bucket)
+
+	// Create temp folder in the temp dir (TMPDIR), the folder of the executable being read-only in Lambda
+	folder, err := ioutil.TempDir("", "data_")
+	if err != nil {
+		Error("Error creating temp folder: %v", err)
+		return nil, AtStage(StageWrite, err)
+	}
 	defer func() {
 		_ = RemoveDirectory(folder)
 	}()
 	Debug("Working folder: %v", folder)
 
-	// Create Parquet File Writer
-	localParquetFilename := folder + "/" + filepath.Base(s3_item)
-	Debug("Creating NewLocalFileWriter on local temp file %v", localParquetFilename)
-	fw, err := local.NewLocalFileWriter(localParquetFilename)
-	if err != nil {
-		Error("Error: Can't create parquet file: %v", err)
-		return err
+	writers := newParquetWriters(dataset, folder)
+	defer writers.close()
+
+	// Without partitions, write a file even without rows
+	if len(dataset.Partitions) == 0 {
+		if _, err = writers.partition(""); err != nil {
+			return nil, AtStage(StageWrite, err)
+		}
 	}
-	defer fw.Close()
 
-	pw, err := writer.NewParquetWriter(fw, new(DataObjectElement), 4)
-	if err != nil {
-		Error("Can't create json writer", err)
-		return err
+	// Write data to Parquet with JSON content, in the file of the partition of each row
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Error("Error reading row: %v", err)
+			return nil, Permanent(AtStage(StageParse, err))
+		}
+		if err = writers.write(dataset.PartitionPath(row, eventTime), row); err != nil {
+			return nil, AtStage(StageWrite, err)
+		}
 	}
 
-	pw.RowGroupSize = 128 * 1024 * 1024 //128M
-	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	// Stop Writers and upload files to S3, in the order of the partitions
+	paths := make([]string, 0, len(writers.partitions))
+	for path := range writers.partitions {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
 
-	// Write data to Parquet with JSON content
-	for _, element := range object {
-		if err = pw.Write(element); err != nil {
-			Error("Write error", err)
-			return err
+	files := []ParquetFile{}
+	for _, path := range paths {
+		partition := writers.partitions[path]
+		if err = partition.pw.WriteStop(); err != nil {
+			Error("WriteStop error: %v", err)
+			return files, AtStage(StageWrite, err)
 		}
+		Debug("Parquet file %v written with %v rows", partition.filename, partition.count)
+
+		s3_item, err := keyOf(path)
+		if err != nil {
+			Error("Error with partition %v: %v", path, err)
+			return files, err
+		}
+		if err := putFile(store, s3_bucket, s3_item, partition.filename); err != nil {
+			return files, AtStage(StageUpload, err)
+		}
+		files = append(files, ParquetFile{Key: s3_item, Partition: path, Rows: partition.count})
+		Info("Parquet file s3://%v/%v ready (%v rows)", s3_bucket, s3_item, partition.count)
 	}
 
-	// Stop Writer
-	if err = pw.WriteStop(); err != nil {
-		Error("WriteStop error", err)
-		return err
+	if len(files) == 0 {
+		Info("No rows, no parquet file for dataset %v", dataset.Name)
 	}
 
-	Debug("Parquet file %v written", localParquetFilename)
+	// Exiting will automatically RemoveDirectory(folder)
+	return files, nil
+}
 
-	// Upload file to S3
-	err = AddFileToS3(s3_bucket, s3_item, localParquetFilename)
+// Create the parquet writer of the index-th partition in folder
+func newParquetPartition(dataset *Dataset, folder string, index int) (*parquetPartition, error) {
+	filename := folder + "/part-" + strconv.Itoa(index) + ".parquet"
+	Debug("Creating NewLocalFileWriter on local temp file %v", filename)
+	fw, err := local.NewLocalFileWriter(filename)
 	if err != nil {
-		Error("Error adding file to S3", err)
-		return err
+		Error("Error: Can't create parquet file: %v", err)
+		return nil, err
+	}
+
+	pw, err := writer.NewJSONWriter(dataset.parquetSchema, fw, 4)
+	if err != nil {
+		Error("Can't create json writer: %v", err)
+		fw.Close()
+		return nil, err
 	}
 
-	Info("Parquet file s3://%v/%v ready", s3_bucket, s3_item)
+	pw.RowGroupSize = config.RowGroupSize
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetPartition{filename: filename, fw: fw, pw: pw}, nil
+}
 
-	// Exiting will automatically RemoveDirectory(folder)
+// Upload the local file filename to s3://s3_bucket/s3_item of store
+func putFile(store ObjectStore, s3_bucket, s3_item, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		Error("Error opening file %v: %v", filename, err)
+		return err
+	}
+	defer file.Close()
+	if err = store.Put(s3_bucket, s3_item, file); err != nil {
+		Error("Error adding file to S3: %v", err)
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RowReader of a slice of rows
+type sliceRows struct {
+	rows []Row
+}
+
+func (reader *sliceRows) Next() (Row, error) {
+	if len(reader.rows) == 0 {
+		return nil, io.EOF
+	}
+	row := reader.rows[0]
+	reader.rows = reader.rows[1:]
+	return row, nil
+}
+
+// Default dataset partitioned by a, with n rows spread over partitions values of a
+func partitionedRows(t *testing.T, n, partitions int) (*Dataset, []Row) {
+	dataset := DefaultDataset()
+	dataset.Partitions = []Partition{{Name: "av", Column: "a"}}
+	if err := dataset.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]Row, n)
+	for i := range rows {
+		rows[i] = Row{"a": float32(i % partitions), "b": float32(i), "total": float32(i + i%partitions), "created_ts": int64(1586207145000 + i)}
+	}
+	return dataset, rows
+}
+
+func TestParquetWritersBuffered(t *testing.T) {
+	withConfig(t)
+	config.RowGroupSize = 16 * 1024
+	eventTime := time.Date(2020, 4, 6, 21, 5, 45, 0, time.UTC)
+	dataset, rows := partitionedRows(t, 5000, 50)
+
+	writers := newParquetWriters(dataset, t.TempDir())
+	defer writers.close()
+	for i, row := range rows {
+		if err := writers.write(dataset.PartitionPath(row, eventTime), row); err != nil {
+			t.Fatal(err)
+		}
+		// The rows buffered by all the writers stay below the row group size
+		total := int64(0)
+		for _, partition := range writers.partitions {
+			total += partition.buffered()
+		}
+		if total != writers.buffered || total > config.RowGroupSize {
+			t.Fatalf("row %v: %v bytes buffered by %v partitions (counted %v), expected at most %v", i+1, total, len(writers.partitions), writers.buffered, config.RowGroupSize)
+		}
+	}
+	if len(writers.partitions) != 50 {
+		t.Errorf("%v partitions", len(writers.partitions))
+	}
+	for path, partition := range writers.partitions {
+		if partition.count != 100 {
+			t.Errorf("%v: %v rows", path, partition.count)
+		}
+	}
+}
+
+func TestWriteToParquetPartitions(t *testing.T) {
+	withConfig(t)
+	config.RowGroupSize = 16 * 1024
+	eventTime := time.Date(2020, 4, 6, 21, 5, 45, 0, time.UTC)
+	keyOf := func(partition string) (string, error) { return "processed/" + partition + "/test.json.parquet", nil }
+
+	dataset, rows := partitionedRows(t, 5000, 50)
+	store := NewMemoryStore()
+	files, err := WriteToParquet(store, dataset, &sliceRows{rows}, eventTime, "deglon", keyOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 50 || files[0].Key != "processed/av=0/test.json.parquet" {
+		t.Fatalf("files %+v", files)
+	}
+	for _, file := range files {
+		content, err := store.Get("deglon", file.Key)
+		if err != nil || file.Rows != 100 || !strings.HasPrefix(string(content), "PAR1") {
+			t.Errorf("%+v: %v", file, err)
+		}
+	}
+
+	// One more partition than the maximum
+	dataset, rows = partitionedRows(t, maxPartitions+1, maxPartitions+1)
+	if _, err := WriteToParquet(NewMemoryStore(), dataset, &sliceRows{rows}, eventTime, "deglon", keyOf); err == nil || !strings.Contains(err.Error(), "more than 100 partitions") {
+		t.Errorf("got %v, expected too many partitions", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**************************************************************
+	Define Partition Variables
+ **************************************************************/
+
+// Value of a partition when the column is null, as written by Hive
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// Layouts of the time formats of partitions
+var partitionFormats = map[string]string{
+	"date":  "2006-01-02",
+	"year":  "2006",
+	"month": "01",
+	"day":   "02",
+	"hour":  "15",
+}
+
+// Most partitions written from one file, each one holds a parquet writer and a temp file
+var maxPartitions = 100
+
+/**************************************************************
+	Partition is a Hive-style folder of the parquet files of a
+	dataset, e.g. dt=2020-04-06, with the value taken from the
+	time of the S3 event or from a column of the rows
+ **************************************************************/
+type Partition struct {
+	// Name of the partition folder, e.g. dt, not a column of the dataset
+	Name string `json:"name"`
+	// Column of the value, by default the time of the S3 event
+	Column string `json:"column,omitempty"`
+	// Format of times: date (YYYY-MM-DD), year, month, day or hour, required for the event time
+	Format string `json:"format,omitempty"`
+
+	column *Column
+}
+
+// Check the partition against the columns of the dataset
+func (partition *Partition) compile(dataset *Dataset) error {
+	if !columnNameRegexp.MatchString(partition.Name) {
+		return fmt.Errorf("invalid partition name %q", partition.Name)
+	}
+	if _, ok := dataset.Column(partition.Name); ok {
+		return fmt.Errorf("partition %v is also a column", partition.Name)
+	}
+	partition.Format = strings.ToLower(partition.Format)
+	if _, ok := partitionFormats[partition.Format]; !ok && partition.Format != "" {
+		return fmt.Errorf("partition %v: unknown format %q", partition.Name, partition.Format)
+	}
+
+	partition.column = nil
+	if partition.Column == "" {
+		if partition.Format == "" {
+			return fmt.Errorf("partition %v: format required for the event time", partition.Name)
+		}
+		return nil
+	}
+	column, ok := dataset.Column(partition.Column)
+	if !ok {
+		return fmt.Errorf("partition %v: %v is not a column", partition.Name, partition.Column)
+	}
+	if partition.Format != "" && column.LogicalType != "DATE" && !strings.HasPrefix(column.LogicalType, "TIMESTAMP") {
+		return fmt.Errorf("partition %v: format %v requires a DATE or TIMESTAMP column", partition.Name, partition.Format)
+	}
+	partition.column = &column
+	return nil
+}
+
+// Value of the partition for row, escaped for a key
+func (partition *Partition) value(row Row, eventTime time.Time) string {
+	if partition.column == nil {
+		return eventTime.UTC().Format(partitionFormats[partition.Format])
+	}
+
+	value := row[partition.column.Name]
+	if value == nil {
+		return hiveDefaultPartition
+	}
+	if partition.Format != "" {
+		switch v := value.(type) {
+		case int32:
+			// DATE, days since epoch
+			value = time.Unix(int64(v)*86400, 0).UTC().Format(partitionFormats[partition.Format])
+		case int64:
+			if partition.column.LogicalType == "TIMESTAMP_MICROS" {
+				value = time.Unix(0, v*1000).UTC().Format(partitionFormats[partition.Format])
+			} else {
+				value = time.Unix(0, v*1000000).UTC().Format(partitionFormats[partition.Format])
+			}
+		}
+	}
+	s := fmt.Sprint(value)
+	if s == "" {
+		return hiveDefaultPartition
+	}
+	return escapePartitionValue(s)
+}
+
+/**************************************************************
+	Path of the partition of a row, e.g. dt=2020-04-06/hour=21,
+	empty when the dataset has no partitions
+ **************************************************************/
+func (dataset *Dataset) PartitionPath(row Row, eventTime time.Time) string {
+	folders := make([]string, len(dataset.Partitions))
+	for i := range dataset.Partitions {
+		partition := &dataset.Partitions[i]
+		folders[i] = partition.Name + "=" + partition.value(row, eventTime)
+	}
+	return strings.Join(folders, "/")
+}
+
+// Escape the characters of a partition value like Hive, e.g. / as %2F
+func escapePartitionValue(s string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		if b < 0x20 || b == 0x7f || strings.IndexByte("\"#%'*/:=?\\{[]^", b) >= 0 {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		} else {
+			escaped.WriteByte(b)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+	Define Work Queue Variables
+ **************************************************************/
+
+// Errors returned when records can't be queued
+var (
+	ErrQueueFull   = errors.New("work queue full")
+	ErrQueueClosed = errors.New("work queue closed")
+)
+
+// Queue of the records to process, set in main (records are processed synchronously without it)
+var workQueue *WorkQueue
+
+/**************************************************************
+	WorkQueue is a bounded queue of event records processed in
+	the background by a pool of workers. Jobs are saved in the
+	journal until done, failed jobs are retried with backoff
+	then parked.
+ **************************************************************/
+type WorkQueue struct {
+	jobs    chan *Job
+	process func(record RecordType) error
+	park    func(job *Job) error
+	journal *Journal
+	policy  RetryPolicy
+	size    int
+	workers sync.WaitGroup
+
+	mutex   sync.Mutex
+	closed  bool
+	pending int // Jobs queued, being processed or waiting for a retry
+	stats   QueueStats
+}
+
+// Counters of the queue
+type QueueStats struct {
+	// Records waiting in the queue
+	Queued int `json:"queued"`
+	// Records waiting for a retry
+	Delayed int `json:"delayed"`
+	// Size of the queue
+	Capacity int `json:"capacity"`
+	// Number of workers
+	Workers int `json:"workers"`
+	// Records being processed
+	Busy int `json:"busy"`
+	// Records processed
+	Processed int64 `json:"processed"`
+	// Failed attempts retried later
+	Retries int64 `json:"retries"`
+	// Records given up and parked in error/
+	Parked int64 `json:"parked"`
+	// Records refused, the queue being full or closed
+	Rejected int64 `json:"rejected"`
+	// Records loaded from the journal at startup
+	Recovered int64 `json:"recovered"`
+}
+
+/**************************************************************
+	Create a WorkQueue of size records processed with process
+	by workers goroutines, resuming the jobs of the journal.
+	Records failing with policy.MaxAttempts attempts, or with
+	a permanent error, are given to park.
+ **************************************************************/
+func NewWorkQueue(size, workers int, journal *Journal, policy RetryPolicy, process func(record RecordType) error, park func(job *Job) error) (*WorkQueue, error) {
+	recovered, err := journal.Load()
+	if err != nil {
+		Error("Error loading journal %v: %v", journal, err)
+		return nil, err
+	}
+
+	queue := &WorkQueue{
+		jobs:    make(chan *Job, size+len(recovered)),
+		process: process,
+		park:    park,
+		journal: journal,
+		policy:  policy,
+		size:    size,
+	}
+	queue.stats.Capacity = size
+	queue.stats.Workers = workers
+
+	// Resume the jobs of the previous run
+	queue.pending = len(recovered)
+	queue.stats.Recovered = int64(len(recovered))
+	for _, job := range recovered {
+		queue.schedule(job)
+	}
+	if len(recovered) > 0 {
+		Info("Resuming %v jobs of journal %v", len(recovered), journal)
+	}
+
+	queue.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+	return queue, nil
+}
+
+// Process the jobs of the queue until it is closed and empty
+func (queue *WorkQueue) work() {
+	defer queue.workers.Done()
+	for job := range queue.jobs {
+		queue.count(func(stats *QueueStats) { stats.Busy++ })
+		err := queue.process(job.Record)
+		queue.count(func(stats *QueueStats) { stats.Busy-- })
+
+		if err != nil {
+			queue.fail(job, err)
+			continue
+		}
+		queue.done(job)
+		queue.count(func(stats *QueueStats) { stats.Processed++ })
+	}
+}
+
+/**************************************************************
+	Record the failed attempt of job, then retry it later or,
+	once attempts are exhausted or the error is permanent,
+	park it
+ **************************************************************/
+func (queue *WorkQueue) fail(job *Job, err error) {
+	job.Attempts = append(job.Attempts, NewAttempt(err))
+	bucket, key := job.Record.S3.Bucket.Name, job.Record.S3.Object.Key
+
+	if !IsPermanent(err) && len(job.Attempts) < queue.policy.MaxAttempts {
+		delay := queue.policy.Delay(len(job.Attempts))
+		job.NotBefore = time.Now().Add(delay)
+		if err := queue.journal.Save(job); err != nil {
+			Error("Error saving job %v in journal: %v", job.ID, err)
+		}
+		Info("Attempt %v of s3://%v/%v failed, retrying in %v: %v", len(job.Attempts), bucket, key, delay, err)
+		queue.count(func(stats *QueueStats) { stats.Retries++ })
+		queue.schedule(job)
+		return
+	}
+
+	if err := queue.park(job); err != nil {
+		// Keep the job in the journal, it is resumed at the next start
+		Error("Error parking s3://%v/%v, kept in journal: %v", bucket, key, err)
+		queue.release()
+		return
+	}
+	queue.count(func(stats *QueueStats) { stats.Parked++ })
+	queue.done(job)
+}
+
+// Remove the job done from the journal
+func (queue *WorkQueue) done(job *Job) {
+	if err := queue.journal.Remove(job); err != nil {
+		Error("Error removing job %v from journal: %v", job.ID, err)
+	}
+	queue.release()
+}
+
+// The job is no longer pending
+func (queue *WorkQueue) release() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.pending--
+}
+
+// Queue job at job.NotBefore, unless the queue is closed (the job stays in the journal)
+func (queue *WorkQueue) schedule(job *Job) {
+	queue.count(func(stats *QueueStats) { stats.Delayed++ })
+	time.AfterFunc(time.Until(job.NotBefore), func() {
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+		queue.stats.Delayed--
+		if queue.closed {
+			queue.pending--
+			return
+		}
+		// Never blocks, the channel holds all the pending jobs
+		queue.jobs <- job
+	})
+}
+
+/**************************************************************
+	Queue all the records, saved in the journal, or none of
+	them with ErrQueueFull when the queue can't hold them all,
+	or ErrQueueClosed when shutting down
+ **************************************************************/
+func (queue *WorkQueue) Enqueue(records []RecordType) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		queue.stats.Rejected += int64(len(records))
+		return ErrQueueClosed
+	}
+	if queue.pending+len(records) > queue.size {
+		queue.stats.Rejected += int64(len(records))
+		return ErrQueueFull
+	}
+
+	jobs := []*Job{}
+	for _, record := range records {
+		job := NewJob(record)
+		if err := queue.journal.Save(job); err != nil {
+			Error("Error saving job %v in journal: %v", job.ID, err)
+			for _, job := range jobs {
+				queue.journal.Remove(job)
+			}
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	for _, job := range jobs {
+		queue.jobs <- job
+	}
+	queue.pending += len(jobs)
+	return nil
+}
+
+/**************************************************************
+	Stop accepting records and wait for the queued records to
+	be processed, or for ctx to be done. Jobs waiting for a
+	retry stay in the journal.
+ **************************************************************/
+func (queue *WorkQueue) Shutdown(ctx context.Context) error {
+	queue.mutex.Lock()
+	if !queue.closed {
+		queue.closed = true
+		close(queue.jobs)
+	}
+	queue.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		queue.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Counters of the queue
+func (queue *WorkQueue) Stats() QueueStats {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	stats := queue.stats
+	stats.Queued = len(queue.jobs)
+	return stats
+}
+
+// Update the counters
+func (queue *WorkQueue) count(update func(stats *QueueStats)) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	update(&queue.stats)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Jobs queued, being processed or waiting for a retry
+func pendingJobs(queue *WorkQueue) int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.pending
+}
+
+// Work queue with a journal in a temp folder, processing records with process
+func newTestQueue(t *testing.T, size, workers int, process func(record RecordType) error) (*WorkQueue, *Journal) {
+	journal, err := OpenJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewWorkQueue(size, workers, journal, testRetryPolicy(t), process, func(job *Job) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue, journal
+}
+
+func TestWorkQueueFull(t *testing.T) {
+	started := make(chan string, 4)
+	release := make(chan struct{})
+	queue, journal := newTestQueue(t, 2, 1, func(record RecordType) error {
+		started <- record.S3.Object.Key
+		<-release
+		return nil
+	})
+
+	// The job being processed counts in the pending jobs
+	if err := queue.Enqueue([]RecordType{createdRecord("deglon", "data/a.json")}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if pending := pendingJobs(queue); pending != 1 {
+		t.Errorf("pending %v, expected 1", pending)
+	}
+
+	// All the records are queued or none of them
+	err := queue.Enqueue([]RecordType{createdRecord("deglon", "data/b.json"), createdRecord("deglon", "data/c.json")})
+	if err != ErrQueueFull {
+		t.Errorf("got %v, expected ErrQueueFull", err)
+	}
+	if stats := queue.Stats(); pendingJobs(queue) != 1 || stats.Queued != 0 || stats.Busy != 1 || stats.Rejected != 2 {
+		t.Errorf("pending %v, stats %+v", pendingJobs(queue), stats)
+	}
+	if err := queue.Enqueue([]RecordType{createdRecord("deglon", "data/b.json")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Enqueue([]RecordType{createdRecord("deglon", "data/c.json")}); err != ErrQueueFull {
+		t.Errorf("got %v, expected ErrQueueFull", err)
+	}
+	if stats := queue.Stats(); pendingJobs(queue) != 2 || stats.Queued != 1 || stats.Rejected != 3 {
+		t.Errorf("pending %v, stats %+v", pendingJobs(queue), stats)
+	}
+	if jobs, err := journal.Load(); err != nil || len(jobs) != 2 {
+		t.Errorf("journal %v, %v", jobs, err)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := queue.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := queue.Stats(); pendingJobs(queue) != 0 || stats.Processed != 2 || stats.Busy != 0 {
+		t.Errorf("pending %v, stats %+v", pendingJobs(queue), stats)
+	}
+	if err := queue.Enqueue([]RecordType{createdRecord("deglon", "data/c.json")}); err != ErrQueueClosed {
+		t.Errorf("got %v, expected ErrQueueClosed", err)
+	}
+}
+
+func TestWorkQueueShutdown(t *testing.T) {
+	var done int32
+	release := make(chan struct{})
+	queue, journal := newTestQueue(t, 4, 2, func(record RecordType) error {
+		<-release
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&done, 1)
+		return nil
+	})
+	records := []RecordType{createdRecord("deglon", "data/a.json"), createdRecord("deglon", "data/b.json"), createdRecord("deglon", "data/c.json")}
+	if err := queue.Enqueue(records); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deadline passes while the jobs are in flight
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := queue.Shutdown(ctx); err != context.DeadlineExceeded || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("got %v after %v, expected the deadline", err, time.Since(start))
+	}
+	if n := atomic.LoadInt32(&done); n != 0 {
+		t.Errorf("%v jobs done", n)
+	}
+
+	// The drain waits for the jobs in flight and the jobs queued
+	close(release)
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&done); n != 3 || pendingJobs(queue) != 0 {
+		t.Errorf("%v jobs done, %v pending", n, pendingJobs(queue))
+	}
+	if jobs, err := journal.Load(); err != nil || len(jobs) != 0 {
+		t.Errorf("journal %v, %v", jobs, err)
+	}
+}
+
+func TestEventHandlerQueueFull(t *testing.T) {
+	withConfig(t)
+	config.EventToken = "secret"
+	release := make(chan struct{})
+	defer close(release)
+	queue, _ := newTestQueue(t, 1, 1, func(record RecordType) error {
+		<-release
+		return nil
+	})
+	previous := workQueue
+	workQueue = queue
+	t.Cleanup(func() { workQueue = previous })
+
+	body, err := ioutil.ReadFile(filepath.Join("events", "s3.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader(string(body)))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		eventHandler(w, r)
+		return w
+	}
+
+	if w := post(); w.Code != http.StatusOK {
+		t.Fatalf("status %v: %s", w.Code, w.Body)
+	}
+	// The queue is full, the sender retries later
+	w := post()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" || !strings.Contains(w.Body.String(), ErrQueueFull.Error()) {
+		t.Errorf("status %v, Retry-After %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+	if stats := queue.Stats(); stats.Rejected != 1 || pendingJobs(queue) != 1 {
+		t.Errorf("pending %v, stats %+v", pendingJobs(queue), stats)
+	}
+}
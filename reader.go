@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+/**************************************************************
+	Define Input Format Variables
+ **************************************************************/
+
+// Input formats
+const (
+	// JSON array of records
+	FormatJSON = "json"
+	// Newline-delimited JSON, one record per line
+	FormatNDJSON = "ndjson"
+	// Comma separated values, with a header line
+	FormatCSV = "csv"
+	// Tab separated values, with a header line
+	FormatTSV = "tsv"
+)
+
+// Formats of the file extensions
+var formatExtensions = map[string]string{
+	".jsonl":  FormatNDJSON,
+	".ndjson": FormatNDJSON,
+	".csv":    FormatCSV,
+	".tsv":    FormatTSV,
+	".tab":    FormatTSV,
+}
+
+/**************************************************************
+	RowReader streams the rows of an input file, one at a
+	time, so memory doesn't depend on the file size
+ **************************************************************/
+type RowReader interface {
+	// Next row, io.EOF after the last one
+	Next() (Row, error)
+}
+
+// Error of a row, with its record number and line in the file (0 when unknown), both from 1
+type RowError struct {
+	Record int
+	Line   int
+	Err    error
+	// Content of the row (record, line or fields), nil when the rest of the file can't be read
+	Content interface{}
+}
+
+func (err *RowError) Error() string {
+	switch {
+	case err.Line == 0:
+		return fmt.Sprintf("record %v: %v", err.Record, err.Err)
+	case err.Record == 0:
+		return fmt.Sprintf("line %v: %v", err.Line, err.Err)
+	}
+	return fmt.Sprintf("row %v (line %v): %v", err.Record, err.Line, err.Err)
+}
+
+func (err *RowError) Unwrap() error {
+	return err.Err
+}
+
+/**************************************************************
+	Create the RowReader of the content of key, detecting the
+	format from the extension of key (.jsonl, .ndjson, .csv,
+	.tsv), or else from the first character of the content:
+	'[' for a JSON array, '{' for NDJSON, otherwise CSV
+ **************************************************************/
+func NewRowReader(key string, content io.Reader, dataset *Dataset) (RowReader, string, error) {
+	reader := bufio.NewReader(content)
+
+	// Skip the UTF-8 byte order mark
+	if bom, _ := reader.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		reader.Discard(3)
+	}
+
+	format, err := DetectFormat(key, reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch format {
+	case FormatNDJSON:
+		return NewNDJSONReader(reader, dataset), format, nil
+	case FormatCSV:
+		return NewCSVReader(reader, dataset, ','), format, nil
+	case FormatTSV:
+		return NewCSVReader(reader, dataset, '\t'), format, nil
+	}
+	return NewJSONArrayReader(reader, dataset), format, nil
+}
+
+// Detect the format of the content of key, peeking at its first bytes
+func DetectFormat(key string, reader *bufio.Reader) (string, error) {
+	if format, ok := formatExtensions[strings.ToLower(path.Ext(key))]; ok {
+		return format, nil
+	}
+
+	for size := 64; size <= reader.Size(); size *= 2 {
+		head, err := reader.Peek(size)
+		head = bytes.TrimLeft(head, " \t\r\n")
+		if len(head) > 0 {
+			switch head[0] {
+			case '[':
+				return FormatJSON, nil
+			case '{':
+				return FormatNDJSON, nil
+			}
+			return FormatCSV, nil
+		}
+		if err == io.EOF {
+			// Empty file, no rows
+			return FormatNDJSON, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("unknown format, content starts with blanks")
+}
+
+/**************************************************************
+	Read a JSON array of records, e.g. [{"a":1},{"a":2}],
+	incrementally into rows of a dataset
+ **************************************************************/
+type jsonArrayReader struct {
+	decoder *json.Decoder
+	dataset *Dataset
+	index   int
+	started bool
+}
+
+// Create a RowReader of the JSON array in r
+func NewJSONArrayReader(r io.Reader, dataset *Dataset) RowReader {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	return &jsonArrayReader{decoder: decoder, dataset: dataset}
+}
+
+func (reader *jsonArrayReader) Next() (Row, error) {
+	// Expect the opening bracket of the array
+	if !reader.started {
+		token, err := reader.decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("reading JSON array: %v", err)
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("expected a JSON array, got %v", token)
+		}
+		reader.started = true
+	}
+
+	// Consume the closing bracket after the last record
+	if !reader.decoder.More() {
+		if _, err := reader.decoder.Token(); err != nil {
+			return nil, &RowError{Record: reader.index + 1, Err: err}
+		}
+		return nil, io.EOF
+	}
+
+	reader.index++
+	var record map[string]interface{}
+	if err := reader.decoder.Decode(&record); err != nil {
+		return nil, &RowError{Record: reader.index, Err: err}
+	}
+	row, err := reader.dataset.NewRow(record)
+	if err != nil {
+		return nil, &RowError{Record: reader.index, Err: err, Content: record}
+	}
+	return row, nil
+}
+
+/**************************************************************
+	Read newline-delimited JSON, one record per line, into
+	rows of a dataset. Blank lines are skipped, errors report
+	the line number.
+ **************************************************************/
+type ndjsonReader struct {
+	reader  *bufio.Reader
+	dataset *Dataset
+	line    int
+}
+
+// Create a RowReader of the NDJSON in r
+func NewNDJSONReader(r io.Reader, dataset *Dataset) RowReader {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	return &ndjsonReader{reader: reader, dataset: dataset}
+}
+
+func (reader *ndjsonReader) Next() (Row, error) {
+	for {
+		content, err := reader.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, &RowError{Line: reader.line + 1, Err: err}
+		}
+		if len(content) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		reader.line++
+
+		content = bytes.TrimSpace(content)
+		if len(content) == 0 {
+			continue
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		var record map[string]interface{}
+		if err := decoder.Decode(&record); err != nil {
+			return nil, &RowError{Line: reader.line, Err: err, Content: string(content)}
+		}
+		if decoder.More() {
+			return nil, &RowError{Line: reader.line, Err: errors.New("more than one JSON value"), Content: string(content)}
+		}
+		row, err := reader.dataset.NewRow(record)
+		if err != nil {
+			return nil, &RowError{Line: reader.line, Err: err, Content: record}
+		}
+		return row, nil
+	}
+}
+
+/**************************************************************
+	Compute the derived columns of each row read
+ **************************************************************/
+type derivedRowReader struct {
+	rows    RowReader
+	dataset *Dataset
+	env     *ExprEnv
+	index   int
+}
+
+// Create a RowReader computing the derived columns of the dataset on rows
+func NewDerivedRowReader(rows RowReader, dataset *Dataset, env *ExprEnv) RowReader {
+	return &derivedRowReader{rows: rows, dataset: dataset, env: env}
+}
+
+func (reader *derivedRowReader) Next() (Row, error) {
+	row, err := reader.rows.Next()
+	if err != nil {
+		return nil, err
+	}
+	reader.index++
+	if err := reader.dataset.Derive(row, reader.env); err != nil {
+		return nil, AtStage(StageDerive, &RowError{Record: reader.index, Err: err, Content: row})
+	}
+	return row, nil
+}
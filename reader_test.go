@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Rows of reader up to the end or the first error
+func readRows(reader RowReader) ([]Row, error) {
+	rows := []Row{}
+	for {
+		row, err := reader.Next()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		key, content, format string
+	}{
+		{"data/test.json", `[{"a": 1}]`, FormatJSON},
+		{"data/test.json", " \r\n\t[{\"a\": 1}]", FormatJSON},
+		{"data/test.json", `{"a": 1}`, FormatNDJSON},
+		{"data/test.json", "\n\n{\"a\": 1}\n", FormatNDJSON},
+		{"data/test.json", "a,b\n1,2\n", FormatCSV},
+		{"data/test.json", `"a","b"`, FormatCSV},
+		{"data/test.json", "", FormatNDJSON},
+		{"data/test.json", "  \n ", FormatNDJSON},
+		{"data/test.json", strings.Repeat(" ", 300) + "[]", FormatJSON},
+		{"data/test", `{"a": 1}`, FormatNDJSON},
+		// The extension wins over the content
+		{"data/test.jsonl", `[{"a": 1}]`, FormatNDJSON},
+		{"data/test.NDJSON", "", FormatNDJSON},
+		{"data/test.csv", `{"a": 1}`, FormatCSV},
+		{"data/test.tsv", "a,b", FormatTSV},
+		{"data/test.tab", "a\tb", FormatTSV},
+	}
+	for _, test := range tests {
+		format, err := DetectFormat(test.key, bufio.NewReader(strings.NewReader(test.content)))
+		if err != nil || format != test.format {
+			t.Errorf("%v %q: got %v, %v, expected %v", test.key, test.content, format, err, test.format)
+		}
+	}
+
+	// Blanks beyond the buffer of the reader
+	reader := bufio.NewReaderSize(strings.NewReader(strings.Repeat(" ", 100)+"[]"), 16)
+	if format, err := DetectFormat("data/test.json", reader); err == nil {
+		t.Errorf("blanks beyond the buffer: got %v, expected an error", format)
+	}
+}
+
+func TestNDJSONReader(t *testing.T) {
+	dataset := DefaultDataset()
+	tests := []struct {
+		name    string
+		content string
+		rows    int
+		line    int // Line of the error, 0 without error
+		err     string
+	}{
+		{name: "rows", content: "{\"a\": 1}\n{\"a\": 2}\n", rows: 2},
+		{name: "no final newline", content: "{\"a\": 1}\n{\"a\": 2}", rows: 2},
+		{name: "CRLF", content: "{\"a\": 1}\r\n{\"a\": 2}\r\n", rows: 2},
+		{name: "blank lines", content: "\n{\"a\": 1}\n\n  \t\n{\"a\": 2}\n\n", rows: 2},
+		{name: "empty", content: "", rows: 0},
+		{name: "only blank lines", content: "\n \n\r\n", rows: 0},
+		{name: "invalid JSON", content: "{\"a\": 1}\n\n{\"a\": \n", rows: 1, line: 3, err: "line 3: unexpected EOF"},
+		{name: "two values", content: "{\"a\": 1} {\"a\": 2}\n", line: 1, err: "line 1: more than one JSON value"},
+		{name: "invalid value", content: "\n{\"a\": 1}\n{\"a\": \"x\"}\n", rows: 1, line: 3, err: "line 3: column a:"},
+		{name: "array", content: "[{\"a\": 1}]\n", line: 1, err: "line 1: json: cannot unmarshal array"},
+	}
+	for _, test := range tests {
+		rows, err := readRows(NewNDJSONReader(strings.NewReader(test.content), dataset))
+		if len(rows) != test.rows {
+			t.Errorf("%v: %v rows, expected %v", test.name, len(rows), test.rows)
+		}
+		if test.line == 0 {
+			if err != nil {
+				t.Errorf("%v: %v", test.name, err)
+			}
+			continue
+		}
+		var rowErr *RowError
+		if !errors.As(err, &rowErr) || rowErr.Line != test.line || rowErr.Record != 0 || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%v: got %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestNewRowReaderNDJSONCopy(t *testing.T) {
+	dataset := DefaultDataset()
+	read := func(key string) ([]Row, string) {
+		file, err := os.Open(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		reader, format, err := NewRowReader(key, file, dataset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := readRows(reader)
+		if err != nil {
+			t.Fatalf("%v: %v", key, err)
+		}
+		return rows, format
+	}
+
+	jsonRows, jsonFormat := read("test.json")
+	ndjsonRows, ndjsonFormat := read("test.jsonl")
+	if jsonFormat != FormatJSON || ndjsonFormat != FormatNDJSON {
+		t.Errorf("formats %v and %v", jsonFormat, ndjsonFormat)
+	}
+	if len(jsonRows) != 3 || !reflect.DeepEqual(jsonRows, ndjsonRows) {
+		t.Errorf("rows of test.json %v, of test.jsonl %v", jsonRows, ndjsonRows)
+	}
+
+	// Byte order mark, and NDJSON detected from the content
+	reader, format, err := NewRowReader("data/test", strings.NewReader("\xef\xbb\xbf{\"a\": 100, \"b\": 200}\n"), dataset)
+	if err != nil || format != FormatNDJSON {
+		t.Fatalf("format %v, %v", format, err)
+	}
+	if rows, err := readRows(reader); err != nil || !reflect.DeepEqual(rows, jsonRows[:1]) {
+		t.Errorf("rows %v, %v", rows, err)
+	}
+}
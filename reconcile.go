@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+	Define Reconcile Variables
+ **************************************************************/
+
+// Error returned when a reconciliation is already running
+var ErrReconcileRunning = errors.New("reconciliation already running")
+
+// Event name of the records queued by the reconciler
+const reconcileEventName = "ObjectCreated:Reconcile"
+
+// Status of the source files without up to date parquet files
+const (
+	// No parquet file
+	ReconcileMissing = "missing"
+	// Parquet files older than the source file
+	ReconcileStale = "stale"
+	// Parked in error/ since the source file changed, not queued
+	ReconcileParked = "parked"
+)
+
+// Reconciler of the data bucket, set in main when reconcile.interval is set
+var reconciler *Reconciler
+
+// Settings of the reconciler
+type ReconcileConfig struct {
+	// Time between two reconciliations, e.g. "1h", disabled when empty (RECONCILE_INTERVAL)
+	Interval string `json:"interval,omitempty"`
+}
+
+// Source file without up to date parquet files
+type Discrepancy struct {
+	Key          string    `json:"key"`
+	LastModified time.Time `json:"lastModified"`
+	Status       string    `json:"status"`
+	// Newest parquet file of a stale file, expected parquet key (with * for the partitions) of a missing file
+	Output         string     `json:"output,omitempty"`
+	OutputModified *time.Time `json:"outputModified,omitempty"`
+	// Queued for conversion
+	Queued bool `json:"queued"`
+}
+
+// Result of a reconciliation
+type ReconcileReport struct {
+	Bucket        string        `json:"bucket"`
+	StartedAt     time.Time     `json:"startedAt"`
+	FinishedAt    time.Time     `json:"finishedAt"`
+	Files         int           `json:"files"`
+	Queued        int           `json:"queued"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	Error         string        `json:"error,omitempty"`
+}
+
+/**************************************************************
+	Reconciler finds the source files (e.g. data/) whose events
+	were lost: without parquet file, or with parquet files
+	older than the source file, and queues them
+ **************************************************************/
+type Reconciler struct {
+	store   ObjectStore
+	bucket  string
+	enqueue func(records []RecordType) error
+
+	mutex   sync.Mutex
+	running bool
+	last    *ReconcileReport
+	stop    chan struct{}
+}
+
+// Create a Reconciler of bucket in store, queuing records with enqueue
+func NewReconciler(store ObjectStore, bucket string, enqueue func(records []RecordType) error) *Reconciler {
+	return &Reconciler{store: store, bucket: bucket, enqueue: enqueue}
+}
+
+// Reconcile now, then every interval until Stop
+func (reconciler *Reconciler) Start(interval time.Duration) {
+	reconciler.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := reconciler.Run(true); err != nil {
+				Error("Error reconciling s3://%v: %v", reconciler.bucket, err)
+			}
+			select {
+			case <-ticker.C:
+			case <-reconciler.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the reconciliations started by Start
+func (reconciler *Reconciler) Stop() {
+	if reconciler.stop != nil {
+		close(reconciler.stop)
+	}
+}
+
+// Report of the last reconciliation, nil before the first one
+func (reconciler *Reconciler) Last() *ReconcileReport {
+	reconciler.mutex.Lock()
+	defer reconciler.mutex.Unlock()
+	return reconciler.last
+}
+
+/**************************************************************
+	Compare the source files of the routes with their parquet
+	files, queuing the files missing or stale if enqueue.
+	Parquet keys are built with the last modified time of the
+	source files for the date placeholders.
+ **************************************************************/
+func (reconciler *Reconciler) Run(enqueue bool) (*ReconcileReport, error) {
+	reconciler.mutex.Lock()
+	if reconciler.running {
+		reconciler.mutex.Unlock()
+		return nil, ErrReconcileRunning
+	}
+	reconciler.running = true
+	reconciler.mutex.Unlock()
+
+	report := &ReconcileReport{Bucket: reconciler.bucket, StartedAt: time.Now(), Discrepancies: []Discrepancy{}}
+	err := reconciler.reconcile(report, enqueue)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.FinishedAt = time.Now()
+	Info("Reconciled s3://%v: %v files, %v discrepancies, %v queued", report.Bucket, report.Files, len(report.Discrepancies), report.Queued)
+
+	reconciler.mutex.Lock()
+	defer reconciler.mutex.Unlock()
+	reconciler.running = false
+	reconciler.last = report
+	return report, err
+}
+
+// Fill report with the discrepancies of the source files of the routes
+func (reconciler *Reconciler) reconcile(report *ReconcileReport, enqueue bool) error {
+	listing := newFolderListing(reconciler.store, reconciler.bucket)
+
+	// Source folders of the routes, listed once each
+	folders := []string{}
+	for _, route := range config.Routes {
+		folder := route.SourceFolder()
+		if _, err := listing.objects(folder); err != nil {
+			return err
+		}
+		folders = append(folders, folder)
+	}
+
+	seen := map[string]bool{}
+	for _, folder := range folders {
+		objects, _ := listing.objects(folder)
+		for _, object := range objects {
+			if seen[object.Key] {
+				continue
+			}
+			seen[object.Key] = true
+
+			discrepancy, err := reconciler.check(listing, object)
+			if err != nil {
+				return err
+			}
+			if discrepancy == nil {
+				continue
+			}
+
+			// Queue the files one at a time, the rest waits for the next run when the queue is full
+			if enqueue && discrepancy.Status != ReconcileParked && reconciler.enqueue != nil {
+				err := reconciler.enqueue([]RecordType{objectRecord(reconciler.bucket, object, reconcileEventName)})
+				if err == nil {
+					discrepancy.Queued = true
+					report.Queued++
+				} else {
+					Error("Error queuing s3://%v/%v: %v", reconciler.bucket, object.Key, err)
+					enqueue = false
+				}
+			}
+			report.Discrepancies = append(report.Discrepancies, *discrepancy)
+		}
+		report.Files = len(seen)
+	}
+	return nil
+}
+
+/**************************************************************
+	Check the parquet files of the source file object, nil
+	when up to date (or not routed)
+ **************************************************************/
+func (reconciler *Reconciler) check(listing *folderListing, object ObjectInfo) (*Discrepancy, error) {
+	bucket, key := reconciler.bucket, object.Key
+	route, err := config.RouteFor(key)
+	if err != nil {
+		return nil, nil
+	}
+	dataset, err := config.RouteDataset(route, key)
+	if err != nil {
+		return nil, nil
+	}
+
+	prefix, suffix, err := route.OutputPattern(bucket, key, dataset, object.LastModified)
+	if err != nil {
+		return nil, nil
+	}
+	_, errorKey, err := route.Keys(bucket, key, dataset.Name, "", object.LastModified)
+	if err != nil {
+		return nil, nil
+	}
+
+	outputs, err := listing.objects(prefix[:strings.LastIndex(prefix, "/")+1])
+	if err != nil {
+		return nil, err
+	}
+	var newest *ObjectInfo
+	for i := range outputs {
+		if matchOutput(outputs[i].Key, prefix, suffix, len(dataset.Partitions)) && (newest == nil || outputs[i].LastModified.After(newest.LastModified)) {
+			newest = &outputs[i]
+		}
+	}
+	if newest != nil && !newest.LastModified.Before(object.LastModified) {
+		return nil, nil
+	}
+
+	// Processed without parquet file, e.g. no rows in a partitioned dataset
+	if entry, err := ledger.Entry(bucket, key); err == nil && entry != nil && entry.ETag != "" && entry.ETag == object.ETag {
+		return nil, nil
+	}
+
+	output := prefix
+	if len(dataset.Partitions) > 0 {
+		output = prefix + "*" + suffix
+	}
+	discrepancy := &Discrepancy{Key: key, LastModified: object.LastModified, Status: ReconcileMissing, Output: output}
+	if newest != nil {
+		discrepancy.Status, discrepancy.Output, discrepancy.OutputModified = ReconcileStale, newest.Key, &newest.LastModified
+	}
+
+	// Parked since it changed, queuing it would fail again
+	parkedFiles, err := listing.objects(path.Dir(errorKey) + "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, parked := range parkedFiles {
+		if parked.Key == errorKey+failureReportExtension && !parked.LastModified.Before(object.LastModified) {
+			discrepancy.Status = ReconcileParked
+		}
+	}
+	return discrepancy, nil
+}
+
+/**************************************************************
+	Folder of the source keys of the route, its prefix up to
+	the first segment with a pattern, e.g. data/
+ **************************************************************/
+func (route *Route) SourceFolder() string {
+	folder := ""
+	for _, segment := range route.prefix {
+		if strings.ContainsAny(segment, "*?[\\") {
+			break
+		}
+		folder += segment + "/"
+	}
+	return folder
+}
+
+// Objects of a bucket listed once per folder
+type folderListing struct {
+	store   ObjectStore
+	bucket  string
+	folders map[string][]ObjectInfo
+}
+
+func newFolderListing(store ObjectStore, bucket string) *folderListing {
+	return &folderListing{store: store, bucket: bucket, folders: map[string][]ObjectInfo{}}
+}
+
+// Objects with keys starting with folder, listing them the first time
+func (listing *folderListing) objects(folder string) ([]ObjectInfo, error) {
+	if objects, ok := listing.folders[folder]; ok {
+		return objects, nil
+	}
+	objects, err := listing.store.List(listing.bucket, folder)
+	if err != nil {
+		Error("Error listing s3://%v/%v: %v", listing.bucket, folder, err)
+		return nil, err
+	}
+	listing.folders[folder] = objects
+	return objects, nil
+}
+
+/**************************************************************
+	Define /admin/reconcile Handler: GET for the report of the
+	last reconciliation, POST to reconcile now (POST
+	?dryRun=true to only list the discrepancies)
+ **************************************************************/
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	Info(">>>>> reconcileHandler")
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if reconciler == nil {
+		http.Error(w, "Not Found: reconciler disabled, set RECONCILE_INTERVAL and DATA_BUCKET", http.StatusNotFound)
+		return
+	}
+
+	var report *ReconcileReport
+	switch r.Method {
+	case http.MethodGet:
+		if report = reconciler.Last(); report == nil {
+			http.Error(w, "Not Found: no reconciliation yet", http.StatusNotFound)
+			return
+		}
+	case http.MethodPost:
+		var err error
+		report, err = reconciler.Run(r.URL.Query().Get("dryRun") != "true")
+		if errors.Is(err, ErrReconcileRunning) {
+			http.Error(w, "Conflict: "+err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		Error("Error encoding reconcile report: %v", err)
+	}
+}
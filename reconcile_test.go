@@ -0,0 +1,203 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Object of the memory store last modified at lastModified
+type testObject struct {
+	key          string
+	lastModified time.Time
+}
+
+// Store the objects in bucket, with their last modified times
+func putObjects(store *MemoryStore, bucket string, objects []testObject) {
+	for _, object := range objects {
+		store.put(bucket, object.key, []byte("[]"))
+		store.buckets[bucket][object.key].info.LastModified = object.lastModified
+	}
+}
+
+func TestReconcilerCheck(t *testing.T) {
+	withConfig(t)
+	withLedger(t, NewMemoryStore())
+	t0 := time.Date(2020, 4, 6, 21, 0, 0, 0, time.UTC)
+	t1, t2 := t0.Add(time.Hour), t0.Add(2*time.Hour)
+
+	tests := []struct {
+		name        string
+		partitioned bool
+		objects     []testObject
+		processed   bool // Ledger entry of data/test.json
+		status      string
+		output      string
+	}{
+		{
+			name:    "up to date",
+			objects: []testObject{{"data/test.json", t0}, {"processed/test.json.parquet", t1}},
+		},
+		{
+			name:    "parquet file of the same time",
+			objects: []testObject{{"data/test.json", t0}, {"processed/test.json.parquet", t0}},
+		},
+		{
+			name:    "missing",
+			objects: []testObject{{"data/test.json", t0}, {"processed/other.json.parquet", t1}},
+			status:  ReconcileMissing,
+			output:  "processed/test.json.parquet",
+		},
+		{
+			name:      "missing, processed without parquet file",
+			objects:   []testObject{{"data/test.json", t0}},
+			processed: true,
+		},
+		{
+			name:    "stale",
+			objects: []testObject{{"data/test.json", t1}, {"processed/test.json.parquet", t0}},
+			status:  ReconcileStale,
+			output:  "processed/test.json.parquet",
+		},
+		{
+			name: "parked since the change",
+			objects: []testObject{
+				{"data/test.json", t1}, {"processed/test.json.parquet", t0},
+				{"error/test.json", t2}, {"error/test.json.error.json", t2},
+			},
+			status: ReconcileParked,
+			output: "processed/test.json.parquet",
+		},
+		{
+			name: "parked before the change",
+			objects: []testObject{
+				{"data/test.json", t1},
+				{"error/test.json", t0}, {"error/test.json.error.json", t0},
+			},
+			status: ReconcileMissing,
+			output: "processed/test.json.parquet",
+		},
+		{
+			name:        "partitions up to date",
+			partitioned: true,
+			objects: []testObject{
+				{"data/test.json", t0},
+				{"processed/dt=2020-04-05/test.json.parquet", t1}, {"processed/dt=2020-04-06/test.json.parquet", t1},
+			},
+		},
+		{
+			name:        "partitions missing",
+			partitioned: true,
+			objects: []testObject{
+				{"data/test.json", t0},
+				{"processed/test.json.parquet", t1}, {"processed/dt=2020-04-06/other.json.parquet", t1},
+			},
+			status: ReconcileMissing,
+			output: "processed/*/test.json.parquet",
+		},
+		{
+			name:        "partitions stale",
+			partitioned: true,
+			objects: []testObject{
+				{"data/test.json", t2},
+				{"processed/dt=2020-04-05/test.json.parquet", t0}, {"processed/dt=2020-04-06/test.json.parquet", t1},
+			},
+			status: ReconcileStale,
+			output: "processed/dt=2020-04-06/test.json.parquet",
+		},
+	}
+	for _, test := range tests {
+		config = DefaultConfig()
+		if test.partitioned {
+			dataset := DefaultDataset()
+			dataset.Partitions = []Partition{{Name: "dt", Format: "date"}}
+			if err := dataset.Compile(); err != nil {
+				t.Fatal(err)
+			}
+			config.Datasets = []*Dataset{dataset}
+		}
+		ledger = NewLedger(NewMarkerLedgerStore(NewMemoryStore(), "", "ledger/"))
+		store := NewMemoryStore()
+		putObjects(store, "deglon", test.objects)
+		source, err := store.Head("deglon", "data/test.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.processed {
+			record := objectRecord("deglon", *source, reconcileEventName)
+			ledger.Begin(record)
+			ledger.Done(record, LedgerProcessed, nil)
+		}
+
+		reconciler := NewReconciler(store, "deglon", nil)
+		discrepancy, err := reconciler.check(newFolderListing(store, "deglon"), *source)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if test.status == "" {
+			if discrepancy != nil {
+				t.Errorf("%v: got %+v, expected no discrepancy", test.name, discrepancy)
+			}
+			continue
+		}
+		if discrepancy == nil || discrepancy.Status != test.status || discrepancy.Output != test.output {
+			t.Errorf("%v: got %+v, expected %v %v", test.name, discrepancy, test.status, test.output)
+		}
+	}
+}
+
+func TestReconcileQueue(t *testing.T) {
+	withConfig(t)
+	withLedger(t, NewMemoryStore())
+	t0 := time.Date(2020, 4, 6, 21, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+
+	store := NewMemoryStore()
+	putObjects(store, "deglon", []testObject{
+		{"data/a.json", t0}, {"processed/a.json.parquet", t1},
+		{"data/b.json", t0},
+		{"data/c.json", t1}, {"processed/c.json.parquet", t0},
+		{"data/d.json", t0}, {"error/d.json", t1}, {"error/d.json.error.json", t1},
+		{"other/e.json", t0},
+	})
+	queued := []string{}
+	reconciler := NewReconciler(store, "deglon", func(records []RecordType) error {
+		queued = append(queued, records[0].S3.Object.Key)
+		return nil
+	})
+
+	// Dry run, then queuing the missing and stale files but not the parked one
+	report, err := reconciler.Run(false)
+	if err != nil || report.Files != 4 || len(report.Discrepancies) != 3 || report.Queued != 0 || len(queued) != 0 {
+		t.Fatalf("dry run: %+v, %v", report, err)
+	}
+	report, err = reconciler.Run(true)
+	if err != nil || report.Queued != 2 || strings.Join(queued, ",") != "data/b.json,data/c.json" || reconciler.Last() != report {
+		t.Errorf("run: %+v, %v, queued %v", report, err, queued)
+	}
+}
+
+func TestMatchOutput(t *testing.T) {
+	tests := []struct {
+		key, prefix, suffix string
+		partitions          int
+		match               bool
+	}{
+		{"processed/test.parquet", "processed/test.parquet", "", 0, true},
+		{"processed/a/test.parquet", "processed/test.parquet", "", 0, false},
+		{"processed/dt=2020-04-06/test.parquet", "processed/", "/test.parquet", 1, true},
+		{"processed/dt=2020-04-06/hour=21/test.parquet", "processed/", "/test.parquet", 2, true},
+		{"processed/dt=2020-04-06/test.parquet", "processed/", "/test.parquet", 2, false},
+		{"processed/dt=2020-04-06/hour=21/test.parquet", "processed/", "/test.parquet", 1, false},
+		{"processed/dt=2020-04-06/other.parquet", "processed/", "/test.parquet", 1, false},
+		{"processed//test.parquet", "processed/", "/test.parquet", 1, false},
+		{"processed/test.parquet", "processed/", "/test.parquet", 1, false},
+		{"processed/dt=2020-04-06/2020/test.parquet", "processed/", "/2020/test.parquet", 1, true},
+	}
+	for _, test := range tests {
+		if match := matchOutput(test.key, test.prefix, test.suffix, test.partitions); match != test.match {
+			t.Errorf("%v (%v %v, %v partitions): got %v", test.key, test.prefix, test.suffix, test.partitions, match)
+		}
+	}
+}
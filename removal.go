@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**************************************************************
+	Define Removal Variables
+ **************************************************************/
+
+// Policies of the parquet files of removed objects
+const (
+	// Keep the parquet files
+	RemovalIgnore = "ignore"
+	// Delete the parquet files
+	RemovalDelete = "delete"
+	// Move the parquet files under the archive prefix
+	RemovalArchive = "archive"
+	// Keep the parquet files, and write a tombstone manifest listing them
+	RemovalTombstone = "tombstone"
+)
+
+// Ledger status of each policy
+var removalStatuses = map[string]string{
+	RemovalIgnore:    LedgerIgnored,
+	RemovalDelete:    LedgerDeleted,
+	RemovalArchive:   LedgerArchived,
+	RemovalTombstone: LedgerTombstoned,
+}
+
+// Settings of the removed objects
+type RemovalConfig struct {
+	// Policy of each event removing objects, e.g. {"ObjectRemoved:DeleteMarkerCreated": "tombstone"}, "*" for the others (REMOVAL_POLICY)
+	Policies map[string]string `json:"policies,omitempty"`
+	// Prefix of the archived parquet files (ARCHIVE_PREFIX)
+	Archive string `json:"archive,omitempty"`
+	// Prefix of the tombstone manifests (TOMBSTONE_PREFIX)
+	Tombstone string `json:"tombstone,omitempty"`
+}
+
+// Tombstone manifest of a removed object, listing its parquet files
+type Tombstone struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	EventName string    `json:"eventName"`
+	EventTime time.Time `json:"eventTime"`
+	Sequencer string    `json:"sequencer,omitempty"`
+	Outputs   []string  `json:"outputs"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Is eventName an event removing an object, e.g. ObjectRemoved:Delete or LifecycleExpiration:DeleteMarkerCreated
+func IsRemoval(eventName string) bool {
+	return strings.HasPrefix(eventName, "ObjectRemoved:") || strings.HasPrefix(eventName, "LifecycleExpiration:")
+}
+
+// Check the policies and prefixes
+func (removal *RemovalConfig) Validate() error {
+	for event, policy := range removal.Policies {
+		if _, ok := removalStatuses[policy]; !ok {
+			return fmt.Errorf("removal.policies %v: unknown policy %q, expected ignore, delete, archive or tombstone", event, policy)
+		}
+		if event != "*" && !IsRemoval(event) {
+			return fmt.Errorf("removal.policies %v: not an ObjectRemoved or LifecycleExpiration event", event)
+		}
+	}
+	if strings.Trim(removal.Archive, "/") == "" {
+		return fmt.Errorf("removal.archive is required")
+	}
+	if strings.Trim(removal.Tombstone, "/") == "" {
+		return fmt.Errorf("removal.tombstone is required")
+	}
+	return nil
+}
+
+// Policy of eventName, the "*" policy or ignore when it has none
+func (removal *RemovalConfig) Policy(eventName string) string {
+	if policy, ok := removal.Policies[eventName]; ok {
+		return policy
+	}
+	if policy, ok := removal.Policies["*"]; ok {
+		return policy
+	}
+	return RemovalIgnore
+}
+
+/**************************************************************
+	Apply the removal policy of the event record to the parquet
+	files of the removed object, returning the status for the
+	ledger and the parquet files. The parquet files are those
+	recorded in the ledger, or else the keys of the route.
+ **************************************************************/
+func removeWork(store ObjectStore, record RecordType) (string, []string, error) {
+	bucket, item := record.S3.Bucket.Name, record.S3.Object.Key
+	policy := config.Removal.Policy(record.EventName)
+	if policy == RemovalIgnore {
+		Info("Ignoring %v of s3://%v/%v", record.EventName, bucket, item)
+		return LedgerIgnored, nil, nil
+	}
+
+	outputs, err := removedOutputs(store, record)
+	if err != nil {
+		return "", nil, err
+	}
+	Debug("Parquet files of s3://%v/%v: %v", bucket, item, outputs)
+
+	switch policy {
+	case RemovalDelete:
+		for _, output := range outputs {
+			if err := store.Delete(bucket, output); err != nil {
+				Error("Error deleting s3://%v/%v: %v", bucket, output, err)
+				return "", nil, err
+			}
+		}
+	case RemovalArchive:
+		for _, output := range outputs {
+			archive := strings.TrimSuffix(config.Removal.Archive, "/") + "/" + output
+			if err := store.Copy(bucket, output, bucket, archive); err != nil && !errors.Is(err, ErrObjectNotFound) {
+				Error("Error archiving s3://%v/%v to s3://%v/%v: %v", bucket, output, bucket, archive, err)
+				return "", nil, err
+			}
+			if err := store.Delete(bucket, output); err != nil {
+				Error("Error deleting s3://%v/%v: %v", bucket, output, err)
+				return "", nil, err
+			}
+		}
+	case RemovalTombstone:
+		content, err := json.MarshalIndent(&Tombstone{
+			Bucket:    bucket,
+			Key:       item,
+			EventName: record.EventName,
+			EventTime: record.EventTime,
+			Sequencer: record.S3.Object.Sequencer,
+			Outputs:   outputs,
+			CreatedAt: time.Now(),
+		}, "", "  ")
+		if err != nil {
+			return "", nil, err
+		}
+		tombstone := strings.TrimSuffix(config.Removal.Tombstone, "/") + "/" + item + ".json"
+		if err := store.Put(bucket, tombstone, bytes.NewReader(content)); err != nil {
+			Error("Error writing tombstone s3://%v/%v: %v", bucket, tombstone, err)
+			return "", nil, err
+		}
+	}
+
+	Info("%v of s3://%v/%v: %v parquet file(s) %v", record.EventName, bucket, item, len(outputs), removalStatuses[policy])
+	return removalStatuses[policy], outputs, nil
+}
+
+// Parquet files of the removed object of record, from the ledger or else from its route
+func removedOutputs(store ObjectStore, record RecordType) ([]string, error) {
+	bucket, item := record.S3.Bucket.Name, record.S3.Object.Key
+	entry, err := ledger.Entry(bucket, item)
+	if err != nil {
+		Error("Error reading ledger of s3://%v/%v: %v", bucket, item, err)
+		return nil, err
+	}
+	if entry != nil && entry.Status == LedgerProcessed && len(entry.Outputs) > 0 {
+		return entry.Outputs, nil
+	}
+
+	// Without ledger, list the parquet files of the route (date placeholders from the time of the event)
+	route, err := config.RouteFor(item)
+	if err != nil {
+		return nil, nil
+	}
+	dataset, err := config.RouteDataset(route, item)
+	if err != nil {
+		return nil, nil
+	}
+	prefix, suffix, err := route.OutputPattern(bucket, item, dataset, record.EventTime)
+	if err != nil {
+		return nil, nil
+	}
+	objects, err := store.List(bucket, prefix[:strings.LastIndex(prefix, "/")+1])
+	if err != nil {
+		Error("Error listing s3://%v/%v: %v", bucket, prefix, err)
+		return nil, err
+	}
+	outputs := []string{}
+	for _, object := range objects {
+		if matchOutput(object.Key, prefix, suffix, len(dataset.Partitions)) {
+			outputs = append(outputs, object.Key)
+		}
+	}
+	return outputs, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+	Define Reprocess Variables
+ **************************************************************/
+
+// Event name of the records replayed by Reprocess
+const reprocessEventName = "ObjectCreated:Reprocess"
+
+// Status of the files of a reprocess
+const (
+	ReprocessDryRun    = "dry-run"
+	ReprocessProcessed = "processed"
+	ReprocessSkipped   = "skipped"
+	ReprocessFailed    = "failed"
+)
+
+// Options of a reprocess
+type ReprocessOptions struct {
+	Bucket string `json:"bucket"`
+	// Prefix of the keys to reprocess, e.g. error/ or data/2020/
+	Prefix string `json:"prefix"`
+	// List the files without processing them
+	DryRun bool `json:"dryRun,omitempty"`
+	// Files processed at the same time
+	Concurrency int `json:"concurrency"`
+	// Only the files last modified in [Since, Until), when set
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+	// Delete the parked copy and its report in error/ once processed
+	DeleteParked bool `json:"deleteParked,omitempty"`
+}
+
+// File of a reprocess
+type ReprocessFile struct {
+	// Key listed, the source key or its parked copy
+	Key string `json:"key"`
+	// Source key processed
+	Source string `json:"source"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Result of a reprocess
+type ReprocessReport struct {
+	Options   ReprocessOptions `json:"options"`
+	Processed int              `json:"processed"`
+	Skipped   int              `json:"skipped"`
+	Failed    int              `json:"failed"`
+	Files     []ReprocessFile  `json:"files"`
+}
+
+/**************************************************************
+	Reprocess the files under options.Prefix, once a bug is
+	fixed: source files (e.g. data/) are processed again, even
+	if the ledger has them, and parked copies (e.g. error/) are
+	replaced by the source file of their failure report, or
+	without report, of the error template of their route.
+	Files failing again are parked again.
+ **************************************************************/
+func Reprocess(store ObjectStore, options ReprocessOptions) (*ReprocessReport, error) {
+	if options.Concurrency < 1 {
+		options.Concurrency = 1
+	}
+	objects, err := store.List(options.Bucket, options.Prefix)
+	if err != nil {
+		Error("Error listing s3://%v/%v: %v", options.Bucket, options.Prefix, err)
+		return nil, err
+	}
+
+	// Failure reports of the parked copies
+	reports := map[string]bool{}
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, failureReportExtension) {
+			reports[object.Key] = true
+		}
+	}
+
+	report := &ReprocessReport{Options: options, Files: []ReprocessFile{}}
+	records := map[int]RecordType{} // Record of each file to process
+	for _, object := range objects {
+		if reports[object.Key] {
+			continue
+		}
+		if !options.Since.IsZero() && object.LastModified.Before(options.Since) {
+			continue
+		}
+		if !options.Until.IsZero() && !object.LastModified.Before(options.Until) {
+			continue
+		}
+
+		file := ReprocessFile{Key: object.Key, Source: object.Key, Status: ReprocessDryRun}
+		record := objectRecord(options.Bucket, object, reprocessEventName)
+		if reports[object.Key+failureReportExtension] {
+			failure, err := readFailureReport(store, options.Bucket, object.Key)
+			if err != nil {
+				file.Status, file.Error = ReprocessFailed, err.Error()
+				report.Files = append(report.Files, file)
+				report.Failed++
+				continue
+			}
+			record = failure.SourceRecord()
+			file.Source = failure.Key
+		} else if _, _, err := config.RouteOf(object.Key); err != nil {
+			// Parked copies without report, e.g. when writing the report failed, map back to
+			// their source through the error template of the route
+			if source, err := config.SourceOfError(options.Bucket, object.Key); err == nil {
+				record.S3.Object.Key = source
+				record.S3.Object.ETag, record.S3.Object.Size = "", 0
+				file.Source = source
+			}
+		}
+		// Files without route (e.g. processed/) aren't converted
+		if _, _, err := config.RouteOf(file.Source); err != nil {
+			file.Status, file.Error = ReprocessSkipped, err.Error()
+			report.Files = append(report.Files, file)
+			report.Skipped++
+			continue
+		}
+		records[len(report.Files)] = record
+		report.Files = append(report.Files, file)
+	}
+	if options.DryRun {
+		Info("Reprocess of s3://%v/%v: %v files (dry run)", options.Bucket, options.Prefix, len(records))
+		return report, nil
+	}
+
+	// Process the files, options.Concurrency at a time
+	var wait sync.WaitGroup
+	var mutex sync.Mutex
+	slots := make(chan struct{}, options.Concurrency)
+	for i := range report.Files {
+		file := &report.Files[i]
+		record, ok := records[i]
+		if !ok {
+			continue
+		}
+
+		wait.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wait.Done()
+			defer func() { <-slots }()
+			err := replay(store, record, file.Key, options.DeleteParked)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if errors.Is(err, ErrNoRoute) {
+				file.Status, file.Error = ReprocessSkipped, err.Error()
+				report.Skipped++
+				return
+			}
+			if err != nil {
+				file.Status, file.Error = ReprocessFailed, err.Error()
+				report.Failed++
+				return
+			}
+			file.Status = ReprocessProcessed
+			report.Processed++
+		}()
+	}
+	wait.Wait()
+
+	Info("Reprocess of s3://%v/%v: %v files processed, %v skipped, %v failed", options.Bucket, options.Prefix, report.Processed, report.Skipped, report.Failed)
+	return report, nil
+}
+
+// Record of an event eventName for the source file object
+func objectRecord(bucket string, object ObjectInfo, eventName string) RecordType {
+	var record RecordType
+	record.EventName = eventName
+	record.EventTime = object.LastModified
+	record.S3.Bucket.Name = bucket
+	record.S3.Object.Key = object.Key
+	record.S3.Object.ETag = object.ETag
+	record.S3.Object.Size = object.Size
+	return record
+}
+
+// Failure report of the parked copy bucket/key
+func readFailureReport(store ObjectStore, bucket, key string) (*FailureReport, error) {
+	content, err := store.Get(bucket, key+failureReportExtension)
+	if err != nil {
+		return nil, err
+	}
+	var failure FailureReport
+	if err := json.Unmarshal(content, &failure); err != nil {
+		return nil, fmt.Errorf("failure report %v%v: %v", key, failureReportExtension, err)
+	}
+	if failure.Key == "" {
+		return nil, fmt.Errorf("failure report %v%v: no key", key, failureReportExtension)
+	}
+	return &failure, nil
+}
+
+// Record of the event of the source file of the report
+func (failure *FailureReport) SourceRecord() RecordType {
+	var record RecordType
+	record.EventName = reprocessEventName
+	record.EventTime = failure.EventTime
+	record.S3.Bucket.Name = failure.Bucket
+	record.S3.Object.Key = failure.Key
+	record.S3.Object.ETag = failure.ETag
+	record.S3.Object.Sequencer = failure.Sequencer
+	return record
+}
+
+/**************************************************************
+	Process the source file of record again, whatever the
+	ledger has, parking it on failure, ErrNoRoute for files
+	without route. Once processed, the
+	parked copy listed (when not the source file) is deleted
+	with its report if deleteParked.
+ **************************************************************/
+func replay(store ObjectStore, record RecordType, listed string, deleteParked bool) error {
+	bucket, item := record.S3.Bucket.Name, record.S3.Object.Key
+
+	// Files without route are skipped, without ledger entry
+	if _, _, err := config.RouteOf(item); err != nil {
+		Info("Skipping file s3://%v/%v: %v", bucket, item, err)
+		return err
+	}
+
+	ledger.Acquire(record)
+	outputs, err := doWork(store, record)
+	if err != nil {
+		ledger.Done(record, "", nil)
+		Error("Error reprocessing file s3://%v/%v: %v", bucket, item, err)
+		// Keep the report of a parked copy whose source file was deleted
+		if errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+		if err := Park(store, record, []Attempt{NewAttempt(err)}); err != nil {
+			Error("Error parking s3://%v/%v: %v", bucket, item, err)
+		}
+		return err
+	}
+	ledger.Done(record, LedgerProcessed, outputs)
+
+	if deleteParked && listed != item {
+		for _, key := range []string{listed, listed + failureReportExtension} {
+			if err := store.Delete(bucket, key); err != nil {
+				Error("Error deleting parked file s3://%v/%v: %v", bucket, key, err)
+				return err
+			}
+		}
+		Info("Parked file s3://%v/%v deleted", bucket, listed)
+	}
+	return nil
+}
+
+/**************************************************************
+	Parse the options of a reprocess, from the query of
+	/admin/reprocess or the flags of the reprocess command
+ **************************************************************/
+func ParseReprocessOptions(bucket, prefix, since, until string, concurrency int, dryRun, deleteParked bool) (ReprocessOptions, error) {
+	options := ReprocessOptions{
+		Bucket:       bucket,
+		Prefix:       prefix,
+		DryRun:       dryRun,
+		Concurrency:  concurrency,
+		DeleteParked: deleteParked,
+	}
+	if bucket == "" {
+		return options, fmt.Errorf("bucket required")
+	}
+	if prefix == "" {
+		return options, fmt.Errorf("prefix required, e.g. error/ or data/")
+	}
+	if concurrency < 1 {
+		return options, fmt.Errorf("concurrency %v is below 1", concurrency)
+	}
+	var err error
+	if options.Since, err = parseOptionalTime("since", since); err != nil {
+		return options, err
+	}
+	if options.Until, err = parseOptionalTime("until", until); err != nil {
+		return options, err
+	}
+	return options, nil
+}
+
+// Parse the RFC3339 time value of the option name, zero when empty
+func parseOptionalTime(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("%v %q is not a RFC3339 time, e.g. 2020-04-06T21:05:45Z", name, value)
+	}
+	return t, nil
+}
+
+/**************************************************************
+	Define /admin/reprocess Handler, e.g. POST
+	/admin/reprocess?prefix=error/&dryRun=true
+ **************************************************************/
+func reprocessHandler(w http.ResponseWriter, r *http.Request) {
+	Info(">>>>> reprocessHandler")
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	bucket := query.Get("bucket")
+	if bucket == "" {
+		bucket = config.Catalog.Bucket
+	}
+	concurrency := config.Workers
+	if value := query.Get("concurrency"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Bad Request: concurrency "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		concurrency = n
+	}
+	options, err := ParseReprocessOptions(bucket, query.Get("prefix"), query.Get("since"), query.Get("until"),
+		concurrency, query.Get("dryRun") == "true", query.Get("deleteParked") == "true")
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := Reprocess(objectStore, options)
+	if err != nil {
+		http.Error(w, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		Error("Error encoding reprocess report: %v", err)
+	}
+}
+
+// Check the admin token of r, responding 403 (or 404 when no token is set) otherwise
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if config.AdminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		Error("Rejecting admin request %v from %v", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
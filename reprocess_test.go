@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReprocessSkipsUnrouted(t *testing.T) {
+	withConfig(t)
+	config.Ledger = "s3"
+	store := NewMemoryStore()
+	withLedger(t, store)
+
+	store.Put("deglon", "data/test.json", strings.NewReader(`[{"a": 100, "b": 200}]`))
+	store.Put("deglon", "processed/old.parquet", strings.NewReader("PAR1"))
+
+	report, err := Reprocess(store, ReprocessOptions{Bucket: "deglon", Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Processed != 1 || report.Skipped != 1 || report.Failed != 0 {
+		t.Errorf("processed %v, skipped %v, failed %v", report.Processed, report.Skipped, report.Failed)
+	}
+	statuses := map[string]string{}
+	for _, file := range report.Files {
+		statuses[file.Key] = file.Status
+	}
+	if statuses["data/test.json"] != ReprocessProcessed || statuses["processed/old.parquet"] != ReprocessSkipped {
+		t.Errorf("statuses %v", statuses)
+	}
+
+	// Only the converted file is in the ledger, nothing is parked
+	expected := []string{"data/test.json", "ledger/data/test.json.json", "processed/old.parquet", "processed/test.json.parquet"}
+	if keys := bucketKeys(t, store, "deglon"); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("keys %v, expected %v", keys, expected)
+	}
+}
+
+func TestReprocessParkedWithoutReport(t *testing.T) {
+	withConfig(t)
+	config.Ledger = "s3"
+	store := NewMemoryStore()
+	withLedger(t, store)
+
+	// Parked copies whose report couldn't be written, one of them with its source deleted since
+	store.Put("deglon", "data/a/test.json", strings.NewReader(`[{"a": 100, "b": 200}]`))
+	store.Put("deglon", "error/a/test.json", strings.NewReader(`[{"a": 1, "b": 2}]`))
+	store.Put("deglon", "error/deleted.json", strings.NewReader(`[{"a": 1, "b": 2}]`))
+
+	options := ReprocessOptions{Bucket: "deglon", Prefix: "error/", Concurrency: 1, DryRun: true}
+	report, err := Reprocess(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := map[string]string{}
+	for _, file := range report.Files {
+		sources[file.Key] = file.Source + " " + file.Status
+	}
+	if sources["error/a/test.json"] != "data/a/test.json dry-run" || sources["error/deleted.json"] != "data/deleted.json dry-run" {
+		t.Errorf("files %v", sources)
+	}
+
+	options.DryRun, options.DeleteParked = false, true
+	if report, err = Reprocess(store, options); err != nil {
+		t.Fatal(err)
+	}
+	if report.Processed != 1 || report.Skipped != 0 || report.Failed != 1 {
+		t.Errorf("processed %v, skipped %v, failed %v", report.Processed, report.Skipped, report.Failed)
+	}
+
+	// The source file is processed, and its parked copy deleted, the copy of the deleted file stays
+	expected := []string{"data/a/test.json", "error/deleted.json", "ledger/data/a/test.json.json", "processed/a/test.json.parquet"}
+	if keys := bucketKeys(t, store, "deglon"); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("keys %v, expected %v", keys, expected)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/**************************************************************
+	PermanentError is an error which retrying won't fix, e.g.
+	invalid content or a key without route
+ **************************************************************/
+type PermanentError struct {
+	Err error
+}
+
+func (err *PermanentError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *PermanentError) Unwrap() error {
+	return err.Err
+}
+
+// Mark err as permanent, nil stays nil
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// Is err permanent, a PermanentError or a missing object
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent) || errors.Is(err, ErrObjectNotFound)
+}
+
+/**************************************************************
+	RetryPolicy gives the delays between the attempts to
+	process a record: exponential backoff with jitter, up to
+	MaxAttempts attempts
+ **************************************************************/
+type RetryPolicy struct {
+	// Attempts before the object is parked in error/ (RETRY_MAX_ATTEMPTS)
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// Delay before the second attempt, doubled for each attempt, e.g. "2s" (RETRY_BASE_DELAY)
+	BaseDelay string `json:"baseDelay,omitempty"`
+	// Longest delay between attempts, e.g. "5m" (RETRY_MAX_DELAY)
+	MaxDelay string `json:"maxDelay,omitempty"`
+
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+// Check the policy and parse its delays
+func (policy *RetryPolicy) Compile() error {
+	if policy.MaxAttempts < 1 {
+		return fmt.Errorf("retry.maxAttempts %v is below 1", policy.MaxAttempts)
+	}
+	var err error
+	if policy.baseDelay, err = time.ParseDuration(policy.BaseDelay); err != nil || policy.baseDelay <= 0 {
+		return fmt.Errorf("retry.baseDelay %q is not a duration, e.g. 2s", policy.BaseDelay)
+	}
+	if policy.maxDelay, err = time.ParseDuration(policy.MaxDelay); err != nil || policy.maxDelay < policy.baseDelay {
+		return fmt.Errorf("retry.maxDelay %q is not a duration above retry.baseDelay", policy.MaxDelay)
+	}
+	return nil
+}
+
+/**************************************************************
+	Delay before the next attempt after attempts failed ones:
+	baseDelay * 2^(attempts-1), at most maxDelay, of which a
+	random half is removed so retries of records failing
+	together spread out
+ **************************************************************/
+func (policy *RetryPolicy) Delay(attempts int) time.Duration {
+	delay := policy.baseDelay
+	for i := 1; i < attempts && delay < policy.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.maxDelay {
+		delay = policy.maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
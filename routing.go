@@ -0,0 +1,500 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+/**************************************************************
+	Define Routing Variables
+ **************************************************************/
+
+// Error returned when no route matches a key
+var ErrNoRoute = errors.New("no route for key")
+
+// Placeholders of the key templates
+var routePlaceholders = map[string]bool{
+	"bucket":    true, // Bucket of the source key
+	"key":       true, // Source key
+	"dirname":   true, // Folder of the source key after the route prefix, e.g. "a/b" for data/a/b/x.json
+	"basename":  true, // File name without extensions, e.g. "x" for x.json.gz
+	"filename":  true, // File name, e.g. "x.json.gz"
+	"ext":       true, // Extensions of the file name, e.g. ".json.gz"
+	"dataset":   true, // Name of the dataset
+	"partition": true, // Hive-style partition folders of the dataset, e.g. "dt=2020-04-06/hour=21"
+	"yyyy":      true, // Year of the event time (UTC)
+	"mm":        true, // Month of the event time
+	"dd":        true, // Day of the event time
+	"hh":        true, // Hour of the event time
+}
+
+/**************************************************************
+	Route maps source keys, matched on their prefix and suffix,
+	to the keys of the parquet file and of the error parking
+	lot, built from templates like
+	"processed/{dataset}/{yyyy}/{mm}/{dd}/{basename}.parquet"
+ **************************************************************/
+type Route struct {
+	// Folder of the source keys, matched segment by segment, "*" matches any one segment
+	Prefix string `json:"prefix"`
+	// End of the file name, e.g. ".csv" or ".json.gz" (ignoring case), empty for any file
+	Suffix string `json:"suffix,omitempty"`
+	// Dataset of the files, by default the dataset with the longest matching prefix
+	Dataset string `json:"dataset,omitempty"`
+	// Template of the parquet key
+	Output string `json:"output"`
+	// Template of the key where failed files are copied
+	Error string `json:"error"`
+	// Template of the NDJSON key of the rows rejected, by default rejected/{dirname}/{filename}.ndjson
+	Rejected string `json:"rejected,omitempty"`
+
+	prefix   []string
+	output   []templatePart
+	error    []templatePart
+	rejected []templatePart
+}
+
+// Template of the key of the rows rejected, when the route has none
+const defaultRejectedTemplate = "rejected/{dirname}/{filename}.ndjson"
+
+// Literal text or placeholder of a key template
+type templatePart struct {
+	text        string
+	placeholder bool
+}
+
+/**************************************************************
+	Default route, data/... to processed/... and error/...
+ **************************************************************/
+func DefaultRoutes() []*Route {
+	routes := []*Route{
+		{
+			Prefix: "data/",
+			Output: "processed/{partition}/{dirname}/{filename}.parquet",
+			Error:  "error/{dirname}/{filename}",
+		},
+	}
+	for _, route := range routes {
+		if err := route.Compile(); err != nil {
+			panic(err)
+		}
+	}
+	return routes
+}
+
+/**************************************************************
+	Check the route and parse its prefix and templates
+ **************************************************************/
+func (route *Route) Compile() error {
+	var err error
+	if route.prefix, err = compilePrefix(route.Prefix); err != nil {
+		return fmt.Errorf("route %q: %v", route.Prefix, err)
+	}
+	if strings.Contains(route.Suffix, "/") {
+		return fmt.Errorf("route %q: suffix %q contains /", route.Prefix, route.Suffix)
+	}
+
+	if route.output, err = parseKeyTemplate(route.Output); err != nil {
+		return fmt.Errorf("route %q: output: %v", route.Prefix, err)
+	}
+	if route.error, err = parseKeyTemplate(route.Error); err != nil {
+		return fmt.Errorf("route %q: error: %v", route.Prefix, err)
+	}
+	rejected := route.Rejected
+	if rejected == "" {
+		rejected = defaultRejectedTemplate
+	}
+	if route.rejected, err = parseKeyTemplate(rejected); err != nil {
+		return fmt.Errorf("route %q: rejected: %v", route.Prefix, err)
+	}
+	return nil
+}
+
+// Split a prefix into the patterns of its folders, e.g. ["data", "*"] for data/*/
+func compilePrefix(prefix string) ([]string, error) {
+	segments := []string{}
+	for _, segment := range strings.Split(strings.Trim(prefix, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		if segment == "." || segment == ".." {
+			return nil, fmt.Errorf("invalid prefix segment %q", segment)
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid prefix segment %q: %v", segment, err)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// Do the first folders of key match the patterns of prefix
+func matchPrefix(prefix []string, key string) bool {
+	folders := strings.Split(key, "/")
+	folders = folders[:len(folders)-1]
+	if len(folders) < len(prefix) {
+		return false
+	}
+	for i, pattern := range prefix {
+		if matched, _ := path.Match(pattern, folders[i]); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse a key template into literal texts and placeholders
+func parseKeyTemplate(template string) ([]templatePart, error) {
+	if template == "" {
+		return nil, fmt.Errorf("empty template")
+	}
+	if strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("template %q starts with /", template)
+	}
+
+	parts := []templatePart{}
+	for rest := template; rest != ""; {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			parts = append(parts, templatePart{text: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("template %q: unexpected }", template)
+		}
+		if open > 0 {
+			parts = append(parts, templatePart{text: rest[:open]})
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("template %q: unterminated {", template)
+		}
+		name := rest[open+1 : open+1+end]
+		if !routePlaceholders[name] {
+			return nil, fmt.Errorf("template %q: unknown placeholder {%v}", template, name)
+		}
+		parts = append(parts, templatePart{text: name, placeholder: true})
+		rest = rest[open+1+end+1:]
+	}
+	return parts, nil
+}
+
+/**************************************************************
+	Does the route match key, returning the folder of key
+	after the prefix (e.g. "a/b" for data/a/b/x.json)
+ **************************************************************/
+func (route *Route) Match(key string) (string, bool) {
+	segments := strings.Split(key, "/")
+	folders, filename := segments[:len(segments)-1], segments[len(segments)-1]
+	if filename == "" || !matchPrefix(route.prefix, key) {
+		return "", false
+	}
+	if !strings.HasSuffix(strings.ToLower(filename), strings.ToLower(route.Suffix)) {
+		return "", false
+	}
+	return strings.Join(folders[len(route.prefix):], "/"), true
+}
+
+/**************************************************************
+	Build the parquet and error keys of the source key, with
+	the date parts of eventTime (now when unknown). Without
+	{partition} in the output template, the partition folders
+	are added before the file name.
+ **************************************************************/
+func (route *Route) Keys(bucket, key, dataset, partition string, eventTime time.Time) (string, string, error) {
+	values, err := route.keyValues(bucket, key, dataset, partition, eventTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	output, err := renderKeyTemplate(route.output, values)
+	if err != nil {
+		return "", "", fmt.Errorf("route %q: output: %v", route.Prefix, err)
+	}
+	if partition != "" && !strings.Contains(route.Output, "{partition}") {
+		output = path.Join(path.Dir(output), partition, path.Base(output))
+	}
+	errorKey, err := renderKeyTemplate(route.error, values)
+	if err != nil {
+		return "", "", fmt.Errorf("route %q: error: %v", route.Prefix, err)
+	}
+	if output == key || errorKey == key {
+		return "", "", fmt.Errorf("route %q: key %v routed to itself", route.Prefix, key)
+	}
+	return output, errorKey, nil
+}
+
+/**************************************************************
+	Pattern of the parquet keys of the source key: the keys
+	are prefix+suffix without partitions, otherwise prefix,
+	the partition folders of dataset, then suffix, e.g.
+	processed/a/ dt=2020-04-06 /x.parquet
+ **************************************************************/
+func (route *Route) OutputPattern(bucket, key string, dataset *Dataset, eventTime time.Time) (string, string, error) {
+	const sentinel = "\x00"
+	partition := ""
+	if len(dataset.Partitions) > 0 {
+		partition = sentinel
+	}
+	output, _, err := route.Keys(bucket, key, dataset.Name, partition, eventTime)
+	if err != nil {
+		return "", "", err
+	}
+	if i := strings.Index(output, sentinel); i >= 0 {
+		return output[:i], output[i+len(sentinel):], nil
+	}
+	return output, "", nil
+}
+
+// Is key the parquet key prefix+partitions+suffix, with partitions folders between prefix and suffix
+func matchOutput(key, prefix, suffix string, partitions int) bool {
+	if partitions == 0 {
+		return key == prefix
+	}
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, suffix) || len(key) <= len(prefix)+len(suffix) {
+		return false
+	}
+	for _, folder := range strings.Split(key[len(prefix):len(key)-len(suffix)], "/") {
+		if folder == "" {
+			return false
+		}
+		partitions--
+	}
+	return partitions == 0
+}
+
+// Build the NDJSON key of the rows of the source key rejected
+func (route *Route) RejectedKey(bucket, key, dataset string, eventTime time.Time) (string, error) {
+	values, err := route.keyValues(bucket, key, dataset, "", eventTime)
+	if err != nil {
+		return "", err
+	}
+	rejected, err := renderKeyTemplate(route.rejected, values)
+	if err != nil {
+		return "", fmt.Errorf("route %q: rejected: %v", route.Prefix, err)
+	}
+	if rejected == key {
+		return "", fmt.Errorf("route %q: key %v routed to itself", route.Prefix, key)
+	}
+	return rejected, nil
+}
+
+// Values of the placeholders of the templates for the source key
+func (route *Route) keyValues(bucket, key, dataset, partition string, eventTime time.Time) (map[string]string, error) {
+	dirname, ok := route.Match(key)
+	if !ok {
+		return nil, fmt.Errorf("%w %v", ErrNoRoute, key)
+	}
+	if eventTime.IsZero() {
+		eventTime = time.Now()
+	}
+	eventTime = eventTime.UTC()
+
+	filename := path.Base(key)
+	basename := path.Base(TrimExtensions(key))
+	return map[string]string{
+		"bucket":    bucket,
+		"key":       key,
+		"dirname":   dirname,
+		"basename":  basename,
+		"filename":  filename,
+		"ext":       strings.TrimPrefix(filename, basename),
+		"dataset":   dataset,
+		"partition": partition,
+		"yyyy":      eventTime.Format("2006"),
+		"mm":        eventTime.Format("01"),
+		"dd":        eventTime.Format("02"),
+		"hh":        eventTime.Format("15"),
+	}, nil
+}
+
+// Fill a key template, removing the empty segments of empty placeholders
+func renderKeyTemplate(parts []templatePart, values map[string]string) (string, error) {
+	var key strings.Builder
+	for _, part := range parts {
+		if part.placeholder {
+			key.WriteString(values[part.text])
+		} else {
+			key.WriteString(part.text)
+		}
+	}
+
+	segments := []string{}
+	for _, segment := range strings.Split(key.String(), "/") {
+		switch segment {
+		case "":
+		case ".", "..":
+			return "", fmt.Errorf("invalid segment %q in key %v", segment, key.String())
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("empty key")
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+/**************************************************************
+	Find the source key of a key of the error parking lot,
+	e.g. data/a/x.json for error/a/x.json, matching it against
+	the error template of each route: the source key is built
+	from {key}, or from the prefix, {dirname} and {filename}
+	(or {basename}{ext}), then checked by building its error
+	key again. ErrNoRoute when no route parked the key.
+ **************************************************************/
+func (cfg *Config) SourceOfError(bucket, errorKey string) (string, error) {
+	for _, route := range cfg.Routes {
+		var source string
+		matchKeyTemplate(route.error, errorKey, map[string]string{}, func(values map[string]string) bool {
+			source = cfg.errorSource(route, bucket, errorKey, values)
+			return source != ""
+		})
+		if source != "" {
+			return source, nil
+		}
+	}
+	return "", fmt.Errorf("%w %v in the error templates", ErrNoRoute, errorKey)
+}
+
+// Source key of route for the placeholder values of the error key, empty unless its error key is errorKey
+func (cfg *Config) errorSource(route *Route, bucket, errorKey string, values map[string]string) string {
+	if values["bucket"] != "" && values["bucket"] != bucket {
+		return ""
+	}
+	filename := values["filename"]
+	if filename == "" {
+		filename = values["basename"] + values["ext"]
+	}
+	source := values["key"]
+	if source == "" {
+		// Without {key}, the prefix must be literal
+		for _, segment := range route.prefix {
+			if strings.ContainsAny(segment, "*?[\\") {
+				return ""
+			}
+		}
+		source = path.Join(append(append([]string{}, route.prefix...), values["dirname"], filename)...)
+	}
+
+	dataset, err := cfg.RouteDataset(route, source)
+	if err != nil {
+		return ""
+	}
+	eventTime := time.Time{}
+	if values["yyyy"] != "" {
+		layout, value := "2006", values["yyyy"]
+		for _, part := range []struct{ name, layout string }{{"mm", "01"}, {"dd", "02"}, {"hh", "15"}} {
+			if values[part.name] != "" {
+				layout, value = layout+" "+part.layout, value+" "+values[part.name]
+			}
+		}
+		eventTime, _ = time.Parse(layout, value)
+	}
+
+	if _, key, err := route.Keys(bucket, source, dataset.Name, "", eventTime); err != nil || key != errorKey {
+		return ""
+	}
+	return source
+}
+
+/**************************************************************
+	Call found with the values of the placeholders of each way
+	the template parts match key, until found returns true.
+	The separators / of the template may be missing from key,
+	like the empty segments of empty placeholders.
+ **************************************************************/
+func matchKeyTemplate(parts []templatePart, key string, values map[string]string, found func(map[string]string) bool) bool {
+	if len(parts) == 0 {
+		return strings.Trim(key, "/") == "" && found(values)
+	}
+	part, rest := parts[0], parts[1:]
+
+	if !part.placeholder {
+		// Compare the text without its /, which may be collapsed in key
+		text := strings.Trim(part.text, "/")
+		key = strings.TrimLeft(key, "/")
+		for _, segment := range strings.Split(text, "/") {
+			if segment == "" {
+				continue
+			}
+			if !strings.HasPrefix(key, segment) {
+				return false
+			}
+			key = strings.TrimLeft(key[len(segment):], "/")
+		}
+		return matchKeyTemplate(rest, key, values, found)
+	}
+
+	// Placeholders of a file or folder name don't span folders
+	end := len(key)
+	switch part.text {
+	case "key", "dirname", "partition":
+	default:
+		if i := strings.Index(key, "/"); i >= 0 {
+			end = i
+		}
+	}
+	for i := 0; i <= end; i++ {
+		value := key[:i]
+		if previous, ok := values[part.text]; ok && previous != value {
+			continue
+		}
+		next := map[string]string{}
+		for name, v := range values {
+			next[name] = v
+		}
+		next[part.text] = value
+		if matchKeyTemplate(rest, key[i:], next, found) {
+			return true
+		}
+	}
+	return false
+}
+
+/**************************************************************
+	Find the route of a key, the first one matching it
+ **************************************************************/
+func (cfg *Config) RouteFor(key string) (*Route, error) {
+	for _, route := range cfg.Routes {
+		if _, ok := route.Match(key); ok {
+			return route, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %v", ErrNoRoute, key)
+}
+
+/**************************************************************
+	Find the route and the dataset of a key, ErrNoRoute when
+	the key has no route or its route no dataset
+ **************************************************************/
+func (cfg *Config) RouteOf(key string) (*Route, *Dataset, error) {
+	route, err := cfg.RouteFor(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataset, err := cfg.RouteDataset(route, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrNoRoute, err)
+	}
+	return route, dataset, nil
+}
+
+/**************************************************************
+	Find the dataset of a key routed by route, the dataset of
+	the route if set, else the one with the longest prefix
+ **************************************************************/
+func (cfg *Config) RouteDataset(route *Route, key string) (*Dataset, error) {
+	if route.Dataset == "" {
+		return cfg.DatasetFor(key)
+	}
+	for _, dataset := range cfg.Datasets {
+		if dataset.Name == route.Dataset {
+			return dataset, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %v: unknown dataset %v", ErrNoDataset, key, route.Dataset)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDefaultRouteKeys(t *testing.T) {
+	route := DefaultRoutes()[0]
+	eventTime := time.Date(2020, 4, 6, 21, 5, 45, 0, time.UTC)
+
+	tests := []struct {
+		key, partition, output, errorKey string
+	}{
+		{"data/test.json", "", "processed/test.json.parquet", "error/test.json"},
+		{"data/2020/test.json.gz", "", "processed/2020/test.json.gz.parquet", "error/2020/test.json.gz"},
+		{"data/test.json", "dt=2020-04-06", "processed/dt=2020-04-06/test.json.parquet", "error/test.json"},
+		{"data/a/b/test.json", "dt=2020-04-06/hour=21", "processed/dt=2020-04-06/hour=21/a/b/test.json.parquet", "error/a/b/test.json"},
+	}
+	for _, test := range tests {
+		output, errorKey, err := route.Keys("deglon", test.key, "default", test.partition, eventTime)
+		if err != nil || output != test.output || errorKey != test.errorKey {
+			t.Errorf("%v %v: got %v %v %v, expected %v %v", test.key, test.partition, output, errorKey, err, test.output, test.errorKey)
+		}
+		// The partitions of every source folder share the folder of the partition in the table
+		if test.partition != "" {
+			if folder := partitionFolder(output, test.partition); folder != "processed/"+test.partition+"/" {
+				t.Errorf("%v: partition folder %v", output, folder)
+			}
+		}
+	}
+}
+
+func TestDefaultRouteKeysDistinct(t *testing.T) {
+	route := DefaultRoutes()[0]
+	eventTime := time.Date(2020, 4, 6, 21, 5, 45, 0, time.UTC)
+
+	// Files of the same name with other extensions don't overwrite each other's parquet file
+	outputs := map[string]string{}
+	for _, key := range []string{"data/x.json", "data/x.csv", "data/x.json.gz", "data/x.jsonl", "data/x", "data/x/x.json"} {
+		output, _, err := route.Keys("deglon", key, "default", "", eventTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := outputs[output]; ok {
+			t.Errorf("%v and %v are both written to %v", other, key, output)
+		}
+		outputs[output] = key
+	}
+}
+
+func TestSourceOfError(t *testing.T) {
+	withConfig(t)
+	config.Routes = append(config.Routes,
+		&Route{Prefix: "logs/*/", Output: "processed/{key}.parquet", Error: "failed/{yyyy}/{mm}/{key}"},
+		&Route{Prefix: "raw/", Suffix: ".csv", Output: "processed/{filename}.parquet", Error: "parked/{dataset}/{dirname}/{basename}-failed{ext}"},
+		&Route{Prefix: "any/*/", Output: "processed/{filename}.parquet", Error: "lost/{filename}"},
+	)
+	for _, route := range config.Routes {
+		if err := route.Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		errorKey, source string
+	}{
+		{"error/test.json", "data/test.json"},
+		{"error/a/b/test.json.gz", "data/a/b/test.json.gz"},
+		{"error/my file (1).json", "data/my file (1).json"},
+		{"failed/2020/04/logs/web/access.log", "logs/web/access.log"},
+		{"parked/default/x.csv", ""}, // Not the name of an error key of raw/
+		{"parked/default/2020/x-failed.csv", "raw/2020/x.csv"},
+		{"parked/default/x-failed.csv", "raw/x.csv"},
+		{"parked/other/x-failed.csv", ""}, // Not the dataset of raw/x.csv
+		{"lost/x.json", ""},               // Source folder unknown
+		{"processed/test.json.parquet", ""},
+		{"error/", ""},
+	}
+	for _, test := range tests {
+		source, err := config.SourceOfError("deglon", test.errorKey)
+		if source != test.source || (test.source == "" && !errors.Is(err, ErrNoRoute)) {
+			t.Errorf("%v: got %q %v, expected %q", test.errorKey, source, err, test.source)
+		}
+	}
+}
@@ -1,37 +1,48 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
 )
 
 /**************************************************************
-	Read a file from s3://bucket/item
+	S3Store is the ObjectStore backed by AWS S3
  **************************************************************/
-func ReadS3File(bucket, item string) ([]byte, error) {
+type S3Store struct {
+	sess *session.Session
+}
+
+// Create a S3Store sharing the session sess for all calls, with
+// the S3 settings s3Config (endpoint, path style)
+func NewS3Store(sess *session.Session, s3Config *aws.Config) *S3Store {
+	return &S3Store{sess: sess.Copy(s3Config)}
+}
 
-	// Start a session
-	sess, _ := session.NewSession(&aws.Config{
-		Region: aws.String("us-west-1")},
-	)
+/**************************************************************
+	Read a file from s3://bucket/item
+ **************************************************************/
+func (store *S3Store) Get(bucket, item string) ([]byte, error) {
 
 	// Prepare a WriteAt Buffer for s3
 	buf := aws.NewWriteAtBuffer([]byte{})
 
 	// Download data from s3
-	numBytes, err := s3manager.NewDownloader(sess).Download(buf,
+	numBytes, err := s3manager.NewDownloader(store.sess).Download(buf,
 		&s3.GetObjectInput{
 			Bucket: aws.String(bucket),
 			Key:    aws.String(item),
 		})
 	if err != nil {
 		Error("Unable to download item %q, %v", item, err)
-		return []byte{}, err
+		return []byte{}, s3Error(err)
 	}
 
 	Debug("Downloaded s3://%v/%v with %v bytes", bucket, item, numBytes)
@@ -40,46 +51,61 @@ func ReadS3File(bucket, item string) ([]byte, error) {
 }
 
 /**************************************************************
-	AddFileToS3 will upload a single file to S3, it will
-	require a pre-built aws session and will set file info
-	like content type and encryption on the uploaded file.
+	Stream the file s3://bucket/item, the caller closes the
+	returned reader
  **************************************************************/
-func AddFileToS3(s3_bucket, s3_item, fileName string) error {
-
-	// Start a session
-	sess, _ := session.NewSession(&aws.Config{
-		Region: aws.String("us-west-1")},
-	)
-
-	// Open the file for use
-	file, err := os.Open(fileName)
+func (store *S3Store) Open(bucket, item string) (io.ReadCloser, *ObjectInfo, error) {
+	output, err := s3.New(store.sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(item),
+	})
 	if err != nil {
-		Error("Error opening file %v: %v", fileName, err)
-		return err
+		Error("Unable to open item %q, %v", item, err)
+		return nil, nil, s3Error(err)
 	}
-	defer file.Close()
-
-	// Get file size and read the file content into a buffer
-	fileInfo, _ := file.Stat()
-	var size int64 = fileInfo.Size()
-	buffer := make([]byte, size)
-	if _, err = file.Read(buffer); err != nil {
-		Error("Error reading file %v: %v", fileName, err)
+
+	Debug("Streaming s3://%v/%v with %v bytes", bucket, item, aws.Int64Value(output.ContentLength))
+
+	return output.Body, &ObjectInfo{
+		Key:             item,
+		Size:            aws.Int64Value(output.ContentLength),
+		ETag:            strings.Trim(aws.StringValue(output.ETag), `"`),
+		LastModified:    aws.TimeValue(output.LastModified),
+		ContentType:     aws.StringValue(output.ContentType),
+		ContentEncoding: aws.StringValue(output.ContentEncoding),
+	}, nil
+}
+
+/**************************************************************
+	Upload the content of body to s3://s3_bucket/s3_item and
+	set file info like content type and encryption on the
+	uploaded file. The content is streamed in a multipart
+	upload, only a few parts are held in memory.
+ **************************************************************/
+func (store *S3Store) Put(s3_bucket, s3_item string, body io.Reader) error {
+
+	// Detect the content type from the first bytes
+	reader := bufio.NewReaderSize(body, 512)
+	head, err := reader.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		Error("Error reading content for s3://%v/%v: %v", s3_bucket, s3_item, err)
 		return err
 	}
 
 	// Config settings: this is where you choose the bucket, filename, content-type etc.
 	// of the file you're uploading.
-	_, err = s3.New(sess).PutObject(&s3.PutObjectInput{
+	_, err = s3manager.NewUploader(store.sess).Upload(&s3manager.UploadInput{
 		Bucket:               aws.String(s3_bucket),
 		Key:                  aws.String(s3_item),
 		ACL:                  aws.String("private"),
-		Body:                 bytes.NewReader(buffer),
-		ContentLength:        aws.Int64(size),
-		ContentType:          aws.String(http.DetectContentType(buffer)),
+		Body:                 reader,
+		ContentType:          aws.String(http.DetectContentType(head)),
 		ContentDisposition:   aws.String("attachment"),
 		ServerSideEncryption: aws.String("AES256"),
 	})
+	if err != nil {
+		Error("Unable to upload s3://%v/%v: %v", s3_bucket, s3_item, err)
+	}
 	return err
 }
 
@@ -87,25 +113,21 @@ func AddFileToS3(s3_bucket, s3_item, fileName string) error {
 	Copy a file s3://source_bucket/source_item to
 	s3://bucket/item
  **************************************************************/
-func CopyS3File(source_bucket, source_item, bucket, item string) error {
-
-	// Start a session
-	sess, _ := session.NewSession(&aws.Config{
-		Region: aws.String("us-west-1")},
-	)
+func (store *S3Store) Copy(source_bucket, source_item, bucket, item string) error {
 
 	// Copy the item
-	if _, err := s3.New(sess).CopyObject(&s3.CopyObjectInput{
+	svc := s3.New(store.sess)
+	if _, err := svc.CopyObject(&s3.CopyObjectInput{
 		Bucket:     aws.String(bucket),
 		CopySource: aws.String(source_bucket + "/" + source_item),
 		Key:        aws.String(item),
 	}); err != nil {
 		Error("Unable to copy item from bucket %v to bucket %v: %v", source_bucket, bucket, err)
-		return err
+		return s3Error(err)
 	}
 
 	// Wait to see if the item got copied
-	if err = s3.New(sess).WaitUntilObjectExists(&s3.HeadObjectInput{
+	if err := svc.WaitUntilObjectExists(&s3.HeadObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(item),
 	}); err != nil {
@@ -115,3 +137,76 @@ func CopyS3File(source_bucket, source_item, bucket, item string) error {
 
 	return nil
 }
+
+/**************************************************************
+	Describe the file s3://bucket/item
+ **************************************************************/
+func (store *S3Store) Head(bucket, item string) (*ObjectInfo, error) {
+	output, err := s3.New(store.sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(item),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &ObjectInfo{
+		Key:             item,
+		Size:            aws.Int64Value(output.ContentLength),
+		ETag:            strings.Trim(aws.StringValue(output.ETag), `"`),
+		LastModified:    aws.TimeValue(output.LastModified),
+		ContentType:     aws.StringValue(output.ContentType),
+		ContentEncoding: aws.StringValue(output.ContentEncoding),
+	}, nil
+}
+
+/**************************************************************
+	List the files in s3://bucket/prefix
+ **************************************************************/
+func (store *S3Store) List(bucket, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := s3.New(store.sess).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				ETag:         strings.Trim(aws.StringValue(object.ETag), `"`),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		Error("Unable to list s3://%v/%v: %v", bucket, prefix, err)
+		return nil, s3Error(err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+/**************************************************************
+	Delete the file s3://bucket/item
+ **************************************************************/
+func (store *S3Store) Delete(bucket, item string) error {
+	if _, err := s3.New(store.sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(item),
+	}); err != nil {
+		Error("Unable to delete s3://%v/%v: %v", bucket, item, err)
+		return s3Error(err)
+	}
+	return nil
+}
+
+// Translate missing keys into ErrObjectNotFound
+func s3Error(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrObjectNotFound
+		}
+	}
+	return err
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**************************************************************
+	Define Schema Variables
+ **************************************************************/
+
+// Error returned when no dataset is configured for a key
+var ErrNoDataset = errors.New("no dataset for key")
+
+// Parquet physical types of a column
+var physicalTypes = map[string]bool{
+	"BOOLEAN":    true,
+	"INT32":      true,
+	"INT64":      true,
+	"FLOAT":      true,
+	"DOUBLE":     true,
+	"BYTE_ARRAY": true,
+}
+
+// Parquet logical types of a column, with the physical type storing them
+var logicalTypes = map[string]string{
+	"UTF8":             "BYTE_ARRAY",
+	"DATE":             "INT32",
+	"TIMESTAMP_MILLIS": "INT64",
+	"TIMESTAMP_MICROS": "INT64",
+	"INT_8":            "INT32",
+	"INT_16":           "INT32",
+	"INT_32":           "INT32",
+	"INT_64":           "INT64",
+}
+
+// Valid column names (also valid Athena column names)
+var columnNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// A record of a dataset, column name to value
+type Row map[string]interface{}
+
+/**************************************************************
+	Dataset describes one JSON shape converted to Parquet,
+	routed by the prefix of the S3 keys
+ **************************************************************/
+type Dataset struct {
+	// Name of the dataset
+	Name string `json:"name"`
+	// Keys starting with Prefix belong to the dataset (longest prefix wins)
+	Prefix string `json:"prefix"`
+	// Columns of the parquet file
+	Columns []Column `json:"columns"`
+	// Columns computed with an expression, in order, from the other columns
+	Derived []DerivedColumn `json:"derived,omitempty"`
+	// Options to read CSV and TSV files
+	CSV CSVOptions `json:"csv"`
+	// Hive-style partitions of the parquet files, in order, e.g. dt then hour
+	Partitions []Partition `json:"partitions,omitempty"`
+	// Folder of the parquet files in the Athena table LOCATION, by default from the output template of the route
+	Location string `json:"location,omitempty"`
+	// Rules checked on each row, after the derived columns
+	Rules []Rule `json:"rules,omitempty"`
+	// Invalid rows written to rejected/ before the whole file fails, none by default
+	Reject RejectPolicy `json:"reject"`
+
+	// Parquet JSON schema built from Columns
+	parquetSchema string
+}
+
+// Column of a dataset
+type Column struct {
+	// Name of the column in the JSON records and the parquet file
+	Name string `json:"name"`
+	// Parquet physical type: BOOLEAN, INT32, INT64, FLOAT, DOUBLE or BYTE_ARRAY
+	Type string `json:"type,omitempty"`
+	// Parquet logical type: UTF8, DATE, TIMESTAMP_MILLIS, TIMESTAMP_MICROS, INT_8, INT_16, INT_32 or INT_64
+	LogicalType string `json:"logicalType,omitempty"`
+	// Values can be null, otherwise missing values are written as the zero value of the type
+	Nullable bool `json:"nullable,omitempty"`
+}
+
+// Column computed with an expression, see expr.go
+type DerivedColumn struct {
+	// Name of the column, one of the dataset columns
+	Column string `json:"column"`
+	// Expression computing the value, e.g. "a + b"
+	Expression string `json:"expression"`
+
+	compiled *Expression
+	column   Column
+}
+
+/**************************************************************
+	Default dataset of the DataObjectElement records
+ **************************************************************/
+func DefaultDataset() *Dataset {
+	columns, err := StructColumns(new(DataObjectElement))
+	if err != nil {
+		panic(err)
+	}
+	dataset := &Dataset{
+		Name:    "default",
+		Columns: columns,
+		// Execute the work, here add total = a + b, and set Timestamp to now in milliseconds
+		Derived: []DerivedColumn{
+			{Column: "total", Expression: "a + b"},
+			{Column: "created_ts", Expression: "now()"},
+		},
+	}
+	if err := dataset.Compile(); err != nil {
+		panic(err)
+	}
+	return dataset
+}
+
+/**************************************************************
+	Check the dataset and build its parquet schema
+ **************************************************************/
+func (dataset *Dataset) Compile() error {
+	if dataset.Name == "" {
+		return fmt.Errorf("dataset without name")
+	}
+	if len(dataset.Columns) == 0 {
+		return fmt.Errorf("dataset %v: no columns", dataset.Name)
+	}
+
+	names := map[string]bool{}
+	for i := range dataset.Columns {
+		column := &dataset.Columns[i]
+		if err := column.normalize(); err != nil {
+			return fmt.Errorf("dataset %v: %v", dataset.Name, err)
+		}
+		if names[strings.ToLower(column.Name)] {
+			return fmt.Errorf("dataset %v: duplicate column %v", dataset.Name, column.Name)
+		}
+		names[strings.ToLower(column.Name)] = true
+	}
+
+	// Parse the expressions of derived columns
+	for i := range dataset.Derived {
+		derived := &dataset.Derived[i]
+		column, ok := dataset.Column(derived.Column)
+		if !ok {
+			return fmt.Errorf("dataset %v: derived column %v is not a column", dataset.Name, derived.Column)
+		}
+		compiled, err := CompileExpression(derived.Expression)
+		if err != nil {
+			return fmt.Errorf("dataset %v: derived column %v: %v", dataset.Name, derived.Column, err)
+		}
+		// Catch typos of column names, e.g. upper(nmae), which would evaluate to null
+		for _, name := range compiled.Columns() {
+			if _, ok := dataset.Column(name); !ok {
+				return fmt.Errorf("dataset %v: derived column %v: %v is not a column", dataset.Name, derived.Column, name)
+			}
+		}
+		derived.column = column
+		derived.compiled = compiled
+	}
+
+	if err := dataset.CSV.Validate(dataset); err != nil {
+		return fmt.Errorf("dataset %v: %v", dataset.Name, err)
+	}
+
+	partitions := map[string]bool{}
+	for i := range dataset.Partitions {
+		partition := &dataset.Partitions[i]
+		if err := partition.compile(dataset); err != nil {
+			return fmt.Errorf("dataset %v: %v", dataset.Name, err)
+		}
+		if partitions[partition.Name] {
+			return fmt.Errorf("dataset %v: duplicate partition %v", dataset.Name, partition.Name)
+		}
+		partitions[partition.Name] = true
+	}
+
+	for i := range dataset.Rules {
+		if err := dataset.Rules[i].compile(dataset); err != nil {
+			return fmt.Errorf("dataset %v: %v", dataset.Name, err)
+		}
+	}
+	if err := dataset.Reject.Validate(); err != nil {
+		return fmt.Errorf("dataset %v: %v", dataset.Name, err)
+	}
+	if len(dataset.Rules) > 0 && dataset.Reject.MaxRows == 0 {
+		Info("Dataset %v: reject.maxRows is 0, the first invalid row fails the whole file", dataset.Name)
+	}
+
+	dataset.parquetSchema = dataset.ParquetSchema()
+	return nil
+}
+
+// Find a column by name
+func (dataset *Dataset) Column(name string) (Column, bool) {
+	for _, column := range dataset.Columns {
+		if column.Name == name {
+			return column, true
+		}
+	}
+	return Column{}, false
+}
+
+/**************************************************************
+	Compute the derived columns of a row, in order
+ **************************************************************/
+func (dataset *Dataset) Derive(row Row, env *ExprEnv) error {
+	env.Row = row
+	for _, derived := range dataset.Derived {
+		value, err := derived.compiled.Eval(env)
+		if err != nil {
+			return fmt.Errorf("column %v: %v", derived.Column, err)
+		}
+		if row[derived.Column], err = derived.column.Coerce(value); err != nil {
+			return fmt.Errorf("column %v: %v", derived.Column, err)
+		}
+	}
+	return nil
+}
+
+// Check the column name and types, and derive the physical type from the logical type
+func (column *Column) normalize() error {
+	if !columnNameRegexp.MatchString(column.Name) {
+		return fmt.Errorf("invalid column name %q", column.Name)
+	}
+	column.Type = strings.ToUpper(column.Type)
+	column.LogicalType = strings.ToUpper(column.LogicalType)
+
+	if column.LogicalType != "" {
+		physical, ok := logicalTypes[column.LogicalType]
+		if !ok {
+			return fmt.Errorf("column %v: unsupported logical type %v", column.Name, column.LogicalType)
+		}
+		if column.Type == "" {
+			column.Type = physical
+		}
+		if column.Type != physical {
+			return fmt.Errorf("column %v: logical type %v requires type %v", column.Name, column.LogicalType, physical)
+		}
+	}
+	if !physicalTypes[column.Type] {
+		return fmt.Errorf("column %v: unsupported type %q", column.Name, column.Type)
+	}
+	return nil
+}
+
+/**************************************************************
+	Build the parquet JSON schema of the dataset, tags use the
+	same syntax as DataObjectElement
+ **************************************************************/
+func (dataset *Dataset) ParquetSchema() string {
+	type field struct {
+		Tag    string  `json:"Tag"`
+		Fields []field `json:"Fields,omitempty"`
+	}
+	root := field{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+	for _, column := range dataset.Columns {
+		root.Fields = append(root.Fields, field{Tag: column.parquetTag()})
+	}
+	content, _ := json.Marshal(root)
+	return string(content)
+}
+
+// Parquet tag of the column, e.g. "name=created_ts, type=TIMESTAMP_MILLIS, repetitiontype=REQUIRED"
+func (column Column) parquetTag() string {
+	tag := "name=" + column.Name + ", type=" + column.Type
+	if column.LogicalType != "" {
+		tag = "name=" + column.Name + ", type=" + column.LogicalType
+	}
+	if column.Type == "BYTE_ARRAY" {
+		tag += ", encoding=PLAIN_DICTIONARY"
+	}
+	if column.Nullable {
+		return tag + ", repetitiontype=OPTIONAL"
+	}
+	return tag + ", repetitiontype=REQUIRED"
+}
+
+/**************************************************************
+	Derive the columns of a struct from its parquet tags,
+	e.g. `parquet:"name=created_ts, type=TIMESTAMP_MILLIS"`
+ **************************************************************/
+func StructColumns(object interface{}) ([]Column, error) {
+	t := reflect.TypeOf(object)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%v is not a struct", t)
+	}
+
+	columns := []Column{}
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("parquet")
+		if tag == "" {
+			continue
+		}
+		column := Column{Nullable: t.Field(i).Type.Kind() == reflect.Ptr}
+		for _, item := range strings.Split(tag, ",") {
+			kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "name":
+				column.Name = kv[1]
+			case "type":
+				if _, ok := logicalTypes[kv[1]]; ok {
+					column.LogicalType = kv[1]
+				} else {
+					column.Type = kv[1]
+				}
+			case "repetitiontype":
+				column.Nullable = kv[1] == "OPTIONAL"
+			}
+		}
+		if err := column.normalize(); err != nil {
+			return nil, fmt.Errorf("%v.%v: %v", t, t.Field(i).Name, err)
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// Coerce the values of a record into the column types, ignoring unknown fields
+func (dataset *Dataset) NewRow(record map[string]interface{}) (Row, error) {
+	row := Row{}
+	for _, column := range dataset.Columns {
+		value, err := column.Coerce(record[column.Name])
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", column.Name, err)
+		}
+		row[column.Name] = value
+	}
+	return row, nil
+}
+
+/**************************************************************
+	Coerce a decoded value into the Go type of the column:
+	bool, int32, int64, float32, float64 or string
+ **************************************************************/
+func (column Column) Coerce(value interface{}) (interface{}, error) {
+	if value == nil {
+		if column.Nullable {
+			return nil, nil
+		}
+		return column.zero(), nil
+	}
+
+	switch column.LogicalType {
+	case "DATE":
+		if s, ok := value.(string); ok {
+			t, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return nil, err
+			}
+			return dateValue(t), nil
+		}
+		if t, ok := value.(time.Time); ok {
+			return dateValue(t), nil
+		}
+	case "TIMESTAMP_MILLIS", "TIMESTAMP_MICROS":
+		if t, ok := value.(time.Time); ok {
+			return timestampValue(t, column.LogicalType), nil
+		}
+		if s, ok := value.(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return timestampValue(t, column.LogicalType), nil
+			}
+		}
+	}
+
+	switch column.Type {
+	case "BOOLEAN":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(v))
+		}
+	case "INT32":
+		n, err := toInt(value, 32)
+		return int32(n), err
+	case "INT64":
+		return toInt(value, 64)
+	case "FLOAT":
+		f, err := toFloat(value, 32)
+		return float32(f), err
+	case "DOUBLE":
+		return toFloat(value, 64)
+	case "BYTE_ARRAY":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case json.Number:
+			return v.String(), nil
+		case bool, int32, int64, float32, float64:
+			return fmt.Sprint(v), nil
+		case time.Time:
+			return v.Format(time.RFC3339Nano), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %v (%T) to %v", value, value, column.typeName())
+}
+
+// Zero value of the column type
+func (column Column) zero() interface{} {
+	switch column.Type {
+	case "BOOLEAN":
+		return false
+	case "INT32":
+		return int32(0)
+	case "INT64":
+		return int64(0)
+	case "FLOAT":
+		return float32(0)
+	case "DOUBLE":
+		return float64(0)
+	}
+	return ""
+}
+
+// Name of the column type, for error messages
+func (column Column) typeName() string {
+	if column.LogicalType != "" {
+		return column.LogicalType
+	}
+	return column.Type
+}
+
+// Days since epoch of the date of t in its location, rounded down
+// so the dates before 1970 are not a day late
+func dateValue(t time.Time) int32 {
+	_, offset := t.Zone()
+	seconds := t.Unix() + int64(offset)
+	days := seconds / 86400
+	if seconds%86400 < 0 {
+		days--
+	}
+	return int32(days)
+}
+
+// Milliseconds or microseconds since epoch
+func timestampValue(t time.Time, logicalType string) int64 {
+	if logicalType == "TIMESTAMP_MICROS" {
+		return t.UnixNano() / 1000
+	}
+	return t.UnixNano() / 1000000
+}
+
+// Convert a number or numeric string into an integer of bitSize bits
+func toInt(value interface{}, bitSize int) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return toInt(string(v), bitSize)
+	case string:
+		s := strings.TrimSpace(v)
+		if n, err := strconv.ParseInt(s, 10, bitSize); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not an integer", v)
+		}
+		return toInt(f, bitSize)
+	case int32:
+		return int64(v), nil
+	case int64:
+		if bitSize == 32 && (v < math.MinInt32 || v > math.MaxInt32) {
+			return 0, fmt.Errorf("%v is not a %v bits integer", v, bitSize)
+		}
+		return v, nil
+	case float32:
+		return toInt(float64(v), bitSize)
+	case float64:
+		limit := math.Ldexp(1, bitSize-1)
+		if v != math.Trunc(v) || v < -limit || v >= limit {
+			return 0, fmt.Errorf("%v is not a %v bits integer", v, bitSize)
+		}
+		return int64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("cannot convert %v (%T) to an integer", value, value)
+}
+
+// Convert a number or numeric string into a float of bitSize bits
+func toFloat(value interface{}, bitSize int) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return strconv.ParseFloat(string(v), bitSize)
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), bitSize)
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("cannot convert %v (%T) to a number", value, value)
+}
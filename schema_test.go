@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatasetCompileDerived(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{"upper(name)", ""},
+		{"coalesce(qty, 0) * 2", ""},
+		{"upper(nmae)", "nmae is not a column"},
+		{"if(qty > 0, price * qty, null)", "price is not a column"},
+		{"upper(", "derived column label"},
+	}
+	for _, test := range tests {
+		dataset := &Dataset{
+			Name: "sales",
+			Columns: []Column{
+				{Name: "name", Type: "BYTE_ARRAY", LogicalType: "UTF8"},
+				{Name: "label", Type: "BYTE_ARRAY", LogicalType: "UTF8"},
+				{Name: "qty", Type: "INT64"},
+			},
+			Derived: []DerivedColumn{{Column: "label", Expression: test.expression}},
+		}
+		err := dataset.Compile()
+		if test.err == "" && err != nil {
+			t.Errorf("%v: %v", test.expression, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%v: got %v, expected %q", test.expression, err, test.err)
+		}
+	}
+}
+
+func TestColumnCoerceDate(t *testing.T) {
+	column := Column{Name: "day", Type: "INT32", LogicalType: "DATE"}
+	paris := time.FixedZone("Paris", 2*3600)
+
+	tests := []struct {
+		value interface{}
+		days  int32
+	}{
+		{"1970-01-01", 0},
+		{"2020-04-06", 18358},
+		{"1969-12-31", -1},
+		{"1900-01-01", -25567},
+		{time.Date(2020, 4, 6, 21, 5, 45, 0, time.UTC), 18358},
+		{time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), -1},
+		{time.Date(1969, 12, 31, 12, 0, 0, 0, time.UTC), -1},
+		{time.Date(2020, 4, 7, 1, 0, 0, 0, paris), 18359},
+		{time.Date(1970, 1, 1, 1, 0, 0, 0, paris), 0},
+	}
+	for _, test := range tests {
+		value, err := column.Coerce(test.value)
+		if err != nil || value != test.days {
+			t.Errorf("%v: got %v, %v, expected %v", test.value, value, err, test.days)
+		}
+	}
+	if _, err := column.Coerce("06/04/2020"); err == nil {
+		t.Errorf("06/04/2020: expected an error")
+	}
+}
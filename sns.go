@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+	Define SNS Signature Verification Variables
+ **************************************************************/
+
+// Error returned when an SNS message is unsigned or its signature doesn't match
+var ErrInvalidSignature = errors.New("invalid SNS message signature")
+
+// Hosts allowed to serve SNS signing certificates (e.g. sns.us-west-1.amazonaws.com)
+var defaultSNSCertHosts = []*regexp.Regexp{
+	regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com$`),
+	regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com\.cn$`),
+}
+
+// Verifier used by ReadS3Event, replace its fields to inject a local signing certificate
+var snsVerifier = NewSNSVerifier()
+
+// Fields signed by SNS, in canonical order, for each message type
+var snsSignedFields = map[string][]string{
+	"Notification":             {"Message", "MessageId", "Subject", "Timestamp", "TopicArn", "Type"},
+	"SubscriptionConfirmation": {"Message", "MessageId", "SubscribeURL", "Timestamp", "Token", "TopicArn", "Type"},
+	"UnsubscribeConfirmation":  {"Message", "MessageId", "SubscribeURL", "Timestamp", "Token", "TopicArn", "Type"},
+}
+
+/**************************************************************
+	SNSVerifier checks the signature of SNS HTTP(S) messages
+ **************************************************************/
+type SNSVerifier struct {
+	// Hosts allowed in SigningCertURL
+	AllowedCertHosts []*regexp.Regexp
+	// Fetch and parse the certificate at SigningCertURL
+	FetchCertificate func(certURL string) (*x509.Certificate, error)
+
+	mutex sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+// Create a SNSVerifier downloading certificates from the AWS SNS hosts
+func NewSNSVerifier() *SNSVerifier {
+	return &SNSVerifier{
+		AllowedCertHosts: defaultSNSCertHosts,
+		FetchCertificate: FetchSNSCertificate,
+		certs:            map[string]*x509.Certificate{},
+	}
+}
+
+/**************************************************************
+	Verify the signature of a raw SNS message body
+ **************************************************************/
+func (v *SNSVerifier) Verify(body []byte) error {
+
+	// Keep the raw string values, Timestamp must be signed as received
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		Error("Error decoding SNS message for verification: %v", err)
+		return ErrInvalidSignature
+	}
+	field := func(name string) string {
+		s, _ := fields[name].(string)
+		return s
+	}
+
+	// Pick the hash from SignatureVersion
+	var hash crypto.Hash
+	switch field("SignatureVersion") {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		Error("Unsupported SNS SignatureVersion %q", field("SignatureVersion"))
+		return ErrInvalidSignature
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(field("Signature"))
+	if err != nil || len(signature) == 0 {
+		Error("Missing or malformed SNS Signature")
+		return ErrInvalidSignature
+	}
+
+	canonical, err := SNSCanonicalString(field("Type"), field)
+	if err != nil {
+		Error("Error building SNS canonical string: %v", err)
+		return ErrInvalidSignature
+	}
+
+	cert, err := v.certificate(field("SigningCertURL"))
+	if err != nil {
+		Error("Error getting SNS signing certificate: %v", err)
+		return ErrInvalidSignature
+	}
+
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		Error("SNS signing certificate %v has no RSA public key", field("SigningCertURL"))
+		return ErrInvalidSignature
+	}
+
+	if err := rsa.VerifyPKCS1v15(publicKey, hash, hashSum(hash, canonical), signature); err != nil {
+		Error("SNS signature mismatch for message %v: %v", field("MessageId"), err)
+		return ErrInvalidSignature
+	}
+
+	Debug("SNS signature verified for message %v", field("MessageId"))
+	return nil
+}
+
+// Get the certificate from cache, or check its URL and fetch it
+func (v *SNSVerifier) certificate(certURL string) (*x509.Certificate, error) {
+	if err := v.checkCertURL(certURL); err != nil {
+		return nil, err
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.certs == nil {
+		v.certs = map[string]*x509.Certificate{}
+	}
+	if cert, ok := v.certs[certURL]; ok {
+		return cert, nil
+	}
+
+	cert, err := v.FetchCertificate(certURL)
+	if err != nil {
+		return nil, err
+	}
+	v.certs[certURL] = cert
+	return cert, nil
+}
+
+// Only https certificates (*.pem) from an allowed host are accepted
+func (v *SNSVerifier) checkCertURL(certURL string) error {
+	u, err := url.Parse(certURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("SigningCertURL %q is not https", certURL)
+	}
+	if !strings.HasSuffix(u.Path, ".pem") {
+		return fmt.Errorf("SigningCertURL %q is not a .pem file", certURL)
+	}
+	for _, host := range v.AllowedCertHosts {
+		if host.MatchString(u.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("SigningCertURL host %q is not allowed", u.Hostname())
+}
+
+/**************************************************************
+	Build the string to sign of a SNS message, fields are
+	"Name\nValue\n" pairs in canonical order; Subject is only
+	signed when present
+ **************************************************************/
+func SNSCanonicalString(messageType string, field func(string) string) ([]byte, error) {
+	names, ok := snsSignedFields[messageType]
+	if !ok {
+		return nil, fmt.Errorf("unknown SNS message type %q", messageType)
+	}
+
+	var buffer strings.Builder
+	for _, name := range names {
+		value := field(name)
+		if name == "Subject" && value == "" {
+			continue
+		}
+		buffer.WriteString(name + "\n" + value + "\n")
+	}
+	return []byte(buffer.String()), nil
+}
+
+// Hash the canonical string with SHA1 or SHA256
+func hashSum(hash crypto.Hash, data []byte) []byte {
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum(data)
+		return sum[:]
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+/**************************************************************
+	Download and parse a PEM certificate from SigningCertURL
+ **************************************************************/
+func FetchSNSCertificate(certURL string) (*x509.Certificate, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v: %v", certURL, resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate in %v", certURL)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCertURL = "https://sns.us-west-1.amazonaws.com/SimpleNotificationService-test.pem"
+
+// Verifier trusting a generated signing certificate, returned with its key
+func newTestVerifier(t *testing.T) (*SNSVerifier, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewSNSVerifier()
+	verifier.FetchCertificate = func(certURL string) (*x509.Certificate, error) {
+		if certURL != testCertURL {
+			return nil, errors.New("unexpected certificate " + certURL)
+		}
+		return cert, nil
+	}
+	return verifier, key
+}
+
+// Body of the SNS message of fields, signed with key
+func signMessage(t *testing.T, key *rsa.PrivateKey, version string, fields map[string]string) []byte {
+	fields["SignatureVersion"] = version
+	fields["SigningCertURL"] = testCertURL
+	canonical, err := SNSCanonicalString(fields["Type"], func(name string) string { return fields[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := crypto.SHA256
+	if version == "1" {
+		hash = crypto.SHA1
+	}
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, hashSum(hash, canonical))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields["Signature"] = base64.StdEncoding.EncodeToString(signature)
+
+	body, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// Fields of a notification of a S3 event
+func notificationFields() map[string]string {
+	return map[string]string{
+		"Type":      "Notification",
+		"MessageId": "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		"TopicArn":  "arn:aws:sns:us-west-1:123456789012:my-topic",
+		"Subject":   "Amazon S3 Notification",
+		"Message":   `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectRestore:Completed","s3":{"bucket":{"name":"deglon"},"object":{"key":"data/test.json"}}}]}`,
+		"Timestamp": "2020-04-06T21:05:45.102Z",
+	}
+}
+
+func TestSNSVerify(t *testing.T) {
+	verifier, key := newTestVerifier(t)
+
+	for _, version := range []string{"1", "2"} {
+		body := signMessage(t, key, version, notificationFields())
+		if err := verifier.Verify(body); err != nil {
+			t.Errorf("SignatureVersion %v: valid message refused: %v", version, err)
+		}
+	}
+
+	// Tampered message
+	body := signMessage(t, key, "2", notificationFields())
+	tampered := strings.Replace(string(body), "data/test.json", "data/other.json", 1)
+	if err := verifier.Verify([]byte(tampered)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("tampered message: got %v, expected ErrInvalidSignature", err)
+	}
+
+	// Certificate from another host
+	fields := notificationFields()
+	body = signMessage(t, key, "2", fields)
+	other := strings.Replace(string(body), "sns.us-west-1.amazonaws.com", "example.com", 1)
+	if err := verifier.Verify([]byte(other)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("certificate of another host: got %v, expected ErrInvalidSignature", err)
+	}
+
+	// Unsigned message and body which isn't JSON
+	unsigned, _ := json.Marshal(notificationFields())
+	for _, body := range [][]byte{unsigned, []byte("not json")} {
+		if err := verifier.Verify(body); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: got %v, expected ErrInvalidSignature", body, err)
+		}
+	}
+}
+
+func TestEventHandlerSignature(t *testing.T) {
+	verifier, key := newTestVerifier(t)
+	defer func(previous *SNSVerifier) { snsVerifier = previous }(snsVerifier)
+	snsVerifier = verifier
+	withConfig(t)
+
+	valid := signMessage(t, key, "2", notificationFields())
+	tampered := strings.Replace(string(valid), "data/test.json", "data/other.json", 1)
+	unsigned, _ := json.Marshal(notificationFields())
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"valid", string(valid), http.StatusOK},
+		{"tampered", tampered, http.StatusForbidden},
+		{"unsigned", string(unsigned), http.StatusForbidden},
+		{"not json", "not json", http.StatusForbidden},
+		{"unknown envelope", `{"hello":"world"}`, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		eventHandler(w, httptest.NewRequest(http.MethodPost, "/event", strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%v: status %v, expected %v: %s", test.name, w.Code, test.status, w.Body)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+	Define SQS Variables
+ **************************************************************/
+
+// Poller of the SQS queue, set in main when sqs.queueUrl is set
+var sqsPoller *SQSPoller
+
+// Settings of the SQS ingress
+type SQSConfig struct {
+	// URL of the queue receiving the S3 events (S3, SNS or EventBridge envelopes), polled when set (SQS_QUEUE_URL)
+	QueueURL string `json:"queueUrl,omitempty"`
+	// Messages received at once and processed at the same time, 1 to 10
+	MaxMessages int `json:"maxMessages,omitempty"`
+	// Time waiting for messages in a long poll, at most "20s"
+	WaitTime string `json:"waitTime,omitempty"`
+	// Visibility timeout of the messages, extended while they are processed, e.g. "2m" (SQS_VISIBILITY_TIMEOUT)
+	VisibilityTimeout string `json:"visibilityTimeout,omitempty"`
+
+	waitTime          time.Duration
+	visibilityTimeout time.Duration
+}
+
+// Check the settings and parse the durations
+func (cfg *SQSConfig) Compile() error {
+	u, err := url.Parse(cfg.QueueURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("sqs.queueUrl %q is not a http(s) URL", cfg.QueueURL)
+	}
+	if cfg.MaxMessages < 1 || cfg.MaxMessages > 10 {
+		return fmt.Errorf("sqs.maxMessages %v is not between 1 and 10", cfg.MaxMessages)
+	}
+	if cfg.waitTime, err = time.ParseDuration(cfg.WaitTime); err != nil || cfg.waitTime < 0 || cfg.waitTime > 20*time.Second {
+		return fmt.Errorf("sqs.waitTime %q is not a duration of at most 20s", cfg.WaitTime)
+	}
+	if cfg.visibilityTimeout, err = time.ParseDuration(cfg.VisibilityTimeout); err != nil || cfg.visibilityTimeout < 10*time.Second || cfg.visibilityTimeout > 12*time.Hour {
+		return fmt.Errorf("sqs.visibilityTimeout %q is not a duration between 10s and 12h", cfg.VisibilityTimeout)
+	}
+	return nil
+}
+
+/**************************************************************
+	MessageQueue abstracts the queue of the S3 notifications
+	polled by the SQSPoller (SQS, or a fake in tests)
+ **************************************************************/
+type MessageQueue interface {
+	// Wait for messages, hidden from other receivers until their visibility timeout
+	Receive(ctx context.Context) ([]QueueMessage, error)
+	// Hide message from other receivers for timeout from now
+	Extend(message QueueMessage, timeout time.Duration) error
+	// Delete message, once processed
+	Delete(message QueueMessage) error
+}
+
+// Message received from a MessageQueue
+type QueueMessage struct {
+	ID      string
+	Receipt string
+	Body    string
+	// Times the message was received, this time included
+	ReceiveCount int
+}
+
+/**************************************************************
+	SQSQueue is the MessageQueue backed by AWS SQS
+ **************************************************************/
+type SQSQueue struct {
+	client   *sqs.SQS
+	queueURL string
+	cfg      SQSConfig
+}
+
+// Create a SQSQueue of cfg.QueueURL sharing the session sess, calling the host of the URL (e.g. a local SQS)
+func NewSQSQueue(sess *session.Session, cfg SQSConfig) (*SQSQueue, error) {
+	u, err := url.Parse(cfg.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	client := sqs.New(sess, &aws.Config{Endpoint: aws.String(u.Scheme + "://" + u.Host)})
+	return &SQSQueue{client: client, queueURL: cfg.QueueURL, cfg: cfg}, nil
+}
+
+func (queue *SQSQueue) Receive(ctx context.Context) ([]QueueMessage, error) {
+	output, err := queue.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queue.queueURL),
+		MaxNumberOfMessages: aws.Int64(int64(queue.cfg.MaxMessages)),
+		WaitTimeSeconds:     aws.Int64(int64(queue.cfg.waitTime / time.Second)),
+		VisibilityTimeout:   aws.Int64(int64(queue.cfg.visibilityTimeout / time.Second)),
+		AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []QueueMessage{}
+	for _, message := range output.Messages {
+		count, _ := strconv.Atoi(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+		if count < 1 {
+			count = 1
+		}
+		messages = append(messages, QueueMessage{
+			ID:           aws.StringValue(message.MessageId),
+			Receipt:      aws.StringValue(message.ReceiptHandle),
+			Body:         aws.StringValue(message.Body),
+			ReceiveCount: count,
+		})
+	}
+	return messages, nil
+}
+
+func (queue *SQSQueue) Extend(message QueueMessage, timeout time.Duration) error {
+	_, err := queue.client.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queue.queueURL),
+		ReceiptHandle:     aws.String(message.Receipt),
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	})
+	return err
+}
+
+func (queue *SQSQueue) Delete(message QueueMessage) error {
+	_, err := queue.client.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queue.queueURL),
+		ReceiptHandle: aws.String(message.Receipt),
+	})
+	return err
+}
+
+/**************************************************************
+	SQSPoller long-polls a MessageQueue of S3 notifications,
+	processing the records of each message while extending
+	its visibility. A message is deleted once its records are
+	processed, or parked in error/ when they failed with a
+	permanent error or for the last attempt; otherwise it is
+	received again after a backoff delay.
+ **************************************************************/
+type SQSPoller struct {
+	queue      MessageQueue
+	visibility time.Duration
+	policy     RetryPolicy
+	process    func(record RecordType) error
+	park       func(record RecordType, attempts []Attempt) error
+
+	mutex  sync.Mutex
+	stats  SQSStats
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Counters of the SQS poller
+type SQSStats struct {
+	// Messages received, received again included
+	Received int64 `json:"received"`
+	// Messages being processed
+	Busy int `json:"busy"`
+	// Messages processed and deleted
+	Deleted int64 `json:"deleted"`
+	// Messages failing, received again later
+	Retries int64 `json:"retries"`
+	// Records given up and parked in error/
+	Parked int64 `json:"parked"`
+	// Messages which aren't S3 notifications
+	Invalid int64 `json:"invalid"`
+	// Visibility timeouts extended
+	Extended int64 `json:"extended"`
+	// Errors receiving, extending or deleting messages
+	Errors int64 `json:"errors"`
+}
+
+/**************************************************************
+	Create a SQSPoller of queue, hiding the messages being
+	processed for visibility at a time. Records are processed
+	with process, and given to park after policy.MaxAttempts
+	receptions or with a permanent error.
+ **************************************************************/
+func NewSQSPoller(queue MessageQueue, visibility time.Duration, policy RetryPolicy, process func(record RecordType) error, park func(record RecordType, attempts []Attempt) error) *SQSPoller {
+	return &SQSPoller{queue: queue, visibility: visibility, policy: policy, process: process, park: park}
+}
+
+// Poll the queue until Stop
+func (poller *SQSPoller) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	poller.cancel, poller.done = cancel, make(chan struct{})
+	go func() {
+		defer close(poller.done)
+		for ctx.Err() == nil {
+			messages, err := poller.queue.Receive(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				Error("Error receiving SQS messages: %v", err)
+				poller.count(func(stats *SQSStats) { stats.Errors++ })
+				select {
+				case <-time.After(poller.policy.Delay(1)):
+				case <-ctx.Done():
+				}
+				continue
+			}
+
+			// Process the messages received together, the next poll waits for them
+			var wait sync.WaitGroup
+			for _, message := range messages {
+				wait.Add(1)
+				go func(message QueueMessage) {
+					defer wait.Done()
+					poller.handle(message)
+				}(message)
+			}
+			wait.Wait()
+		}
+	}()
+}
+
+/**************************************************************
+	Stop polling, and wait until the messages being processed
+	are done or ctx is done. Messages not done are received
+	again once their visibility timeout expires.
+ **************************************************************/
+func (poller *SQSPoller) Stop(ctx context.Context) error {
+	if poller.cancel == nil {
+		return nil
+	}
+	poller.cancel()
+	select {
+	case <-poller.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Counters of the poller
+func (poller *SQSPoller) Stats() SQSStats {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	return poller.stats
+}
+
+// Update the counters
+func (poller *SQSPoller) count(update func(stats *SQSStats)) {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	update(&poller.stats)
+}
+
+/**************************************************************
+	Process the records of message, extending its visibility
+	until done, then delete it or leave it for a retry
+ **************************************************************/
+func (poller *SQSPoller) handle(message QueueMessage) {
+	poller.count(func(stats *SQSStats) { stats.Received++; stats.Busy++ })
+	defer poller.count(func(stats *SQSStats) { stats.Busy-- })
+	lastAttempt := message.ReceiveCount >= poller.policy.MaxAttempts
+
+	// Keep the message hidden while its records are processed
+	stopHeartbeat := poller.heartbeat(message)
+	defer stopHeartbeat()
+
+	event, err := NormalizeS3Event([]byte(message.Body))
+	if err != nil {
+		stopHeartbeat()
+		Error("Error with SQS message %v (received %v times): %v: %s", message.ID, message.ReceiveCount, err, message.Body)
+		poller.count(func(stats *SQSStats) { stats.Invalid++ })
+		if lastAttempt {
+			poller.delete(message)
+		}
+		return
+	}
+
+	// Process each record matching an event rule, parking those which can't be retried
+	retry := false
+	for _, record := range config.FilterEvents(event.Records) {
+		err := poller.process(record)
+		if err == nil {
+			continue
+		}
+		bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+		if !IsPermanent(err) && !lastAttempt {
+			Info("Attempt %v of s3://%v/%v failed, retrying: %v", message.ReceiveCount, bucket, key, err)
+			retry = true
+			continue
+		}
+		if err := poller.park(record, []Attempt{NewAttempt(err)}); err != nil {
+			Error("Error parking s3://%v/%v, message %v kept: %v", bucket, key, message.ID, err)
+			retry = true
+			continue
+		}
+		poller.count(func(stats *SQSStats) { stats.Parked++ })
+	}
+
+	stopHeartbeat()
+	if retry {
+		// Receive the message again after a backoff delay, its processed records being skipped by the ledger
+		poller.count(func(stats *SQSStats) { stats.Retries++ })
+		if err := poller.queue.Extend(message, poller.policy.Delay(message.ReceiveCount)); err != nil {
+			Error("Error delaying SQS message %v: %v", message.ID, err)
+			poller.count(func(stats *SQSStats) { stats.Errors++ })
+		}
+		return
+	}
+	poller.delete(message)
+}
+
+// Extend the visibility of message every half visibility timeout, until the returned function is called
+func (poller *SQSPoller) heartbeat(message QueueMessage) func() {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(poller.visibility / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := poller.queue.Extend(message, poller.visibility); err != nil {
+					Error("Error extending visibility of SQS message %v: %v", message.ID, err)
+					poller.count(func(stats *SQSStats) { stats.Errors++ })
+					continue
+				}
+				Debug("Visibility of SQS message %v extended by %v", message.ID, poller.visibility)
+				poller.count(func(stats *SQSStats) { stats.Extended++ })
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+		<-stopped
+	}
+}
+
+// Delete message once done
+func (poller *SQSPoller) delete(message QueueMessage) {
+	if err := poller.queue.Delete(message); err != nil {
+		Error("Error deleting SQS message %v: %v", message.ID, err)
+		poller.count(func(stats *SQSStats) { stats.Errors++ })
+		return
+	}
+	Debug("SQS message %v deleted", message.ID)
+	poller.count(func(stats *SQSStats) { stats.Deleted++ })
+}
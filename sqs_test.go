@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake MessageQueue recording the calls of the poller
+type fakeQueue struct {
+	mutex    sync.Mutex
+	messages []QueueMessage
+	extended []time.Duration
+	deleted  []string
+}
+
+func (queue *fakeQueue) Receive(ctx context.Context) ([]QueueMessage, error) {
+	queue.mutex.Lock()
+	messages := queue.messages
+	queue.messages = nil
+	queue.mutex.Unlock()
+	if len(messages) > 0 {
+		return messages, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (queue *fakeQueue) Extend(message QueueMessage, timeout time.Duration) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.extended = append(queue.extended, timeout)
+	return nil
+}
+
+func (queue *fakeQueue) Delete(message QueueMessage) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.deleted = append(queue.deleted, message.ID)
+	return nil
+}
+
+// S3 notification of data/test.json, the body of the SQS messages
+const sqsTestBody = `{"Records":[{"eventVersion":"2.1","eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"deglon"},"object":{"key":"data/test.json","sequencer":"005E8B9B6A4B5B3B5C"}}}]}`
+
+func testRetryPolicy(t *testing.T) RetryPolicy {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: "1s", MaxDelay: "1m"}
+	if err := policy.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestSQSPollerHandle(t *testing.T) {
+	withConfig(t)
+	transient := errors.New("S3 unavailable")
+
+	tests := []struct {
+		name         string
+		body         string
+		receiveCount int
+		processErr   error
+		parkErr      error
+		deleted      bool
+		retried      bool // Extended by the backoff delay
+		parked       int
+	}{
+		{name: "processed", body: sqsTestBody, receiveCount: 1, deleted: true},
+		{name: "transient error", body: sqsTestBody, receiveCount: 1, processErr: transient, retried: true},
+		{name: "transient error, last attempt", body: sqsTestBody, receiveCount: 3, processErr: transient, deleted: true, parked: 1},
+		{name: "permanent error", body: sqsTestBody, receiveCount: 1, processErr: Permanent(errors.New("invalid JSON")), deleted: true, parked: 1},
+		{name: "park error", body: sqsTestBody, receiveCount: 3, processErr: transient, parkErr: transient, retried: true},
+		{name: "invalid message", body: `{"hello":"world"}`, receiveCount: 1},
+		{name: "invalid message, last attempt", body: `{"hello":"world"}`, receiveCount: 3, deleted: true},
+	}
+	for _, test := range tests {
+		queue := &fakeQueue{}
+		parked := 0
+		poller := NewSQSPoller(queue, time.Hour, testRetryPolicy(t),
+			func(record RecordType) error { return test.processErr },
+			func(record RecordType, attempts []Attempt) error {
+				if len(attempts) != 1 || record.S3.Object.Key != "data/test.json" {
+					t.Errorf("%v: parked %v with %+v", test.name, record.S3.Object.Key, attempts)
+				}
+				if test.parkErr != nil {
+					return test.parkErr
+				}
+				parked++
+				return nil
+			})
+
+		poller.handle(QueueMessage{ID: "1", Receipt: "r1", Body: test.body, ReceiveCount: test.receiveCount})
+		if deleted := len(queue.deleted) == 1; deleted != test.deleted {
+			t.Errorf("%v: deleted %v, expected %v", test.name, queue.deleted, test.deleted)
+		}
+		if retried := len(queue.extended) == 1; retried != test.retried {
+			t.Errorf("%v: extended %v, expected a retry %v", test.name, queue.extended, test.retried)
+		} else if delay := time.Second << (test.receiveCount - 1); retried && (queue.extended[0] < delay/2 || queue.extended[0] > delay) {
+			t.Errorf("%v: retried after %v, expected the backoff delay of attempt %v", test.name, queue.extended[0], test.receiveCount)
+		}
+		if parked != test.parked {
+			t.Errorf("%v: %v parked, expected %v", test.name, parked, test.parked)
+		}
+		if stats := poller.Stats(); stats.Received != 1 || stats.Busy != 0 || stats.Parked != int64(test.parked) {
+			t.Errorf("%v: stats %+v", test.name, stats)
+		}
+	}
+}
+
+func TestSQSPollerHeartbeat(t *testing.T) {
+	withConfig(t)
+
+	// Records processed for 3 half visibility timeouts, the message is deleted once done
+	queue := &fakeQueue{messages: []QueueMessage{{ID: "1", Body: sqsTestBody, ReceiveCount: 1}}}
+	done := make(chan struct{})
+	poller := NewSQSPoller(queue, 40*time.Millisecond, testRetryPolicy(t),
+		func(record RecordType) error {
+			defer close(done)
+			time.Sleep(70 * time.Millisecond)
+			return nil
+		},
+		func(record RecordType, attempts []Attempt) error { return nil })
+	poller.Start()
+	<-done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := poller.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if len(queue.extended) < 1 || queue.extended[0] != 40*time.Millisecond {
+		t.Errorf("extended %v, expected the visibility timeout", queue.extended)
+	}
+	if len(queue.deleted) != 1 {
+		t.Errorf("deleted %v", queue.deleted)
+	}
+	if stats := poller.Stats(); stats.Extended != int64(len(queue.extended)) || stats.Deleted != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// Message of the fake SQS server
+type fakeSQSMessage struct {
+	id, body     string
+	receiveCount int
+	visible      bool
+}
+
+// Fake SQS server speaking the JSON protocol of the SDK, recording the calls
+type fakeSQS struct {
+	t        *testing.T
+	queueURL string
+
+	mutex    sync.Mutex
+	messages []*fakeSQSMessage
+	received []map[string]interface{} // Requests of ReceiveMessage
+	changed  []string                 // Receipt handle and visibility timeout of ChangeMessageVisibility
+	deleted  []string                 // Receipt handles of DeleteMessage
+}
+
+// Receipt handle of a reception of the message
+func (message *fakeSQSMessage) receipt() string {
+	return fmt.Sprintf("%v-%v", message.id, message.receiveCount)
+}
+
+func (queue *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		queue.t.Errorf("request: %v", err)
+	}
+	if request["QueueUrl"] != queue.queueURL {
+		queue.t.Errorf("queue URL %v, expected %v", request["QueueUrl"], queue.queueURL)
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	switch action := r.Header.Get("X-Amz-Target"); action {
+	case "AmazonSQS.ReceiveMessage":
+		queue.received = append(queue.received, request)
+		messages := []map[string]interface{}{}
+		for _, message := range queue.messages {
+			if !message.visible {
+				continue
+			}
+			message.visible = false
+			message.receiveCount++
+			messages = append(messages, map[string]interface{}{
+				"MessageId":     message.id,
+				"ReceiptHandle": message.receipt(),
+				"Body":          message.body,
+				"MD5OfBody":     fmt.Sprintf("%x", md5.Sum([]byte(message.body))),
+				"Attributes":    map[string]string{"ApproximateReceiveCount": strconv.Itoa(message.receiveCount)},
+			})
+		}
+		if len(messages) == 0 {
+			// Long poll, shortened
+			queue.mutex.Unlock()
+			select {
+			case <-time.After(20 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+			queue.mutex.Lock()
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Messages": messages})
+
+	case "AmazonSQS.ChangeMessageVisibility":
+		queue.changed = append(queue.changed, fmt.Sprintf("%v %v", request["ReceiptHandle"], request["VisibilityTimeout"]))
+		for _, message := range queue.messages {
+			if message.receipt() == request["ReceiptHandle"] && request["VisibilityTimeout"] == 0.0 {
+				message.visible = true
+			}
+		}
+		fmt.Fprint(w, "{}")
+
+	case "AmazonSQS.DeleteMessage":
+		queue.deleted = append(queue.deleted, fmt.Sprint(request["ReceiptHandle"]))
+		for i, message := range queue.messages {
+			if message.receipt() == request["ReceiptHandle"] {
+				queue.messages = append(queue.messages[:i], queue.messages[i+1:]...)
+				break
+			}
+		}
+		fmt.Fprint(w, "{}")
+
+	default:
+		queue.t.Errorf("unexpected action %q", action)
+		http.Error(w, `{"__type":"InvalidAction"}`, http.StatusBadRequest)
+	}
+}
+
+// SQSQueue of a fake SQS server with messages, its session without endpoint
+func newFakeSQS(t *testing.T, messages ...*fakeSQSMessage) (*fakeSQS, *SQSQueue) {
+	fake := &fakeSQS{t: t, messages: messages}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.queueURL = server.URL + "/123456789012/events"
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("AKIDTEST", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := SQSConfig{QueueURL: fake.queueURL, MaxMessages: 10, WaitTime: "1s", VisibilityTimeout: "30s"}
+	if err := cfg.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	// The client calls the host of the queue URL
+	queue, err := NewSQSQueue(sess, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, queue
+}
+
+func TestSQSQueue(t *testing.T) {
+	fake, queue := newFakeSQS(t, &fakeSQSMessage{id: "1", body: sqsTestBody, receiveCount: 2, visible: true})
+
+	messages, err := queue.Receive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != "1" || messages[0].Receipt != "1-3" || messages[0].Body != sqsTestBody || messages[0].ReceiveCount != 3 {
+		t.Fatalf("messages %+v", messages)
+	}
+	request := fake.received[0]
+	if request["MaxNumberOfMessages"] != 10.0 || request["WaitTimeSeconds"] != 1.0 || request["VisibilityTimeout"] != 30.0 || fmt.Sprint(request["AttributeNames"]) != "[ApproximateReceiveCount]" {
+		t.Errorf("ReceiveMessage %v", request)
+	}
+
+	if err := queue.Extend(messages[0], 45*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Delete(messages[0]); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(fake.changed, ",") != "1-3 45" || strings.Join(fake.deleted, ",") != "1-3" || len(fake.messages) != 0 {
+		t.Errorf("changed %v, deleted %v, messages left %v", fake.changed, fake.deleted, len(fake.messages))
+	}
+
+	// Without ApproximateReceiveCount, the message is received for the first time
+	fake.messages = []*fakeSQSMessage{{id: "2", body: sqsTestBody, visible: true}}
+	if messages, err := queue.Receive(context.Background()); err != nil || len(messages) != 1 || messages[0].ReceiveCount != 1 {
+		t.Errorf("messages %+v, %v", messages, err)
+	}
+}
+
+func TestSQSPollerServer(t *testing.T) {
+	withConfig(t)
+	failing := strings.Replace(sqsTestBody, "data/test.json", "data/fail.json", 1)
+	fake, queue := newFakeSQS(t,
+		&fakeSQSMessage{id: "1", body: sqsTestBody, visible: true},
+		&fakeSQSMessage{id: "2", body: failing, visible: true},
+	)
+
+	// A policy without delay, retried messages are visible again at once
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: "1ms", MaxDelay: "1ms"}
+	if err := policy.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	parked := []string{}
+	poller := NewSQSPoller(queue, time.Hour, policy,
+		func(record RecordType) error {
+			if record.S3.Object.Key == "data/fail.json" {
+				return errors.New("S3 unavailable")
+			}
+			return nil
+		},
+		func(record RecordType, attempts []Attempt) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			parked = append(parked, record.S3.Object.Key)
+			return nil
+		})
+	poller.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && poller.Stats().Deleted < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := poller.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failing message is retried, then parked on its third reception
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if strings.Join(fake.changed, ",") != "2-1 0,2-2 0" {
+		t.Errorf("changed %v", fake.changed)
+	}
+	if strings.Join(fake.deleted, ",") != "1-1,2-3" || len(fake.messages) != 0 {
+		t.Errorf("deleted %v, messages left %v", fake.deleted, len(fake.messages))
+	}
+	if strings.Join(parked, ",") != "data/fail.json" {
+		t.Errorf("parked %v", parked)
+	}
+	if stats := poller.Stats(); stats.Received != 4 || stats.Retries != 2 || stats.Parked != 1 || stats.Deleted != 2 || stats.Errors != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
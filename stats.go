@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+/**************************************************************
+	Define /stats Handler, the counters of the application
+ **************************************************************/
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	Info(">>>>> statsHandler")
+
+	stats := map[string]interface{}{
+		"ledger": ledger.Stats(),
+		"events": eventCounters.Stats(),
+	}
+	if workQueue != nil {
+		stats["queue"] = workQueue.Stats()
+	}
+	if sqsPoller != nil {
+		stats["sqs"] = sqsPoller.Stats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		Error("Error encoding stats: %v", err)
+	}
+}
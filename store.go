@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"io"
+	"strings"
+	"time"
+)
+
+/**************************************************************
+	Define Object Store Variables
+ **************************************************************/
+
+// Error returned when an object doesn't exist in the store
+var ErrObjectNotFound = errors.New("object not found")
+
+// Object store used by the event handler, set in main
+var objectStore ObjectStore
+
+/**************************************************************
+	ObjectStore abstracts the bucket holding the data/,
+	processed/ and error/ files (S3, memory or local folder)
+ **************************************************************/
+type ObjectStore interface {
+	// Read the content of bucket/key
+	Get(bucket, key string) ([]byte, error)
+	// Stream the content of bucket/key, the caller closes the reader
+	Open(bucket, key string) (io.ReadCloser, *ObjectInfo, error)
+	// Write the content of body to bucket/key, streaming it
+	Put(bucket, key string, body io.Reader) error
+	// Copy sourceBucket/sourceKey to bucket/key
+	Copy(sourceBucket, sourceKey, bucket, key string) error
+	// Describe bucket/key, ErrObjectNotFound if it doesn't exist
+	Head(bucket, key string) (*ObjectInfo, error)
+	// List objects of bucket with keys starting with prefix, sorted by key
+	List(bucket, prefix string) ([]ObjectInfo, error)
+	// Delete bucket/key, deleting a missing object is not an error
+	Delete(bucket, key string) error
+}
+
+// Description of an object in an ObjectStore
+type ObjectInfo struct {
+	Key             string    `json:"key"`
+	Size            int64     `json:"size"`
+	ETag            string    `json:"eTag,omitempty"`
+	LastModified    time.Time `json:"lastModified"`
+	ContentType     string    `json:"contentType,omitempty"`
+	ContentEncoding string    `json:"contentEncoding,omitempty"`
+}
+
+/**************************************************************
+	Create the ObjectStore from its name: "s3" (using the
+	shared session sess), "memory" or "file:<folder>"
+ **************************************************************/
+func NewObjectStore(name string, sess *session.Session) (ObjectStore, error) {
+	switch {
+	case name == "s3":
+		if sess == nil {
+			return nil, fmt.Errorf("object store s3 requires an AWS session")
+		}
+		return NewS3Store(sess, config.AWS.S3Config()), nil
+	case name == "memory":
+		return NewMemoryStore(), nil
+	case strings.HasPrefix(name, "file:"):
+		return NewFileStore(strings.TrimPrefix(name, "file:"))
+	}
+	return nil, fmt.Errorf("unknown object store %q", name)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+	Define SNS Subscription Variables
+ **************************************************************/
+
+// HTTP client used to call SubscribeURL, replace it to talk to a local fake SNS
+var snsHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// Subscriptions confirmed automatically, for the topics of config.SNSTopicArns (set in main)
+var subscriptions = NewSubscriptionRegistry(nil)
+
+// Subscription status values
+const (
+	SubscriptionPending      = "pending"
+	SubscriptionConfirmed    = "confirmed"
+	SubscriptionRejected     = "rejected"
+	SubscriptionFailed       = "failed"
+	SubscriptionUnsubscribed = "unsubscribed"
+)
+
+// Current state of the subscription to a SNS topic
+type SubscriptionState struct {
+	TopicArn        string    `json:"topicArn"`
+	Status          string    `json:"status"`
+	SubscriptionArn string    `json:"subscriptionArn,omitempty"`
+	MessageId       string    `json:"messageId,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// Response of SNS to a GET on SubscribeURL
+type confirmSubscriptionResponse struct {
+	SubscriptionArn string `xml:"ConfirmSubscriptionResult>SubscriptionArn"`
+}
+
+/**************************************************************
+	SubscriptionRegistry confirms subscriptions to allowed
+	topics and keeps track of their state
+ **************************************************************/
+type SubscriptionRegistry struct {
+	mutex   sync.Mutex
+	allowed map[string]bool
+	states  map[string]*SubscriptionState
+}
+
+// Create a SubscriptionRegistry confirming subscriptions to topicArns
+func NewSubscriptionRegistry(topicArns []string) *SubscriptionRegistry {
+	registry := &SubscriptionRegistry{
+		allowed: map[string]bool{},
+		states:  map[string]*SubscriptionState{},
+	}
+	for _, arn := range topicArns {
+		if arn = strings.TrimSpace(arn); arn != "" {
+			registry.allowed[arn] = true
+		}
+	}
+	return registry
+}
+
+// Is the topic in the allowlist
+func (registry *SubscriptionRegistry) Allowed(topicArn string) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.allowed[topicArn]
+}
+
+// Record the state of the subscription to a topic
+func (registry *SubscriptionRegistry) set(state SubscriptionState) {
+	state.UpdatedAt = time.Now()
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.states[state.TopicArn] = &state
+}
+
+// List the current subscription states, sorted by TopicArn
+func (registry *SubscriptionRegistry) States() []SubscriptionState {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	states := []SubscriptionState{}
+	for _, state := range registry.states {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].TopicArn < states[j].TopicArn })
+	return states
+}
+
+/**************************************************************
+	Confirm a SubscriptionConfirmation event by calling its
+	SubscribeURL, when the topic is in the allowlist
+ **************************************************************/
+func (registry *SubscriptionRegistry) Confirm(event *EventType) error {
+	state := SubscriptionState{TopicArn: event.TopicArn, MessageId: event.MessageId}
+
+	if !registry.Allowed(event.TopicArn) {
+		Info("Not confirming subscription to %v (not in snsTopicArns), SubscribeURL: %v", event.TopicArn, event.SubscribeURL)
+		state.Status = SubscriptionRejected
+		registry.set(state)
+		return nil
+	}
+
+	subscriptionArn, err := confirmSubscription(event.SubscribeURL)
+	if err != nil {
+		Error("Error confirming subscription to %v: %v", event.TopicArn, err)
+		state.Status = SubscriptionFailed
+		state.Error = err.Error()
+		registry.set(state)
+		return err
+	}
+
+	Info("Subscription to %v confirmed: %v", event.TopicArn, subscriptionArn)
+	state.Status = SubscriptionConfirmed
+	state.SubscriptionArn = subscriptionArn
+	registry.set(state)
+	return nil
+}
+
+/**************************************************************
+	Record an UnsubscribeConfirmation event
+ **************************************************************/
+func (registry *SubscriptionRegistry) Unsubscribed(event *EventType) {
+	Info("Unsubscribed from %v", event.TopicArn)
+	registry.set(SubscriptionState{
+		TopicArn:  event.TopicArn,
+		MessageId: event.MessageId,
+		Status:    SubscriptionUnsubscribed,
+	})
+}
+
+// Call SubscribeURL and return the SubscriptionArn from the response
+func confirmSubscription(subscribeURL string) (string, error) {
+	if subscribeURL == "" {
+		return "", fmt.Errorf("missing SubscribeURL")
+	}
+
+	resp, err := snsHTTPClient.Get(subscribeURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("SubscribeURL returned %v", resp.Status)
+	}
+
+	var response confirmSubscriptionResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("decoding ConfirmSubscription response: %v", err)
+	}
+	return response.SubscriptionArn, nil
+}
+
+/**************************************************************
+	Define /subscriptions Handler listing subscription states
+ **************************************************************/
+func subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	Info(">>>>> subscriptionsHandler")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(subscriptions.States()); err != nil {
+		Error("Error encoding subscriptions: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Fake SNS answering the SubscribeURL calls
+type fakeSNS struct {
+	status int
+	calls  []string
+}
+
+func (sns *fakeSNS) RoundTrip(r *http.Request) (*http.Response, error) {
+	sns.calls = append(sns.calls, r.URL.String())
+	body := `<ConfirmSubscriptionResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/">
+  <ConfirmSubscriptionResult>
+    <SubscriptionArn>arn:aws:sns:us-west-1:123456789012:my-topic:2bcfbf39-05c3-41de-beaa-fcfcc21c8f55</SubscriptionArn>
+  </ConfirmSubscriptionResult>
+</ConfirmSubscriptionResponse>`
+	return &http.Response{
+		StatusCode: sns.status,
+		Status:     http.StatusText(sns.status),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Header:     http.Header{},
+		Request:    r,
+	}, nil
+}
+
+// Use sns as the SNS of the SubscribeURL calls until the test ends
+func useFakeSNS(t *testing.T, sns *fakeSNS) {
+	previous := snsHTTPClient
+	snsHTTPClient = &http.Client{Transport: sns}
+	t.Cleanup(func() { snsHTTPClient = previous })
+}
+
+func confirmationEvent(topicArn string) *EventType {
+	return &EventType{
+		Type:         "SubscriptionConfirmation",
+		MessageId:    "165545c9-2a5c-472c-8df2-7ff2be2b3b1b",
+		TopicArn:     topicArn,
+		SubscribeURL: "https://sns.us-west-1.amazonaws.com/?Action=ConfirmSubscription&TopicArn=" + topicArn + "&Token=2336412f37",
+	}
+}
+
+func TestSubscriptionConfirm(t *testing.T) {
+	allowed := "arn:aws:sns:us-west-1:123456789012:my-topic"
+	unknown := "arn:aws:sns:us-west-1:999999999999:other-topic"
+
+	tests := []struct {
+		name     string
+		topicArn string
+		status   int
+		expected string
+		calls    int
+		fails    bool
+	}{
+		{"allowed topic", allowed, http.StatusOK, SubscriptionConfirmed, 1, false},
+		{"unknown topic", unknown, http.StatusOK, SubscriptionRejected, 0, false},
+		{"SNS error", allowed, http.StatusForbidden, SubscriptionFailed, 1, true},
+	}
+	for _, test := range tests {
+		sns := &fakeSNS{status: test.status}
+		useFakeSNS(t, sns)
+		registry := NewSubscriptionRegistry([]string{allowed})
+
+		err := registry.Confirm(confirmationEvent(test.topicArn))
+		if (err != nil) != test.fails {
+			t.Errorf("%v: error %v", test.name, err)
+		}
+		if len(sns.calls) != test.calls {
+			t.Errorf("%v: %v calls to SNS, expected %v", test.name, len(sns.calls), test.calls)
+		}
+		states := registry.States()
+		if len(states) != 1 || states[0].TopicArn != test.topicArn || states[0].Status != test.expected {
+			t.Errorf("%v: states %+v, expected %v", test.name, states, test.expected)
+		}
+		if test.expected == SubscriptionConfirmed && !strings.HasPrefix(states[0].SubscriptionArn, allowed+":") {
+			t.Errorf("%v: subscription ARN %q", test.name, states[0].SubscriptionArn)
+		}
+	}
+}
+
+func TestSubscriptionsHandler(t *testing.T) {
+	useFakeSNS(t, &fakeSNS{status: http.StatusOK})
+	defer func(previous *SubscriptionRegistry) { subscriptions = previous }(subscriptions)
+	subscriptions = NewSubscriptionRegistry([]string{"arn:aws:sns:us-west-1:123456789012:b-topic"})
+
+	subscriptions.Confirm(confirmationEvent("arn:aws:sns:us-west-1:123456789012:b-topic"))
+	subscriptions.Confirm(confirmationEvent("arn:aws:sns:us-west-1:123456789012:a-topic"))
+	subscriptions.Unsubscribed(&EventType{Type: "UnsubscribeConfirmation", TopicArn: "arn:aws:sns:us-west-1:123456789012:c-topic"})
+
+	w := httptest.NewRecorder()
+	subscriptionsHandler(w, httptest.NewRequest(http.MethodGet, "/subscriptions", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	var states []SubscriptionState
+	if err := json.Unmarshal(w.Body.Bytes(), &states); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct{ topic, status string }{
+		{"a-topic", SubscriptionRejected},
+		{"b-topic", SubscriptionConfirmed},
+		{"c-topic", SubscriptionUnsubscribed},
+	}
+	if len(states) != len(expected) {
+		t.Fatalf("%v states, expected %v: %s", len(states), len(expected), w.Body)
+	}
+	for i, state := range states {
+		if !strings.HasSuffix(state.TopicArn, ":"+expected[i].topic) || state.Status != expected[i].status {
+			t.Errorf("state %v: %+v, expected %v %v", i, state, expected[i].topic, expected[i].status)
+		}
+	}
+}
@@ -81,7 +81,7 @@ func Info(format string, a ...interface{}) {
 	Info in file /var/log/web-1.log
  **************************************************************/
 func Error(format string, a ...interface{}) {
-	Info("ERROR: "+format, a)
+	Info("ERROR: "+format, a...)
 	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", a...)
 }
 
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+/**************************************************************
+	Rule checks the values of a column of a dataset, rows
+	breaking a rule are rejected
+ **************************************************************/
+type Rule struct {
+	// Column checked, a column of the dataset (derived columns included)
+	Column string `json:"column"`
+	// Value can't be null or empty
+	Required bool `json:"required,omitempty"`
+	// Range of numbers, included
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// Regular expression matching strings, e.g. "^[A-Z]{2}$"
+	Pattern string `json:"pattern,omitempty"`
+	// Allowed values
+	Enum []string `json:"enum,omitempty"`
+	// Most characters of strings
+	MaxLength int `json:"maxLength,omitempty"`
+
+	pattern *regexp.Regexp
+	enum    map[string]bool
+}
+
+// Check the rule against the columns of the dataset
+func (rule *Rule) compile(dataset *Dataset) error {
+	column, ok := dataset.Column(rule.Column)
+	if !ok {
+		return fmt.Errorf("rule of %v: not a column", rule.Column)
+	}
+	numeric := column.Type != "BOOLEAN" && column.Type != "BYTE_ARRAY"
+	if (rule.Min != nil || rule.Max != nil) && !numeric {
+		return fmt.Errorf("rule of %v: min and max require a number column", rule.Column)
+	}
+	if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+		return fmt.Errorf("rule of %v: min %v above max %v", rule.Column, *rule.Min, *rule.Max)
+	}
+	if (rule.Pattern != "" || rule.MaxLength != 0) && column.Type != "BYTE_ARRAY" {
+		return fmt.Errorf("rule of %v: pattern and maxLength require a BYTE_ARRAY column", rule.Column)
+	}
+	if rule.MaxLength < 0 {
+		return fmt.Errorf("rule of %v: maxLength %v is negative", rule.Column, rule.MaxLength)
+	}
+
+	rule.pattern = nil
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule of %v: pattern: %v", rule.Column, err)
+		}
+		rule.pattern = pattern
+	}
+	rule.enum = nil
+	if len(rule.Enum) > 0 {
+		rule.enum = map[string]bool{}
+		for _, value := range rule.Enum {
+			rule.enum[value] = true
+		}
+	}
+	return nil
+}
+
+// Reasons why value breaks the rule, none when valid
+func (rule *Rule) check(value interface{}) []string {
+	if value == nil || value == "" {
+		if rule.Required {
+			return []string{fmt.Sprintf("column %v: required", rule.Column)}
+		}
+		return nil
+	}
+
+	reasons := []string{}
+	if number, ok := toNumber(value); ok {
+		if rule.Min != nil && number < *rule.Min {
+			reasons = append(reasons, fmt.Sprintf("column %v: %v below min %v", rule.Column, value, *rule.Min))
+		}
+		if rule.Max != nil && number > *rule.Max {
+			reasons = append(reasons, fmt.Sprintf("column %v: %v above max %v", rule.Column, value, *rule.Max))
+		}
+	}
+	if s, ok := value.(string); ok {
+		if rule.pattern != nil && !rule.pattern.MatchString(s) {
+			reasons = append(reasons, fmt.Sprintf("column %v: %q doesn't match %v", rule.Column, s, rule.Pattern))
+		}
+		if rule.MaxLength > 0 && utf8.RuneCountInString(s) > rule.MaxLength {
+			reasons = append(reasons, fmt.Sprintf("column %v: %v characters, more than %v", rule.Column, utf8.RuneCountInString(s), rule.MaxLength))
+		}
+	}
+	if rule.enum != nil && !rule.enum[fmt.Sprint(value)] {
+		reasons = append(reasons, fmt.Sprintf("column %v: %v not in %v", rule.Column, value, strings.Join(rule.Enum, ", ")))
+	}
+	return reasons
+}
+
+// Value of a number column as a float64
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+/**************************************************************
+	Reasons why the row breaks the rules of the dataset, none
+	when valid
+ **************************************************************/
+func (dataset *Dataset) Validate(row Row) []string {
+	reasons := []string{}
+	for i := range dataset.Rules {
+		reasons = append(reasons, dataset.Rules[i].check(row[dataset.Rules[i].Column])...)
+	}
+	return reasons
+}
+
+/**************************************************************
+	RejectPolicy decides when the invalid rows of a file are
+	written to rejected/ or fail the whole file
+ **************************************************************/
+type RejectPolicy struct {
+	// Most rows rejected in a file, by default 0: the first invalid row fails the whole file
+	MaxRows int `json:"maxRows,omitempty"`
+	// Most share of the rows of a file rejected, e.g. 0.01 for 1%, 0 for no limit
+	MaxRatio float64 `json:"maxRatio,omitempty"`
+}
+
+// Check the limits of the policy
+func (policy *RejectPolicy) Validate() error {
+	if policy.MaxRows < 0 {
+		return fmt.Errorf("reject.maxRows %v is negative", policy.MaxRows)
+	}
+	if policy.MaxRatio < 0 || policy.MaxRatio > 1 {
+		return fmt.Errorf("reject.maxRatio %v is not between 0 and 1", policy.MaxRatio)
+	}
+	return nil
+}
+
+// Row rejected, a line of the NDJSON file in rejected/
+type RejectedRow struct {
+	Record int      `json:"record,omitempty"`
+	Line   int      `json:"line,omitempty"`
+	Stage  string   `json:"stage"`
+	Errors []string `json:"errors"`
+	// Content of the row: its values, or the record, line or fields which couldn't be read
+	Row interface{} `json:"row"`
+}
+
+/**************************************************************
+	RowRejecter reads the valid rows of a RowReader, writing
+	the invalid ones (breaking the rules of the dataset, or
+	which couldn't be read) in a local NDJSON file, until the
+	reject policy of the dataset fails the file
+ **************************************************************/
+type RowRejecter struct {
+	rows    RowReader
+	dataset *Dataset
+	file    *os.File
+	encoder *json.Encoder
+	// Rows read, valid or not
+	read     int
+	rejected int
+}
+
+// Create a RowRejecter of the rows of dataset, the caller closes it
+func NewRowRejecter(rows RowReader, dataset *Dataset) *RowRejecter {
+	return &RowRejecter{rows: rows, dataset: dataset}
+}
+
+func (rejecter *RowRejecter) Next() (Row, error) {
+	for {
+		row, err := rejecter.rows.Next()
+		if err == io.EOF {
+			return nil, rejecter.checkRatio()
+		}
+
+		var rejected RejectedRow
+		if err != nil {
+			// Reject the rows which couldn't be read, unless the rest of the file can't be read
+			var rowError *RowError
+			if !errors.As(err, &rowError) || rowError.Content == nil {
+				return nil, err
+			}
+			rejected = RejectedRow{Record: rowError.Record, Line: rowError.Line, Stage: StageParse, Errors: []string{rowError.Err.Error()}, Row: rowError.Content}
+			var stageError *StageError
+			if errors.As(err, &stageError) {
+				rejected.Stage = stageError.Stage
+			}
+		}
+		rejecter.read++
+		if err == nil {
+			reasons := rejecter.dataset.Validate(row)
+			if len(reasons) == 0 {
+				return row, nil
+			}
+			rejected = RejectedRow{Record: rejecter.read, Stage: StageValidate, Errors: reasons, Row: row}
+			err = AtStage(StageValidate, &RowError{Record: rejecter.read, Err: errors.New(strings.Join(reasons, ", "))})
+		}
+
+		if err := rejecter.reject(&rejected, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Write the rejected row, or fail with err once more than MaxRows rows are rejected
+func (rejecter *RowRejecter) reject(rejected *RejectedRow, err error) error {
+	rejecter.rejected++
+	if rejecter.rejected > rejecter.dataset.Reject.MaxRows {
+		if rejecter.dataset.Reject.MaxRows == 0 {
+			return err
+		}
+		return fmt.Errorf("more than %v rows rejected (reject.maxRows), %w", rejecter.dataset.Reject.MaxRows, err)
+	}
+
+	if rejecter.file == nil {
+		file, err := ioutil.TempFile("", "rejected-*.ndjson")
+		if err != nil {
+			Error("Error creating file of rejected rows: %v", err)
+			return AtStage(StageWrite, err)
+		}
+		rejecter.file, rejecter.encoder = file, json.NewEncoder(file)
+	}
+	if err := rejecter.encoder.Encode(rejected); err != nil {
+		Error("Error writing rejected row: %v", err)
+		return AtStage(StageWrite, err)
+	}
+	return nil
+}
+
+// io.EOF, or the error failing the file when more than MaxRatio of its rows were rejected
+func (rejecter *RowRejecter) checkRatio() error {
+	policy := rejecter.dataset.Reject
+	if policy.MaxRatio > 0 && rejecter.read > 0 && float64(rejecter.rejected)/float64(rejecter.read) > policy.MaxRatio {
+		return AtStage(StageValidate, fmt.Errorf("%v of %v rows rejected, more than %v (reject.maxRatio)", rejecter.rejected, rejecter.read, policy.MaxRatio))
+	}
+	return io.EOF
+}
+
+// Number of rows rejected
+func (rejecter *RowRejecter) Rejected() int {
+	return rejecter.rejected
+}
+
+// Upload the rejected rows to bucket/key, if any
+func (rejecter *RowRejecter) Upload(store ObjectStore, bucket, key string) error {
+	if rejecter.file == nil {
+		return nil
+	}
+	if _, err := rejecter.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := store.Put(bucket, key, rejecter.file); err != nil {
+		Error("Error uploading rejected rows to s3://%v/%v: %v", bucket, key, err)
+		return err
+	}
+	return nil
+}
+
+// Remove the local file of the rejected rows
+func (rejecter *RowRejecter) Close() error {
+	if rejecter.file == nil {
+		return nil
+	}
+	rejecter.file.Close()
+	return os.Remove(rejecter.file.Name())
+}
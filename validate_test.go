@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Dataset of orders with rules, rejecting up to maxRows rows and maxRatio of the rows
+func orderDataset(t *testing.T, rules []Rule, reject RejectPolicy) *Dataset {
+	dataset := &Dataset{
+		Name: "orders",
+		Columns: []Column{
+			{Name: "amount", Type: "DOUBLE", Nullable: true},
+			{Name: "qty", Type: "INT64", Nullable: true},
+			{Name: "country", Type: "BYTE_ARRAY", LogicalType: "UTF8", Nullable: true},
+			{Name: "status", Type: "BYTE_ARRAY", LogicalType: "UTF8", Nullable: true},
+			{Name: "paid", Type: "BOOLEAN", Nullable: true},
+		},
+		Rules:  rules,
+		Reject: reject,
+	}
+	if err := dataset.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	return dataset
+}
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func TestRuleCheck(t *testing.T) {
+	tests := []struct {
+		rule    Rule
+		value   interface{}
+		reasons []string
+	}{
+		{Rule{Column: "country", Required: true}, "US", nil},
+		{Rule{Column: "country", Required: true}, "", []string{"column country: required"}},
+		{Rule{Column: "country", Required: true}, nil, []string{"column country: required"}},
+		{Rule{Column: "amount", Required: true}, 0.0, nil},
+
+		{Rule{Column: "amount", Min: float(0), Max: float(100)}, 0.0, nil},
+		{Rule{Column: "amount", Min: float(0), Max: float(100)}, 100.0, nil},
+		{Rule{Column: "amount", Min: float(0), Max: float(100)}, -0.5, []string{"column amount: -0.5 below min 0"}},
+		{Rule{Column: "amount", Min: float(0), Max: float(100)}, 100.5, []string{"column amount: 100.5 above max 100"}},
+		{Rule{Column: "qty", Min: float(1)}, int64(0), []string{"column qty: 0 below min 1"}},
+		{Rule{Column: "qty", Max: float(10)}, int64(11), []string{"column qty: 11 above max 10"}},
+		// Rules other than required aren't checked on null values
+		{Rule{Column: "amount", Min: float(0)}, nil, nil},
+
+		{Rule{Column: "country", Pattern: "^[A-Z]{2}$"}, "FR", nil},
+		{Rule{Column: "country", Pattern: "^[A-Z]{2}$"}, "fr", []string{`column country: "fr" doesn't match ^[A-Z]{2}$`}},
+		{Rule{Column: "country", Pattern: "^[A-Z]{2}$"}, "", nil},
+
+		{Rule{Column: "status", Enum: []string{"new", "paid"}}, "paid", nil},
+		{Rule{Column: "status", Enum: []string{"new", "paid"}}, "lost", []string{"column status: lost not in new, paid"}},
+		{Rule{Column: "qty", Enum: []string{"1", "2"}}, int64(2), nil},
+		{Rule{Column: "paid", Enum: []string{"true"}}, false, []string{"column paid: false not in true"}},
+
+		{Rule{Column: "status", MaxLength: 3}, "été", nil},
+		{Rule{Column: "status", MaxLength: 3}, "shipped", []string{"column status: 7 characters, more than 3"}},
+
+		// Every reason is reported
+		{Rule{Column: "country", Pattern: "^[A-Z]+$", MaxLength: 2}, "usa", []string{`column country: "usa" doesn't match ^[A-Z]+$`, "column country: 3 characters, more than 2"}},
+	}
+	for _, test := range tests {
+		dataset := orderDataset(t, []Rule{test.rule}, RejectPolicy{})
+		reasons := dataset.Validate(Row{test.rule.Column: test.value})
+		if strings.Join(reasons, "|") != strings.Join(test.reasons, "|") {
+			t.Errorf("%+v on %v: got %q, expected %q", test.rule, test.value, reasons, test.reasons)
+		}
+	}
+}
+
+func TestRuleCompileErrors(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		err  string
+	}{
+		{Rule{Column: "missing", Required: true}, "rule of missing: not a column"},
+		{Rule{Column: "country", Min: float(0)}, "min and max require a number column"},
+		{Rule{Column: "paid", Max: float(1)}, "min and max require a number column"},
+		{Rule{Column: "amount", Min: float(2), Max: float(1)}, "min 2 above max 1"},
+		{Rule{Column: "amount", Pattern: "^1"}, "pattern and maxLength require a BYTE_ARRAY column"},
+		{Rule{Column: "qty", MaxLength: 2}, "pattern and maxLength require a BYTE_ARRAY column"},
+		{Rule{Column: "status", MaxLength: -1}, "maxLength -1 is negative"},
+		{Rule{Column: "status", Pattern: "(["}, "rule of status: pattern:"},
+	}
+	for _, test := range tests {
+		dataset := &Dataset{
+			Name:    "orders",
+			Columns: orderDataset(t, nil, RejectPolicy{}).Columns,
+			Rules:   []Rule{test.rule},
+		}
+		if err := dataset.Compile(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: got %v, expected %q", test.rule, err, test.err)
+		}
+	}
+
+	for _, policy := range []RejectPolicy{{MaxRows: -1}, {MaxRatio: -0.1}, {MaxRatio: 1.5}} {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("%+v: no error", policy)
+		}
+	}
+}
+
+// NDJSON of n orders, the amount of the rows in invalid below the min 0
+func orderLines(n int, invalid map[int]bool) string {
+	var lines strings.Builder
+	for i := 1; i <= n; i++ {
+		amount := 10
+		if invalid[i] {
+			amount = -1
+		}
+		fmt.Fprintf(&lines, "{\"amount\": %v}\n", amount)
+	}
+	return lines.String()
+}
+
+func TestRowRejecterThresholds(t *testing.T) {
+	tests := []struct {
+		name     string
+		reject   RejectPolicy
+		rows     int
+		invalid  map[int]bool
+		valid    int
+		rejected int
+		err      string
+	}{
+		{"all valid", RejectPolicy{}, 10, nil, 10, 0, ""},
+		{"default fails at the first invalid row", RejectPolicy{}, 10, map[int]bool{4: true}, 3, 1, "record 4: column amount: -1 below min 0"},
+		{"up to maxRows", RejectPolicy{MaxRows: 2}, 10, map[int]bool{2: true, 8: true}, 8, 2, ""},
+		{"above maxRows", RejectPolicy{MaxRows: 2}, 10, map[int]bool{2: true, 5: true, 8: true}, 5, 3, "more than 2 rows rejected (reject.maxRows), record 8"},
+		{"up to maxRatio", RejectPolicy{MaxRows: 10, MaxRatio: 0.2}, 10, map[int]bool{1: true, 2: true}, 8, 2, ""},
+		{"above maxRatio", RejectPolicy{MaxRows: 10, MaxRatio: 0.2}, 10, map[int]bool{1: true, 2: true, 3: true}, 7, 3, "3 of 10 rows rejected, more than 0.2 (reject.maxRatio)"},
+		{"maxRatio 0 is no limit", RejectPolicy{MaxRows: 10}, 10, map[int]bool{1: true, 2: true, 3: true, 4: true, 5: true, 6: true}, 4, 6, ""},
+	}
+	for _, test := range tests {
+		dataset := orderDataset(t, []Rule{{Column: "amount", Min: float(0)}}, test.reject)
+		rejecter := NewRowRejecter(NewNDJSONReader(strings.NewReader(orderLines(test.rows, test.invalid)), dataset), dataset)
+		valid, err := 0, error(nil)
+		for {
+			var row Row
+			if row, err = rejecter.Next(); err != nil {
+				break
+			}
+			if row["amount"].(float64) < 0 {
+				t.Errorf("%v: invalid row %v", test.name, row)
+			}
+			valid++
+		}
+		rejecter.Close()
+
+		if test.err == "" && err != io.EOF {
+			t.Errorf("%v: %v", test.name, err)
+		}
+		if test.err != "" && (err == io.EOF || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%v: got %v, expected %q", test.name, err, test.err)
+		}
+		var stageError *StageError
+		if test.err != "" && (!errors.As(err, &stageError) || stageError.Stage != StageValidate) {
+			t.Errorf("%v: %v not at stage validate", test.name, err)
+		}
+		if valid != test.valid || rejecter.Rejected() != test.rejected {
+			t.Errorf("%v: %v valid and %v rejected rows, expected %v and %v", test.name, valid, rejecter.Rejected(), test.valid, test.rejected)
+		}
+	}
+}
+
+func TestRowRejecterUpload(t *testing.T) {
+	dataset := orderDataset(t, []Rule{
+		{Column: "amount", Min: float(0)},
+		{Column: "country", Required: true, Pattern: "^[A-Z]{2}$"},
+	}, RejectPolicy{MaxRows: 10})
+	content := `{"amount": 10, "country": "FR"}
+{"amount": -5, "country": "us"}
+not json
+{"amount": "ten", "country": "FR"}
+{"amount": 3, "country": "DE"}
+`
+	rejecter := NewRowRejecter(NewNDJSONReader(strings.NewReader(content), dataset), dataset)
+	defer rejecter.Close()
+	valid := 0
+	for {
+		_, err := rejecter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid++
+	}
+	if valid != 2 || rejecter.Rejected() != 3 {
+		t.Fatalf("%v valid and %v rejected rows", valid, rejecter.Rejected())
+	}
+
+	store := NewMemoryStore()
+	if err := rejecter.Upload(store, "deglon", "rejected/orders.json.ndjson"); err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := store.Get("deglon", "rejected/orders.json.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One JSON line per rejected row, with its position, stage, reasons and content
+	expected := []string{
+		`{"record":2,"stage":"validate","errors":["column amount: -5 below min 0","column country: \"us\" doesn't match ^[A-Z]{2}$"],"row":{"amount":-5,"country":"us","paid":null,"qty":null,"status":null}}`,
+		`{"line":3,"stage":"parse","errors":["invalid character 'o' in literal null (expecting 'u')"],"row":"not json"}`,
+		`{"line":4,"stage":"parse","errors":["column amount: strconv.ParseFloat: parsing \"ten\": invalid syntax"],"row":{"amount":"ten","country":"FR"}}`,
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(uploaded)))
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		var rejected RejectedRow
+		if err := json.Unmarshal(scanner.Bytes(), &rejected); err != nil {
+			t.Errorf("line %v: %v", len(lines), err)
+		}
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("rejected rows:\n%v\nexpected:\n%v", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// Without rejected rows, nothing is uploaded
+	empty := NewRowRejecter(NewNDJSONReader(strings.NewReader(`{"amount": 1, "country": "FR"}`), dataset), dataset)
+	defer empty.Close()
+	for _, err := empty.Next(); err == nil; _, err = empty.Next() {
+	}
+	if err := empty.Upload(store, "deglon", "rejected/empty.json.ndjson"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("deglon", "rejected/empty.json.ndjson"); err == nil {
+		t.Error("empty file of rejected rows uploaded")
+	}
+}